@@ -8,8 +8,10 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	random "math/rand"
 	"net/http"
 	"os"
@@ -17,13 +19,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Ireoo/sixin-server/common"
 	"github.com/Ireoo/sixin-server/config"
 	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/ratelimit"
 	"github.com/Ireoo/sixin-server/logger"
 	"github.com/Ireoo/sixin-server/models"
-	"github.com/gorilla/websocket"
 	"github.com/zishang520/socket.io/v2/socket"
 	"gopkg.in/gomail.v2"
+	"gorm.io/gorm"
 
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -47,12 +51,14 @@ type Base struct {
 	Config        map[string]interface{}
 	mu            sync.Mutex
 	IoManager     *socket.Server
-	WsManager     []*websocket.Conn
+	WsManager     common.WebSocketManager
 	DbManager     *database.DatabaseManager
+	RateLimiter   *ratelimit.Limiter // HTTP 和 Socket.IO 共用
+	Cfg           *config.Config
 }
 
 func NewBase(cfg *config.Config) *Base {
-	b := &Base{Folder: "./DATA"}
+	b := &Base{Folder: "./DATA", Cfg: cfg}
 
 	// 创建 DatabaseManager 实例
 	dbManager, err := database.NewDatabaseManager(database.DatabaseType(cfg.DBType), cfg.DBConn)
@@ -63,6 +69,15 @@ func NewBase(cfg *config.Config) *Base {
 
 	// 将数据库实例和管理器保存到 base 中
 	b.DbManager = dbManager
+	dbManager.OnMembershipChange = b.syncRoomSockets
+	dbManager.OnUserEvent = b.EmitToUsers
+
+	policies, err := ratelimit.ParsePolicies(cfg.RateLimits)
+	if err != nil {
+		logger.Error("解析限流策略失败:", err)
+		return nil
+	}
+	b.RateLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore(), policies)
 
 	b.loadConfig()
 
@@ -129,7 +144,12 @@ func (mh *Base) DownloadFile(url, outputPath string) error {
 }
 
 func (mh *Base) GenerateVerificationCode() string {
-	return fmt.Sprintf("%06d", random.Intn(900000)+100000)
+	// 使用 crypto/rand，验证码不能被预测
+	n, err := rand.Int(rand.Reader, big.NewInt(900000))
+	if err != nil {
+		return fmt.Sprintf("%06d", random.Intn(900000)+100000)
+	}
+	return fmt.Sprintf("%06d", n.Int64()+100000)
 }
 
 func (mh *Base) SendMessage(msg string) {
@@ -141,26 +161,30 @@ func (mh *Base) SendMessage(msg string) {
 	}
 
 	// 发送消息给 WebSocket 客户端
-	if mh.EmailNote {
-		mh.SendEmail()
+	if mh.EmailNote && mh.Cfg != nil && mh.Cfg.NotifyEmail != "" {
+		if err := mh.SendEmail(mh.Cfg.NotifyEmail, "sixin 通知", msg); err != nil {
+			fmt.Printf("Error sending email: %v\n", err)
+		}
 	}
 }
 
-func (mh *Base) SendEmail() {
-	m := gomail.NewMessage()
-	m.SetHeader("From", "2636466208@qq.com")
-	m.SetHeader("To", "19980108@qq.com")
-	m.SetHeader("Subject", "Verification code for registering integem.com")
-	verificationCode := mh.GenerateVerificationCode()
-	m.SetBody("text/html", fmt.Sprintf("The verification code you obtained is %s", verificationCode))
+// SendEmail 使用配置的 SMTP 服务器发送 HTML 邮件
+func (mh *Base) SendEmail(to, subject, body string) error {
+	if mh.Cfg == nil || mh.Cfg.SMTPHost == "" {
+		return fmt.Errorf("未配置 SMTP 服务器")
+	}
 
-	d := gomail.NewDialer("smtp.qq.com", 587, "2636466208@qq.com", "vvupgrgxbpoaeajj")
+	m := gomail.NewMessage()
+	m.SetHeader("From", mh.Cfg.SMTPFrom)
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
 
+	d := gomail.NewDialer(mh.Cfg.SMTPHost, mh.Cfg.SMTPPort, mh.Cfg.SMTPUsername, mh.Cfg.SMTPPassword)
 	if err := d.DialAndSend(m); err != nil {
-		fmt.Printf("Error sending email: %v\n", err)
-	} else {
-		fmt.Println("Email sent successfully")
+		return fmt.Errorf("发送邮件失败: %w", err)
 	}
+	return nil
 }
 
 func (mh *Base) set(key string, value interface{}) {
@@ -182,26 +206,217 @@ func (b *Base) SetIO(io *socket.Server) {
 	b.IoManager = io
 }
 
+func (b *Base) SetWebSocketManager(wsManager common.WebSocketManager) {
+	b.WsManager = wsManager
+}
+
 func (b *Base) SetDatabaseManager(dbManager *database.DatabaseManager) {
 
 	b.DbManager = dbManager
 }
 
-// 添加 sendMessageToUsers 方法
+// SendMessageToUsers 把消息推送给指定用户的所有实时连接（socket.io 和 WebSocket）
 func (b *Base) SendMessageToUsers(message interface{}, userIDs ...uint) {
-	for _, userID := range userIDs {
-		socketID := socket.SocketId(fmt.Sprintf("%d", userID))
-		clients := b.IoManager.Sockets().Sockets()
-		clients.Range(func(id socket.SocketId, client *socket.Socket) bool {
-			if client.Id() == socketID {
-				err := client.Emit("message", message)
-				if err != nil {
-					fmt.Printf("发送消息给用户 %d 失败: %v\n", userID, err)
-				}
-				return false
+	b.EmitToUsers("message", message, userIDs...)
+}
+
+// PostMessage 以 message.TalkerID 的身份发送消息：检查发送权限，保存后推送给会话参与者。
+// HTTP、socket.io、WebSocket 和定时消息都经过这里
+func (b *Base) PostMessage(message *models.Message) (models.FullMessage, error) {
+	if message.RoomID != 0 {
+		if _, err := b.DbManager.CheckRoomPermission(message.TalkerID, message.RoomID, database.ActionPost); err != nil {
+			return models.FullMessage{}, err
+		}
+	}
+	if err := b.DbManager.CreateMessage(message); err != nil {
+		return models.FullMessage{}, err
+	}
+
+	fullMessage, err := b.DbManager.GetFullMessage(message.ID, message.TalkerID)
+	if err != nil {
+		return fullMessage, fmt.Errorf("加载完整消息数据失败: %w", err)
+	}
+	b.DispatchMessage(fullMessage)
+	return fullMessage, nil
+}
+
+// DispatchMessage 推送新消息：群消息发送给房间当前的所有成员，单聊消息发送给双方。
+// HTTP、socket.io 和 WebSocket 发送的消息都经过这里
+func (b *Base) DispatchMessage(message models.FullMessage) {
+	if message.RoomID == 0 {
+		userIDs := []uint{message.TalkerID}
+		if message.ListenerID != 0 && message.ListenerID != message.TalkerID {
+			userIDs = append(userIDs, message.ListenerID)
+		}
+		b.SendMessageToUsers(message, userIDs...)
+		return
+	}
+
+	// 每个成员的事件序号不同，按成员分别记录和推送
+	memberIDs, err := b.DbManager.GetRoomMemberIDs(message.RoomID)
+	if err != nil {
+		logger.Error(fmt.Sprintf("获取房间 %d 成员失败:", message.RoomID), err)
+		return
+	}
+	b.SendMessageToUsers(message, memberIDs...)
+}
+
+// RoomSocketRoom 返回聊天房间对应的 socket.io 房间，成员的连接都会加入，用于不需要补发的房间内通知
+func RoomSocketRoom(roomID uint) socket.Room {
+	return socket.Room(fmt.Sprintf("room:%d", roomID))
+}
+
+// 成员加入或离开房间后，让该用户已有的 socket.io 连接同步加入或离开对应的房间
+func (b *Base) syncRoomSockets(userID, roomID uint, joined bool) {
+	if b.IoManager == nil {
+		return
+	}
+	sockets := b.IoManager.In(UserSocketRoom(userID))
+	if joined {
+		sockets.SocketsJoin(RoomSocketRoom(roomID))
+	} else {
+		sockets.SocketsLeave(RoomSocketRoom(roomID))
+	}
+}
+
+// SessionRoom 返回会话对应的 socket.io 房间，连接时加入，用于按会话断开连接
+func SessionRoom(sessionID uint) socket.Room {
+	return socket.Room(fmt.Sprintf("session:%d", sessionID))
+}
+
+// UserSocketRoom 返回用户对应的 socket.io 房间，用户的每个连接都会加入，用于向用户的所有设备推送
+func UserSocketRoom(userID uint) socket.Room {
+	return socket.Room(fmt.Sprintf("user:%d", userID))
+}
+
+// EventMeta 随需要补发的事件一起推送的第二个参数，客户端处理后用 Seq 确认
+type EventMeta struct {
+	Seq uint64 `json:"seq"`
+}
+
+// EmitToUsers 把事件记录到每个用户的事件日志，并推送给其所有在线连接（socket.io 和 WebSocket）。
+// 离线或断线的设备重连后按确认位置补发
+func (b *Base) EmitToUsers(event string, data interface{}, userIDs ...uint) {
+	if len(userIDs) == 0 {
+		return
+	}
+	events, err := b.DbManager.AppendUserEvents(event, data, userIDs...)
+	if err != nil {
+		// 记录失败时仍然推送给在线设备，只是无法补发
+		logger.Error(fmt.Sprintf("记录事件 %s 失败:", event), err)
+		events = make([]models.UserEvent, len(userIDs))
+		for i, userID := range userIDs {
+			events[i] = models.UserEvent{UserID: userID, Event: event}
+		}
+	}
+
+	for _, e := range events {
+		if b.IoManager != nil {
+			if err := b.IoManager.To(UserSocketRoom(e.UserID)).Emit(event, data, EventMeta{Seq: e.Seq}); err != nil {
+				logger.Error(fmt.Sprintf("推送事件 %s 失败:", event), err)
 			}
-			return true
-		})
+		}
+		if b.WsManager != nil {
+			b.WsManager.SendEvent(e.UserID, event, e.Seq, data)
+		}
+	}
+}
+
+// ReplayMissedEvents 按顺序把设备确认位置之后的事件交给 emit 重新推送，连接建立后调用
+func (b *Base) ReplayMissedEvents(userID, sessionID uint, emit func(event string, data interface{}, meta EventMeta)) error {
+	return b.DbManager.EachMissedEvent(sessionID, userID, func(e models.UserEvent, data interface{}) {
+		emit(e.Event, data, EventMeta{Seq: e.Seq})
+	})
+}
+
+// StartEventJanitor 定期清理过期和超出数量上限的事件
+func (b *Base) StartEventJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			pruned, err := b.DbManager.PruneUserEvents(b.Cfg.EventRetention, b.Cfg.EventMaxPerUser)
+			if err != nil {
+				logger.Error("清理事件日志失败:", err)
+				continue
+			}
+			if pruned > 0 {
+				logger.Info(fmt.Sprintf("已清理 %d 条事件日志", pruned))
+			}
+		}
+	}()
+}
+
+// StartScheduledDispatcher 每隔 interval 发送到期的定时消息。定时消息保存在数据库中，
+// 服务重启后继续发送；重启前发送到一半的消息重新排队，已经保存过的不会重复发送
+func (b *Base) StartScheduledDispatcher(interval time.Duration) {
+	if requeued, err := b.DbManager.RequeueScheduledMessages(); err != nil {
+		logger.Error("恢复定时消息失败:", err)
+	} else if requeued > 0 {
+		logger.Info(fmt.Sprintf("已重新排队 %d 条定时消息", requeued))
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			b.dispatchScheduledMessages()
+		}
+	}()
+}
+
+func (b *Base) dispatchScheduledMessages() {
+	now := time.Now()
+	ids, err := b.DbManager.DueScheduledMessages(now, 100)
+	if err != nil {
+		logger.Error("查询到期的定时消息失败:", err)
+		return
+	}
+	for _, id := range ids {
+		scheduled, err := b.DbManager.ClaimScheduledMessage(id, now)
+		if err != nil {
+			logger.Error(fmt.Sprintf("领取定时消息 %d 失败:", id), err)
+			continue
+		}
+		if scheduled == nil {
+			continue
+		}
+		if err := b.DbManager.FinishScheduledMessage(scheduled, b.sendScheduledMessage(scheduled)); err != nil {
+			logger.Error(fmt.Sprintf("记录定时消息 %d 的发送结果失败:", id), err)
+		}
+	}
+}
+
+func (b *Base) sendScheduledMessage(scheduled *models.ScheduledMessage) error {
+	existing, err := b.DbManager.GetMessageByID(scheduled.MsgID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		_, err = b.PostMessage(scheduled.ToMessage())
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if existing.TalkerID != scheduled.UserID {
+		return database.ErrDuplicateMsgID
+	}
+
+	// 上次发送时消息已保存但未记录结果，可能也没有推送，重新推送一次
+	fullMessage, err := b.DbManager.GetFullMessage(existing.ID, existing.TalkerID)
+	if err != nil {
+		return fmt.Errorf("加载完整消息数据失败: %w", err)
+	}
+	b.DispatchMessage(fullMessage)
+	return nil
+}
+
+// DisconnectSessions 断开与指定会话关联的所有实时连接（socket.io 和 WebSocket）
+func (b *Base) DisconnectSessions(sessionIDs ...uint) {
+	if b.IoManager != nil {
+		for _, sessionID := range sessionIDs {
+			b.IoManager.In(SessionRoom(sessionID)).DisconnectSockets(true)
+		}
+	}
+	if b.WsManager != nil {
+		b.WsManager.DisconnectSessions(sessionIDs...)
 	}
 }
 
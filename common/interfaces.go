@@ -9,6 +9,10 @@ import (
 type WebSocketManager interface {
 	HandleWebSocket(w http.ResponseWriter, r *http.Request)
 	SendMessage(channel string, message []byte)
+	// SendEvent 把带序号的事件发送给用户的所有连接
+	SendEvent(userID uint, event string, seq uint64, data interface{})
+	// DisconnectSessions 关闭属于指定登录会话的连接
+	DisconnectSessions(sessionIDs ...uint)
 }
 
 type DatabaseManager interface {
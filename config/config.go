@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"encoding/json"
 	"os"
@@ -20,6 +22,52 @@ type Config struct {
 	DBConn            string
 	TestMode          bool
 	EnableSomeFeature bool
+	// JWTSigningKeyID 当前用于签发 token 的密钥 ID (kid)
+	JWTSigningKeyID string
+	// JWTKeys 密钥列表，格式为 "kid:算法:密钥材料"，算法支持 HS256、RS256、EdDSA。
+	// HS256 的密钥材料为共享密钥，RS256/EdDSA 为 PEM 文件路径（私钥可签名和验证，公钥仅验证）。
+	// 轮换时保留旧密钥用于验证，直到其签发的 token 全部过期。
+	JWTKeys []string
+	// AccessTokenTTL 访问令牌有效期
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL 刷新令牌（会话）有效期，每次刷新都会顺延
+	RefreshTokenTTL time.Duration
+	// SMTP 发信配置，用于验证邮件和通知邮件
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	// NotifyEmail 接收系统通知邮件的地址，为空时不发送
+	NotifyEmail string
+	// PublicURL 服务对外访问地址，用于生成邮件中的链接
+	PublicURL string
+	// TOTPIssuer 两步验证器应用中显示的服务名称
+	TOTPIssuer string
+	// OIDC 登录配置，设置 OIDCIssuer 后启用，回调地址需在提供方注册
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	// RateLimits 限流策略，格式 "名称=次数/周期"。名称为 HTTP 路由模板（如 /api/message）
+	// 或 socket:事件名，"http" 和 "socket" 为未单独配置时的默认策略
+	RateLimits []string
+	// TrustedProxies 受信任的反向代理（CIDR 或 IP），只有来自这些地址的请求才使用
+	// X-Forwarded-For / X-Real-IP 中的客户端 IP，为空时始终使用连接的对端地址
+	TrustedProxies []string
+	// EventRetention 用户事件日志的保留时间，超过后即使设备未确认也会被清理
+	EventRetention time.Duration
+	// EventMaxPerUser 每个用户最多保留的事件数量
+	EventMaxPerUser int
+	// MessageEditWindow 消息发送后允许发送者编辑的时间
+	MessageEditWindow time.Duration
+	// MessageRecallWindow 消息发送后允许发送者撤回的时间，房间管理员撤回不受限制
+	MessageRecallWindow time.Duration
+	// ScheduledMessageMaxDelay 定时消息的发送时间最多可以设置在多久之后
+	ScheduledMessageMaxDelay time.Duration
+	// ScheduledMessageMaxPending 每个用户最多保留的待发送定时消息数量
+	ScheduledMessageMaxPending int
 }
 
 // InitConfig initializes and returns the application configuration
@@ -37,6 +85,31 @@ func InitConfig() *Config {
 	pflag.Int("port", 0, "服务器端口")
 	pflag.Bool("test", false, "测试模式，启动后立即关闭")
 	pflag.Bool("enable-feature", false, "是否启用某个功能")
+	pflag.String("jwt-kid", "", "签发 JWT 使用的密钥 ID")
+	pflag.String("jwt-keys", "", "JWT 密钥列表，逗号分隔，格式 kid:算法:密钥材料")
+	pflag.Duration("access-token-ttl", 0, "访问令牌有效期")
+	pflag.Duration("refresh-token-ttl", 0, "刷新令牌有效期")
+	pflag.String("smtp-host", "", "SMTP 服务器地址")
+	pflag.Int("smtp-port", 0, "SMTP 服务器端口")
+	pflag.String("smtp-username", "", "SMTP 用户名")
+	pflag.String("smtp-password", "", "SMTP 密码")
+	pflag.String("smtp-from", "", "发件人地址")
+	pflag.String("notify-email", "", "接收通知邮件的地址")
+	pflag.String("public-url", "", "服务对外访问地址")
+	pflag.String("totp-issuer", "", "两步验证器中显示的服务名称")
+	pflag.String("oidc-issuer", "", "OIDC 提供方地址")
+	pflag.String("oidc-client-id", "", "OIDC 客户端 ID")
+	pflag.String("oidc-client-secret", "", "OIDC 客户端密钥")
+	pflag.String("oidc-redirect-url", "", "OIDC 回调地址")
+	pflag.String("oidc-scopes", "", "OIDC 请求的 scope，逗号分隔")
+	pflag.String("rate-limits", "", "限流策略，逗号分隔，格式 名称=次数/周期")
+	pflag.String("trusted-proxies", "", "受信任的反向代理地址，逗号分隔，CIDR 或 IP")
+	pflag.Duration("event-retention", 0, "离线事件保留时间")
+	pflag.Int("event-max-per-user", 0, "每个用户最多保留的离线事件数量")
+	pflag.Duration("message-edit-window", 0, "消息可编辑时间")
+	pflag.Duration("message-recall-window", 0, "消息可撤回时间")
+	pflag.Duration("scheduled-message-max-delay", 0, "定时消息最长延迟时间")
+	pflag.Int("scheduled-message-max-pending", 0, "每个用户最多待发送的定时消息数量")
 	pflag.Parse()
 
 	// Bind command-line flags to viper
@@ -54,15 +127,54 @@ func InitConfig() *Config {
 	viper.SetDefault("db-type", "sqlite")
 	viper.SetDefault("db-uri", "./database.db")
 	viper.SetDefault("enable-feature", false)
+	viper.SetDefault("access-token-ttl", 15*time.Minute)
+	viper.SetDefault("refresh-token-ttl", 30*24*time.Hour)
+	viper.SetDefault("smtp-port", 587)
+	viper.SetDefault("totp-issuer", "sixin")
+	viper.SetDefault("oidc-scopes", "openid,profile,email")
+	viper.SetDefault("rate-limits", "http=600/1m,socket=600/1m,/api/register=5/1h,/api/login=20/1m,/api/message=60/1m,"+
+		"socket:message=60/1m,socket:createRoom=10/1m,socket:updateRoom=30/1m")
+	viper.SetDefault("event-retention", 7*24*time.Hour)
+	viper.SetDefault("event-max-per-user", 1000)
+	viper.SetDefault("message-edit-window", 24*time.Hour)
+	viper.SetDefault("message-recall-window", 2*time.Minute)
+	viper.SetDefault("scheduled-message-max-delay", 365*24*time.Hour)
+	viper.SetDefault("scheduled-message-max-pending", 100)
 
 	// Create Config instance
 	config := &Config{
-		Host:              getStringConfig("host"),
-		Port:              getIntConfig("port"),
-		DBType:            getStringConfig("db-type"),
-		DBConn:            getStringConfig("db-uri"),
-		TestMode:          viper.GetBool("test"),
-		EnableSomeFeature: viper.GetBool("enable-feature"),
+		Host:                getStringConfig("host"),
+		Port:                getIntConfig("port"),
+		DBType:              getStringConfig("db-type"),
+		DBConn:              getStringConfig("db-uri"),
+		TestMode:            viper.GetBool("test"),
+		EnableSomeFeature:   viper.GetBool("enable-feature"),
+		JWTSigningKeyID:     viper.GetString("jwt-kid"),
+		JWTKeys:             getListConfig("jwt-keys"),
+		AccessTokenTTL:      viper.GetDuration("access-token-ttl"),
+		RefreshTokenTTL:     viper.GetDuration("refresh-token-ttl"),
+		SMTPHost:            viper.GetString("smtp-host"),
+		SMTPPort:            viper.GetInt("smtp-port"),
+		SMTPUsername:        viper.GetString("smtp-username"),
+		SMTPPassword:        viper.GetString("smtp-password"),
+		SMTPFrom:            viper.GetString("smtp-from"),
+		NotifyEmail:         viper.GetString("notify-email"),
+		PublicURL:           strings.TrimRight(viper.GetString("public-url"), "/"),
+		TOTPIssuer:          viper.GetString("totp-issuer"),
+		OIDCIssuer:          strings.TrimRight(viper.GetString("oidc-issuer"), "/"),
+		OIDCClientID:        viper.GetString("oidc-client-id"),
+		OIDCClientSecret:    viper.GetString("oidc-client-secret"),
+		OIDCRedirectURL:     viper.GetString("oidc-redirect-url"),
+		OIDCScopes:          getListConfig("oidc-scopes"),
+		RateLimits:          getListConfig("rate-limits"),
+		TrustedProxies:      getListConfig("trusted-proxies"),
+		EventRetention:      viper.GetDuration("event-retention"),
+		EventMaxPerUser:     viper.GetInt("event-max-per-user"),
+		MessageEditWindow:   viper.GetDuration("message-edit-window"),
+		MessageRecallWindow: viper.GetDuration("message-recall-window"),
+
+		ScheduledMessageMaxDelay:   viper.GetDuration("scheduled-message-max-delay"),
+		ScheduledMessageMaxPending: viper.GetInt("scheduled-message-max-pending"),
 	}
 
 	// Validate the configuration
@@ -90,6 +202,17 @@ func getIntConfig(key string) int {
 	return viper.GetInt(key)
 }
 
+// getListConfig retrieves a comma separated list configuration value
+func getListConfig(key string) []string {
+	var values []string
+	for _, item := range strings.Split(viper.GetString(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
 // Validate checks the Config for required fields and valid values
 func (c *Config) Validate() error {
 	if c.DBConn == "" {
@@ -98,14 +221,35 @@ func (c *Config) Validate() error {
 	if c.Port <= 0 || c.Port > 65535 {
 		return fmt.Errorf("无效的服务器端口号: %d", c.Port)
 	}
+	if len(c.JWTKeys) > 0 && c.JWTSigningKeyID == "" {
+		return fmt.Errorf("配置了 JWT 密钥时必须指定签名密钥 ID (jwt-kid)")
+	}
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		return fmt.Errorf("令牌有效期必须大于 0")
+	}
+	if c.SMTPHost != "" && c.SMTPFrom == "" {
+		return fmt.Errorf("配置了 SMTP 服务器时必须设置发件人地址 (smtp-from)")
+	}
+	if c.OIDCIssuer != "" && (c.OIDCClientID == "" || c.OIDCRedirectURL == "") {
+		return fmt.Errorf("启用 OIDC 时必须设置客户端 ID (oidc-client-id) 和回调地址 (oidc-redirect-url)")
+	}
+	if c.EventRetention <= 0 || c.EventMaxPerUser <= 0 {
+		return fmt.Errorf("离线事件保留时间和数量必须大于 0")
+	}
+	if c.MessageEditWindow <= 0 || c.MessageRecallWindow <= 0 {
+		return fmt.Errorf("消息可编辑和可撤回时间必须大于 0")
+	}
+	if c.ScheduledMessageMaxDelay <= 0 || c.ScheduledMessageMaxPending <= 0 {
+		return fmt.Errorf("定时消息最长延迟时间和待发送数量必须大于 0")
+	}
 	// 添加其他验证逻辑
 	return nil
 }
 
 // String returns a string representation of the configuration
 func (c *Config) String() string {
-	return fmt.Sprintf("Host: %s, Port: %d, DB Type: %s, DB Conn: %s, Test Mode: %v, Enable Feature: %v",
-		c.Host, c.Port, c.DBType, c.DBConn, c.TestMode, c.EnableSomeFeature)
+	return fmt.Sprintf("Host: %s, Port: %d, DB Type: %s, DB Conn: %s, Test Mode: %v, Enable Feature: %v, JWT Kid: %s, SMTP: %s:%d",
+		c.Host, c.Port, c.DBType, c.DBConn, c.TestMode, c.EnableSomeFeature, c.JWTSigningKeyID, c.SMTPHost, c.SMTPPort)
 }
 
 func LoadConfig(filePath string) (*Config, error) {
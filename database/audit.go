@@ -0,0 +1,172 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+// 审计来源
+const (
+	AuditSourceHTTP      = "http"
+	AuditSourceSocketIO  = "socketio"
+	AuditSourceWebSocket = "websocket"
+)
+
+// AuditContext 发起操作的用户和连接信息，由各入口（HTTP、Socket.IO、WebSocket）填充
+type AuditContext struct {
+	ActorID   uint
+	SessionID uint
+	IP        string
+	Source    string
+}
+
+// Audit 追加一条审计记录，before 和 after 序列化为 JSON。
+// 写入失败只记录日志，不影响已经完成的操作。
+func (dm *DatabaseManager) Audit(ac AuditContext, entry models.AuditLog, before, after interface{}) {
+	entry.ID = 0
+	entry.ActorID = ac.ActorID
+	entry.SessionID = ac.SessionID
+	entry.IP = ac.IP
+	entry.Source = ac.Source
+	entry.Before = auditValue(before)
+	entry.After = auditValue(after)
+
+	if err := dm.DB.Create(&entry).Error; err != nil {
+		log.Printf("写入审计日志失败 %s: %v", entry.Action, err)
+	}
+}
+
+func auditValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// AuditFriendChange 比较好友备注和隐私设置的修改前后值，分别记录发生变化的字段，nil 表示未修改
+func (dm *DatabaseManager) AuditFriendChange(ac AuditContext, before *models.UserFriend, alias *string, isPrivate *bool) {
+	if before == nil {
+		return
+	}
+	entry := models.AuditLog{TargetType: models.AuditTargetUser, TargetID: before.FriendID}
+	if alias != nil && *alias != before.Alias {
+		entry.Action = models.AuditFriendAlias
+		dm.Audit(ac, entry, map[string]string{"alias": before.Alias}, map[string]string{"alias": *alias})
+	}
+	if isPrivate != nil && *isPrivate != before.IsPrivate {
+		entry.Action = models.AuditFriendPrivacy
+		dm.Audit(ac, entry, map[string]bool{"isPrivate": before.IsPrivate}, map[string]bool{"isPrivate": *isPrivate})
+	}
+}
+
+// AuditMemberChange 比较房间成员别名和隐私设置的修改前后值，分别记录发生变化的字段，nil 表示未修改
+func (dm *DatabaseManager) AuditMemberChange(ac AuditContext, before *models.UserRoom, alias *string, isPrivate *bool) {
+	if before == nil {
+		return
+	}
+	entry := models.AuditLog{TargetType: models.AuditTargetUser, TargetID: before.UserID, RoomID: before.RoomID}
+	if alias != nil && *alias != before.Alias {
+		entry.Action = models.AuditRoomAlias
+		dm.Audit(ac, entry, map[string]string{"alias": before.Alias}, map[string]string{"alias": *alias})
+	}
+	if isPrivate != nil && *isPrivate != before.IsPrivate {
+		entry.Action = models.AuditRoomPrivacy
+		dm.Audit(ac, entry, map[string]bool{"isPrivate": before.IsPrivate}, map[string]bool{"isPrivate": *isPrivate})
+	}
+}
+
+// AuditMemberAdd 记录成员加入房间，after 为实际保存的成员记录（包含默认角色）
+func (dm *DatabaseManager) AuditMemberAdd(ac AuditContext, userID, roomID uint) {
+	entry := models.AuditLog{Action: models.AuditRoomMemberAdd, TargetType: models.AuditTargetUser, TargetID: userID, RoomID: roomID}
+	var after interface{}
+	if member, err := dm.GetMembership(userID, roomID); err == nil && member != nil {
+		after = map[string]interface{}{"alias": member.Alias, "isPrivate": member.IsPrivate, "role": member.Role}
+	}
+	dm.Audit(ac, entry, nil, after)
+}
+
+// AuditMemberRemove 记录成员被移出（或主动退出）房间，before 为移除前的成员记录
+func (dm *DatabaseManager) AuditMemberRemove(ac AuditContext, before *models.UserRoom) {
+	if before == nil {
+		return
+	}
+	dm.Audit(ac, models.AuditLog{Action: models.AuditRoomMemberRemove, TargetType: models.AuditTargetUser, TargetID: before.UserID, RoomID: before.RoomID},
+		map[string]interface{}{"alias": before.Alias, "isPrivate": before.IsPrivate, "role": before.Role}, nil)
+}
+
+// AuditLogFilter 审计日志查询条件，零值表示不过滤
+type AuditLogFilter struct {
+	ActorID    uint
+	Action     string
+	TargetType string
+	TargetID   uint
+	RoomID     uint
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+// ListAuditLogs 按条件查询审计日志，按时间倒序，同时返回符合条件的总数
+func (dm *DatabaseManager) ListAuditLogs(filter AuditLogFilter) ([]models.AuditLog, int64, error) {
+	query := dm.DB.Model(&models.AuditLog{})
+	if filter.ActorID != 0 {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != 0 {
+		query = query.Where("target_id = ?", filter.TargetID)
+	}
+	if filter.RoomID != 0 {
+		query = query.Where("room_id = ?", filter.RoomID)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var logs []models.AuditLog
+	err := query.Order("id DESC").Limit(filter.Limit).Offset(filter.Offset).Find(&logs).Error
+	return logs, total, err
+}
+
+// GetFriendship 获取好友关系，用于记录修改前的值
+func (dm *DatabaseManager) GetFriendship(userID, friendID uint) (*models.UserFriend, error) {
+	var userFriend models.UserFriend
+	err := dm.DB.Where("user_id = ? AND friend_id = ?", userID, friendID).First(&userFriend).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &userFriend, err
+}
+
+// GetMembership 获取房间成员记录，用于记录修改前的值
+func (dm *DatabaseManager) GetMembership(userID, roomID uint) (*models.UserRoom, error) {
+	var userRoom models.UserRoom
+	err := dm.DB.Where("user_id = ? AND room_id = ?", userID, roomID).First(&userRoom).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &userRoom, err
+}
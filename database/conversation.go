@@ -0,0 +1,375 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+var ErrPeerNotFound = errors.New("用户不存在")
+
+// Conversation 会话列表中的一项，单聊以 PeerID 标识，群聊以 RoomID 标识
+type Conversation struct {
+	PeerID       uint            `json:"peerId,omitempty"`
+	RoomID       uint            `json:"roomId,omitempty"`
+	Name         string          `json:"name"`
+	Avatar       string          `json:"avatar"`
+	Alias        string          `json:"alias"` // 来自 UserFriend 或 UserRoom
+	LastMessage  *models.Message `json:"lastMessage,omitempty"`
+	UnreadCount  int64           `json:"unreadCount"`
+	MentionCount int64           `json:"mentionCount"`         // 未读提及数，免打扰时客户端仍可据此提示
+	ReadCursor   string          `json:"readCursor,omitempty"` // 已读位置，与历史消息游标格式相同
+	Muted        bool            `json:"muted"`
+	Pinned       bool            `json:"pinned"`
+	Archived     bool            `json:"archived"`
+
+	pinnedAt *time.Time
+}
+
+// ConversationSettings 会话设置，nil 表示不修改
+type ConversationSettings struct {
+	Muted    *bool `json:"muted"`
+	Pinned   *bool `json:"pinned"`
+	Archived *bool `json:"archived"`
+}
+
+// ConversationStatus 会话已读位置或设置变化后推送给用户所有设备的内容
+type ConversationStatus struct {
+	PeerID       uint   `json:"peerId,omitempty"`
+	RoomID       uint   `json:"roomId,omitempty"`
+	ReadCursor   string `json:"readCursor,omitempty"`
+	UnreadCount  int64  `json:"unreadCount"`
+	MentionCount int64  `json:"mentionCount"`
+	Muted        bool   `json:"muted"`
+	Pinned       bool   `json:"pinned"`
+	Archived     bool   `json:"archived"`
+}
+
+func (dm *DatabaseManager) ConversationStatusOf(state *models.ConversationState) (*ConversationStatus, error) {
+	unread, err := dm.UnreadCount(state)
+	if err != nil {
+		return nil, err
+	}
+	mentions, err := dm.UnreadMentionCount(state)
+	if err != nil {
+		return nil, err
+	}
+	return &ConversationStatus{
+		PeerID:       state.PeerID,
+		RoomID:       state.RoomID,
+		ReadCursor:   readCursor(state),
+		UnreadCount:  unread,
+		MentionCount: mentions,
+		Muted:        state.Muted,
+		Pinned:       state.Pinned,
+		Archived:     state.Archived,
+	}, nil
+}
+
+// GetConversations 返回用户的会话列表：有消息往来或有会话状态的单聊对方，以及所在的全部房间。
+// 置顶会话在前，其余按最新消息倒序
+func (dm *DatabaseManager) GetConversations(userID uint) ([]Conversation, error) {
+	var states []models.ConversationState
+	if err := dm.DB.Where("user_id = ?", userID).Find(&states).Error; err != nil {
+		return nil, err
+	}
+	stateOf := make(map[[2]uint]*models.ConversationState, len(states))
+	for i := range states {
+		stateOf[[2]uint{states[i].PeerID, states[i].RoomID}] = &states[i]
+	}
+
+	var peerIDs []uint
+	err := dm.DB.Model(&models.Message{}).
+		Select("DISTINCT CASE WHEN talker_id = ? THEN listener_id ELSE talker_id END", userID).
+		Where("room_id = 0 AND (talker_id = ? OR listener_id = ?)", userID, userID).
+		Scan(&peerIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		if state.PeerID != 0 {
+			peerIDs = append(peerIDs, state.PeerID)
+		}
+	}
+
+	var conversations []Conversation
+	if len(peerIDs) > 0 {
+		var peers []models.User
+		if err := dm.DB.Where("id IN ?", peerIDs).Find(&peers).Error; err != nil {
+			return nil, err
+		}
+		var friends []models.UserFriend
+		if err := dm.DB.Where("user_id = ? AND friend_id IN ?", userID, peerIDs).Find(&friends).Error; err != nil {
+			return nil, err
+		}
+		aliases := make(map[uint]string, len(friends))
+		for _, friend := range friends {
+			aliases[friend.FriendID] = friend.Alias
+		}
+		for _, peer := range peers {
+			name := peer.Name
+			if name == "" {
+				name = peer.Username
+			}
+			conversations = append(conversations, Conversation{PeerID: peer.ID, Name: name, Avatar: peer.Avatar, Alias: aliases[peer.ID]})
+		}
+	}
+
+	var memberships []models.UserRoom
+	if err := dm.DB.Preload("Room").Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	for _, membership := range memberships {
+		if membership.Room == nil {
+			continue
+		}
+		conversations = append(conversations, Conversation{RoomID: membership.RoomID, Name: membership.Room.Name, Avatar: membership.Room.Avatar, Alias: membership.Alias})
+	}
+
+	var roomIDs []uint
+	for _, c := range conversations {
+		if c.RoomID != 0 {
+			roomIDs = append(roomIDs, c.RoomID)
+		}
+	}
+	lastMessages, err := dm.lastMessages(userID, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	unreadCounts, err := dm.unreadCounts(userID, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	mentionCounts, err := dm.unreadMentionCounts(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range conversations {
+		c := &conversations[i]
+		key := [2]uint{c.PeerID, c.RoomID}
+		if state := stateOf[key]; state != nil {
+			c.Muted, c.Pinned, c.Archived, c.pinnedAt = state.Muted, state.Pinned, state.Archived, state.PinnedAt
+			c.ReadCursor = readCursor(state)
+		}
+		c.LastMessage = lastMessages[key]
+		c.UnreadCount = unreadCounts[key]
+		c.MentionCount = mentionCounts[key]
+	}
+
+	sort.SliceStable(conversations, func(i, j int) bool {
+		a, b := conversations[i], conversations[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+		if a.Pinned && a.pinnedAt != nil && b.pinnedAt != nil && !a.pinnedAt.Equal(*b.pinnedAt) {
+			return a.pinnedAt.After(*b.pinnedAt)
+		}
+		var at, bt MessageCursor
+		if a.LastMessage != nil {
+			at = cursorOf(a.LastMessage)
+		}
+		if b.LastMessage != nil {
+			bt = cursorOf(b.LastMessage)
+		}
+		if at.Timestamp != bt.Timestamp {
+			return at.Timestamp > bt.Timestamp
+		}
+		return at.ID > bt.ID
+	})
+	return conversations, nil
+}
+
+// 会话列表统计按 [2]uint{peerID, roomID} 索引，与 stateOf 相同
+
+// 每个单聊和 roomIDs 中每个房间的最新消息，单聊和房间各用一条分组查询
+func (dm *DatabaseManager) lastMessages(userID uint, roomIDs []uint) (map[[2]uint]*models.Message, error) {
+	var messages []models.Message
+	direct := dm.DB.Model(&models.Message{}).Select("talker_id, listener_id, MAX(timestamp) AS ts").
+		Where("room_id = 0 AND (talker_id = ? OR listener_id = ?)", userID, userID).
+		Group("talker_id, listener_id")
+	err := dm.DB.Joins("JOIN (?) AS latest ON messages.talker_id = latest.talker_id AND messages.listener_id = latest.listener_id AND messages.timestamp = latest.ts", direct).
+		Where("messages.room_id = 0").Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(roomIDs) > 0 {
+		var roomMessages []models.Message
+		rooms := dm.DB.Model(&models.Message{}).Select("room_id, MAX(timestamp) AS ts").
+			Where("room_id IN ?", roomIDs).Group("room_id")
+		err := dm.DB.Joins("JOIN (?) AS latest ON messages.room_id = latest.room_id AND messages.timestamp = latest.ts", rooms).
+			Find(&roomMessages).Error
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, roomMessages...)
+	}
+
+	// 同一时间戳可能有多条消息，两个方向的单聊也分别统计，按 (timestamp, id) 取最新的一条
+	last := make(map[[2]uint]*models.Message)
+	for i := range messages {
+		message := &messages[i]
+		key := [2]uint{0, message.RoomID}
+		if message.RoomID == 0 {
+			key[0] = message.ListenerID
+			if message.ListenerID == userID {
+				key[0] = message.TalkerID
+			}
+		}
+		if current := last[key]; current == nil || cursorOf(message).after(cursorOf(current)) {
+			last[key] = message
+		}
+	}
+	return last, nil
+}
+
+// 已读位置之后由他人发送的消息数，单聊和房间各用一条分组查询；没有会话状态时全部未读
+func (dm *DatabaseManager) unreadCounts(userID uint, roomIDs []uint) (map[[2]uint]int64, error) {
+	const afterRead = "messages.timestamp > COALESCE(conversation_states.last_read_timestamp, 0) OR " +
+		"(messages.timestamp = COALESCE(conversation_states.last_read_timestamp, 0) AND messages.id > COALESCE(conversation_states.last_read_id, 0))"
+	var rows []struct {
+		RoomID   uint
+		TalkerID uint
+		Count    int64
+	}
+	err := dm.DB.Model(&models.Message{}).Select("messages.talker_id, COUNT(*) AS count").
+		Joins("LEFT JOIN conversation_states ON conversation_states.user_id = ? AND conversation_states.room_id = 0 "+
+			"AND conversation_states.peer_id = messages.talker_id AND conversation_states.deleted_at IS NULL", userID).
+		Where("messages.room_id = 0 AND messages.listener_id = ? AND messages.talker_id <> ?", userID, userID).
+		Where(afterRead).Group("messages.talker_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[[2]uint]int64, len(rows)+len(roomIDs))
+	for _, row := range rows {
+		counts[[2]uint{row.TalkerID, 0}] = row.Count
+	}
+
+	if len(roomIDs) > 0 {
+		rows = rows[:0]
+		err := dm.DB.Model(&models.Message{}).Select("messages.room_id, COUNT(*) AS count").
+			Joins("LEFT JOIN conversation_states ON conversation_states.user_id = ? AND conversation_states.peer_id = 0 "+
+				"AND conversation_states.room_id = messages.room_id AND conversation_states.deleted_at IS NULL", userID).
+			Where("messages.room_id IN ? AND messages.talker_id <> ?", roomIDs, userID).
+			Where(afterRead).Group("messages.room_id").Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			counts[[2]uint{0, row.RoomID}] = row.Count
+		}
+	}
+	return counts, nil
+}
+
+// 用户在各会话中的未读提及数，单聊中的提及来自对方
+func (dm *DatabaseManager) unreadMentionCounts(userID uint) (map[[2]uint]int64, error) {
+	var rows []struct {
+		RoomID   uint
+		TalkerID uint
+		Count    int64
+	}
+	err := dm.unreadMentions(userID).Select("mentions.room_id, mentions.talker_id, COUNT(*) AS count").
+		Group("mentions.room_id, mentions.talker_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[[2]uint]int64)
+	for _, row := range rows {
+		if row.RoomID != 0 {
+			counts[[2]uint{0, row.RoomID}] += row.Count
+		} else {
+			counts[[2]uint{row.TalkerID, 0}] += row.Count
+		}
+	}
+	return counts, nil
+}
+
+// UnreadCount 已读位置之后、由他人发送的消息数量
+func (dm *DatabaseManager) UnreadCount(state *models.ConversationState) (int64, error) {
+	var count int64
+	cursor := MessageCursor{Timestamp: state.LastReadTimestamp, ID: state.LastReadID}
+	err := whereBeyond(dm.conversationMessages(state.UserID, state.PeerID, state.RoomID), cursor, false).
+		Where("messages.talker_id <> ?", state.UserID).
+		Count(&count).Error
+	return count, err
+}
+
+func readCursor(state *models.ConversationState) string {
+	if state.LastReadID == 0 {
+		return ""
+	}
+	return MessageCursor{Timestamp: state.LastReadTimestamp, ID: state.LastReadID}.Encode()
+}
+
+// MarkConversationRead 把已读位置推进到 msgID 对应的消息，msgID 为空时推进到最新消息。
+// 已读位置只前进不后退，多端上报的顺序不影响结果
+func (dm *DatabaseManager) MarkConversationRead(userID, peerID, roomID uint, msgID string) (*models.ConversationState, error) {
+	return dm.advanceConversation(userID, peerID, roomID, msgID, ReceiptRead)
+}
+
+// UpdateConversationSettings 修改会话的免打扰、置顶和归档状态
+func (dm *DatabaseManager) UpdateConversationSettings(userID, peerID, roomID uint, settings ConversationSettings) (*models.ConversationState, error) {
+	if err := dm.checkConversation(userID, peerID, roomID); err != nil {
+		return nil, err
+	}
+
+	var state models.ConversationState
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := conversationState(tx, userID, peerID, roomID, &state); err != nil {
+			return err
+		}
+		updates := make(map[string]interface{})
+		if settings.Muted != nil {
+			updates["muted"] = *settings.Muted
+		}
+		if settings.Archived != nil {
+			updates["archived"] = *settings.Archived
+		}
+		if settings.Pinned != nil && *settings.Pinned != state.Pinned {
+			updates["pinned"] = *settings.Pinned
+			updates["pinned_at"] = nil
+			if *settings.Pinned {
+				updates["pinned_at"] = time.Now()
+			}
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		if err := tx.Model(&state).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.First(&state, state.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// 会话必须且只能是单聊对方或房间之一，房间需要是成员
+func (dm *DatabaseManager) checkConversation(userID, peerID, roomID uint) error {
+	if (peerID == 0) == (roomID == 0) {
+		return ErrInvalidConversation
+	}
+	if roomID != 0 {
+		return dm.CheckUserRoom(userID, roomID)
+	}
+	var count int64
+	if err := dm.DB.Model(&models.User{}).Where("id = ?", peerID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrPeerNotFound
+	}
+	return nil
+}
+
+func conversationState(tx *gorm.DB, userID, peerID, roomID uint, state *models.ConversationState) error {
+	return tx.Where("user_id = ? AND peer_id = ? AND room_id = ?", userID, peerID, roomID).
+		Attrs(models.ConversationState{UserID: userID, PeerID: peerID, RoomID: roomID}).
+		FirstOrCreate(state).Error
+}
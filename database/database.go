@@ -3,8 +3,10 @@ package database
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/Ireoo/sixin-server/models"
 	"golang.org/x/crypto/bcrypt"
@@ -88,6 +90,10 @@ func (g *GormDB) GetDB() *gorm.DB {
 
 // 使用 models.GetAllModels() 初始化数据表
 func initTables(db *gorm.DB) error {
+	if err := dedupeUserRooms(db); err != nil {
+		return fmt.Errorf("清理重复的房间成员记录失败: %w", err)
+	}
+
 	models := models.GetAllModels()
 	if err := db.AutoMigrate(models...); err != nil {
 		return err
@@ -97,9 +103,46 @@ func initTables(db *gorm.DB) error {
 	return nil
 }
 
+// 早期版本退出房间只软删除成员记录，加入房间时也不检查重复，同一用户和房间可能有多条记录。
+// 创建唯一索引 idx_user_room 之前，删除软删除的记录，重复的记录只保留最早的一条
+func dedupeUserRooms(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.UserRoom{}) || migrator.HasIndex(&models.UserRoom{}, "idx_user_room") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM user_rooms WHERE deleted_at IS NOT NULL").Error; err != nil {
+			return err
+		}
+		result := tx.Exec("DELETE FROM user_rooms WHERE id NOT IN (SELECT id FROM (SELECT MIN(id) AS id FROM user_rooms GROUP BY user_id, room_id) AS kept)")
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			log.Printf("已删除 %d 条重复的房间成员记录", result.RowsAffected)
+		}
+		return nil
+	})
+}
+
 // DatabaseManager 结构体及其方法
 type DatabaseManager struct {
 	DB *gorm.DB
+	// OnMembershipChange 房间成员加入（joined 为 true）或离开后调用，用于同步实时连接加入的房间
+	OnMembershipChange func(userID, roomID uint, joined bool)
+	// OnUserEvent 好友、房间和成员设置变化后调用，记录到相关用户的事件日志并推送
+	OnUserEvent func(event string, data interface{}, userIDs ...uint)
+	// IsOnline 判断用户当前是否在线，用于 @here 提及；未设置时视为所有人都不在线
+	IsOnline func(userID uint) bool
+}
+
+func (dm *DatabaseManager) membershipChanged(roomID uint, joined bool, userIDs ...uint) {
+	if dm.OnMembershipChange == nil {
+		return
+	}
+	for _, userID := range userIDs {
+		dm.OnMembershipChange(userID, roomID, joined)
+	}
 }
 
 func NewDatabaseManager(dbType DatabaseType, connectionString string) (*DatabaseManager, error) {
@@ -121,15 +164,32 @@ func generateSecretKey() (string, error) {
 	return base64.StdEncoding.EncodeToString(key), nil
 }
 
+// ErrInvalidCredentials 用户不存在和密码错误返回同一个错误，避免泄露用户名是否存在
+var ErrInvalidCredentials = errors.New("用户名或密码错误")
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// 用户不存在时也做一次 bcrypt 比较，使两种情况的响应时间一致
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("sixin-dummy-password"), bcrypt.DefaultCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
 // 用户登录验证方法
 func (dm *DatabaseManager) AuthenticateUser(username, password string) (*models.User, error) {
 	var user models.User
 	if err := dm.DB.Model(&models.User{}).Where("username = ?", username).First(&user).Error; err != nil {
-		return nil, fmt.Errorf("用户不存在")
+		compareDummyPassword(password)
+		return nil, ErrInvalidCredentials
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return nil, fmt.Errorf("密码不正确")
+		return nil, ErrInvalidCredentials
 	}
 
 	return &user, nil
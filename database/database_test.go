@@ -0,0 +1,34 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Ireoo/sixin-server/models"
+)
+
+// 每个测试使用独立的内存 SQLite 数据库
+func newTestManager(t *testing.T) *DatabaseManager {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	dm, err := NewDatabaseManager(SQLite, fmt.Sprintf("file:%s?mode=memory&cache=shared", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := dm.DB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return dm
+}
+
+func createTestUser(t *testing.T, dm *DatabaseManager, username string) *models.User {
+	t.Helper()
+	user := &models.User{Username: username, WechatID: username}
+	if err := dm.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 补发离线事件时每次读取的数量
+const eventReplayBatch = 200
+
+// 记录事件时每批分配序号和写入的用户数量
+const eventAppendBatch = 500
+
+// AppendUserEvents 为每个用户分配下一个事件序号并记录事件，返回的事件与去重后的 userIDs 一一对应。
+// 新消息只记录消息 ID，补发时再按接收者加载，不在每个用户的日志中复制消息内容
+func (dm *DatabaseManager) AppendUserEvents(event string, data interface{}, userIDs ...uint) ([]models.UserEvent, error) {
+	record := models.UserEvent{Event: event}
+	if message, ok := data.(models.FullMessage); ok {
+		record.MessageID = message.Message.ID
+	} else {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		record.Payload = string(payload)
+	}
+
+	userIDs = uniqueUserIDs(userIDs)
+	events := make([]models.UserEvent, 0, len(userIDs))
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(userIDs); start += eventAppendBatch {
+			batch := userIDs[start:min(start+eventAppendBatch, len(userIDs))]
+			seqs, err := nextEventSeqs(tx, batch)
+			if err != nil {
+				return err
+			}
+			for _, userID := range batch {
+				e := record
+				e.UserID, e.Seq = userID, seqs[userID]
+				events = append(events, e)
+			}
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&events, eventAppendBatch).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// 为一批用户各分配下一个序号：补齐缺少的序号记录后用一条 UPDATE 递增，再一次读回
+func nextEventSeqs(tx *gorm.DB, userIDs []uint) (map[uint]uint64, error) {
+	sequences := make([]models.UserEventSequence, len(userIDs))
+	for i, userID := range userIDs {
+		sequences[i] = models.UserEventSequence{UserID: userID}
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&sequences).Error; err != nil {
+		return nil, err
+	}
+	err := tx.Model(&models.UserEventSequence{}).Where("user_id IN ?", userIDs).
+		UpdateColumn("last_seq", gorm.Expr("last_seq + 1")).Error
+	if err != nil {
+		return nil, err
+	}
+
+	sequences = sequences[:0]
+	if err := tx.Where("user_id IN ?", userIDs).Find(&sequences).Error; err != nil {
+		return nil, err
+	}
+	seqs := make(map[uint]uint64, len(sequences))
+	for _, sequence := range sequences {
+		seqs[sequence.UserID] = sequence.LastSeq
+	}
+	return seqs, nil
+}
+
+func uniqueUserIDs(userIDs []uint) []uint {
+	seen := make(map[uint]bool, len(userIDs))
+	unique := make([]uint, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			unique = append(unique, userID)
+		}
+	}
+	return unique
+}
+
+// EventData 解析 viewerID 事件日志中的事件内容，返回值与 events 一一对应。
+// 新消息按 viewerID 重新加载，消息已被删除时为 nil
+func (dm *DatabaseManager) EventData(viewerID uint, events []models.UserEvent) ([]interface{}, error) {
+	var messageIDs []uint
+	for _, e := range events {
+		if e.MessageID != 0 {
+			messageIDs = append(messageIDs, e.MessageID)
+		}
+	}
+	messages, err := dm.GetFullMessages(messageIDs, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]interface{}, len(events))
+	for i, e := range events {
+		if e.MessageID != 0 {
+			if message, ok := messages[e.MessageID]; ok {
+				data[i] = message
+			}
+			continue
+		}
+		if err := json.Unmarshal([]byte(e.Payload), &data[i]); err != nil {
+			return nil, fmt.Errorf("解析事件 %d 失败: %w", e.Seq, err)
+		}
+	}
+	return data, nil
+}
+
+// LatestEventSeq 用户最近分配的事件序号，没有事件时为 0
+func (dm *DatabaseManager) LatestEventSeq(userID uint) (uint64, error) {
+	var seqs []uint64
+	err := dm.DB.Model(&models.UserEventSequence{}).Where("user_id = ?", userID).Pluck("last_seq", &seqs).Error
+	if err != nil || len(seqs) == 0 {
+		return 0, err
+	}
+	return seqs[0], nil
+}
+
+// GetDeviceCursor 获取设备的确认位置，新设备从当前最新序号开始，不补发登录前的事件
+func (dm *DatabaseManager) GetDeviceCursor(sessionID, userID uint) (*models.DeviceCursor, error) {
+	var cursor models.DeviceCursor
+	err := dm.DB.First(&cursor, "session_id = ?", sessionID).Error
+	if err == nil {
+		return &cursor, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	latest, err := dm.LatestEventSeq(userID)
+	if err != nil {
+		return nil, err
+	}
+	cursor = models.DeviceCursor{SessionID: sessionID, UserID: userID, AckedSeq: latest}
+	if err := dm.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&cursor).Error; err != nil {
+		return nil, err
+	}
+	return &cursor, dm.DB.First(&cursor, "session_id = ?", sessionID).Error
+}
+
+// AckEvents 设备确认已收到 seq 及之前的全部事件，确认位置只前进不后退，且不超过已分配的序号
+func (dm *DatabaseManager) AckEvents(sessionID, userID uint, seq uint64) (*models.DeviceCursor, error) {
+	cursor, err := dm.GetDeviceCursor(sessionID, userID)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := dm.LatestEventSeq(userID)
+	if err != nil {
+		return nil, err
+	}
+	if seq > latest {
+		seq = latest
+	}
+	if seq <= cursor.AckedSeq {
+		return cursor, nil
+	}
+
+	err = dm.DB.Model(&models.DeviceCursor{}).
+		Where("session_id = ? AND acked_seq < ?", sessionID, seq).
+		Updates(map[string]interface{}{"acked_seq": seq, "updated_at": time.Now()}).Error
+	if err != nil {
+		return nil, err
+	}
+	return cursor, dm.DB.First(cursor, "session_id = ?", sessionID).Error
+}
+
+// GetUserEventsSince 获取序号大于 afterSeq 的事件，按序号升序
+func (dm *DatabaseManager) GetUserEventsSince(userID uint, afterSeq uint64, limit int) ([]models.UserEvent, error) {
+	var events []models.UserEvent
+	err := dm.DB.Where("user_id = ? AND seq > ?", userID, afterSeq).
+		Order("seq ASC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// EachMissedEvent 按顺序遍历设备确认位置之后的全部事件及其内容，跳过消息已被删除的事件
+func (dm *DatabaseManager) EachMissedEvent(sessionID, userID uint, fn func(e models.UserEvent, data interface{})) error {
+	cursor, err := dm.GetDeviceCursor(sessionID, userID)
+	if err != nil {
+		return err
+	}
+	afterSeq := cursor.AckedSeq
+	for {
+		events, err := dm.GetUserEventsSince(userID, afterSeq, eventReplayBatch)
+		if err != nil {
+			return err
+		}
+		data, err := dm.EventData(userID, events)
+		if err != nil {
+			return err
+		}
+		for i, event := range events {
+			if data[i] != nil {
+				fn(event, data[i])
+			}
+		}
+		if len(events) < eventReplayBatch {
+			return nil
+		}
+		afterSeq = events[len(events)-1].Seq
+	}
+}
+
+// PruneUserEvents 清理超过保留时间的事件，并且每个用户只保留最近 maxPerUser 个事件
+func (dm *DatabaseManager) PruneUserEvents(retention time.Duration, maxPerUser int) (int64, error) {
+	result := dm.DB.Where("created_at < ?", time.Now().Add(-retention)).Delete(&models.UserEvent{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	pruned := result.RowsAffected
+
+	var sequences []models.UserEventSequence
+	if err := dm.DB.Where("last_seq > ?", maxPerUser).Find(&sequences).Error; err != nil {
+		return pruned, err
+	}
+	for _, sequence := range sequences {
+		result := dm.DB.Where("user_id = ? AND seq <= ?", sequence.UserID, sequence.LastSeq-uint64(maxPerUser)).Delete(&models.UserEvent{})
+		if result.Error != nil {
+			return pruned, result.Error
+		}
+		pruned += result.RowsAffected
+	}
+	return pruned, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+// GetUserByIdentity 根据外部身份查找绑定的本地用户，未绑定时返回 nil
+func (dm *DatabaseManager) GetUserByIdentity(provider, subject string) (*models.User, error) {
+	var identity models.UserIdentity
+	err := dm.DB.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var user models.User
+	if err := dm.DB.First(&user, identity.UserID).Error; err != nil {
+		return nil, fmt.Errorf("获取绑定用户失败: %w", err)
+	}
+	return &user, nil
+}
+
+// LinkIdentity 将外部身份绑定到已有用户，不改变用户的状态和邮箱验证时间
+func (dm *DatabaseManager) LinkIdentity(user *models.User, identity *models.UserIdentity) error {
+	identity.UserID = user.ID
+	if err := dm.DB.Create(identity).Error; err != nil {
+		return fmt.Errorf("绑定外部身份失败: %w", err)
+	}
+	return nil
+}
+
+// CreateUserWithIdentity 为外部身份自动创建本地用户并绑定
+func (dm *DatabaseManager) CreateUserWithIdentity(user *models.User, identity *models.UserIdentity) error {
+	secretKey, err := generateSecretKey()
+	if err != nil {
+		return fmt.Errorf("无法生成密钥: %v", err)
+	}
+	user.SecretKey = secretKey
+
+	return dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return fmt.Errorf("无法创建用户: %v", err)
+		}
+		identity.UserID = user.ID
+		if err := tx.Create(identity).Error; err != nil {
+			return fmt.Errorf("绑定外部身份失败: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+func (dm *DatabaseManager) CreateLockout(lockout *models.AccountLockout) error {
+	return dm.DB.Create(lockout).Error
+}
+
+// GetActiveLockout 查询仍在生效的锁定记录，账号按用户名匹配，IP 按地址匹配；没有时返回 nil
+func (dm *DatabaseManager) GetActiveLockout(lockoutType, key string) (*models.AccountLockout, error) {
+	column := "username"
+	if lockoutType == models.LockoutTypeIP {
+		column = "ip"
+	}
+
+	var lockout models.AccountLockout
+	err := dm.DB.Where("type = ? AND "+column+" = ? AND unlocked_at IS NULL AND locked_until > ?", lockoutType, key, time.Now()).
+		Order("locked_until DESC").
+		First(&lockout).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// ListLockouts 按时间倒序列出锁定记录，activeOnly 为 true 时只返回仍在生效的
+func (dm *DatabaseManager) ListLockouts(activeOnly bool, limit int) ([]models.AccountLockout, error) {
+	query := dm.DB.Model(&models.AccountLockout{})
+	if activeOnly {
+		query = query.Where("unlocked_at IS NULL AND locked_until > ?", time.Now())
+	}
+
+	var lockouts []models.AccountLockout
+	err := query.Order("id DESC").Limit(limit).Find(&lockouts).Error
+	return lockouts, err
+}
+
+// Unlock 解除指定账号或 IP 的所有生效锁定，返回解除的记录
+func (dm *DatabaseManager) Unlock(lockoutType, key string, adminID uint) ([]models.AccountLockout, error) {
+	column := "username"
+	if lockoutType == models.LockoutTypeIP {
+		column = "ip"
+	}
+
+	var lockouts []models.AccountLockout
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("type = ? AND "+column+" = ? AND unlocked_at IS NULL AND locked_until > ?", lockoutType, key, time.Now()).
+			Find(&lockouts).Error
+		if err != nil || len(lockouts) == 0 {
+			return err
+		}
+
+		ids := make([]uint, 0, len(lockouts))
+		for _, lockout := range lockouts {
+			ids = append(ids, lockout.ID)
+		}
+		return tx.Model(&models.AccountLockout{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"unlocked_at": time.Now(),
+			"unlocked_by": adminID,
+		}).Error
+	})
+	return lockouts, err
+}
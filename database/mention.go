@@ -0,0 +1,269 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 提及相关事件：被提及时推送给被提及的用户，会话设置了免打扰也会推送；
+// 手动标记已读后同步到用户的其他设备
+const (
+	EventMention      = "mention"
+	EventMentionsRead = "mentionsRead"
+)
+
+// 提及收件箱分页大小
+const (
+	DefaultMentionLimit = 50
+	MaxMentionLimit     = 100
+)
+
+var (
+	ErrInvalidMention      = errors.New("提及的用户不在会话中")
+	ErrInvalidMentionScope = errors.New("无效的提及范围")
+)
+
+// MentionQuery 未读提及查询，RoomID 为 0 时返回所有会话中的提及；
+// Before 为上一页返回的 NextBefore，按提及时间从新到旧分页
+type MentionQuery struct {
+	UserID uint
+	RoomID uint
+	Before uint
+	Limit  int
+}
+
+// MentionInbox 一页未读提及，按时间从新到旧排列
+type MentionInbox struct {
+	Mentions   []models.Mention `json:"mentions"`
+	NextBefore uint             `json:"nextBefore,omitempty"`
+	HasMore    bool             `json:"hasMore"`
+}
+
+// 校验并整理消息的提及：去重并去掉发送者自己，提及的用户必须在会话中；
+// @all 和 @here 只能用于房间消息，且需要房主或管理员权限
+func (dm *DatabaseManager) checkMentions(message *models.Message) error {
+	message.MentionIDList = uniqueMentionIDs(message.TalkerID, message.MentionIDList)
+	switch message.MentionScope {
+	case "":
+	case models.MentionAll, models.MentionHere:
+		if message.RoomID == 0 {
+			return ErrInvalidMentionScope
+		}
+		if _, err := dm.CheckRoomPermission(message.TalkerID, message.RoomID, ActionMentionAll); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidMentionScope
+	}
+	return dm.checkMentionMembers(message, message.MentionIDList)
+}
+
+// 房间消息只能提及房间成员，单聊消息只能提及对方
+func (dm *DatabaseManager) checkMentionMembers(message *models.Message, userIDs []uint) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	if message.RoomID == 0 {
+		for _, userID := range userIDs {
+			if userID != message.ListenerID {
+				return ErrInvalidMention
+			}
+		}
+		return nil
+	}
+	var count int64
+	err := dm.DB.Model(&models.UserRoom{}).Where("room_id = ? AND user_id IN ?", message.RoomID, userIDs).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count != int64(len(userIDs)) {
+		return ErrInvalidMention
+	}
+	return nil
+}
+
+func uniqueMentionIDs(talkerID uint, userIDs []uint) []uint {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	seen := make(map[uint]bool, len(userIDs))
+	unique := make([]uint, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userID == 0 || userID == talkerID || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		unique = append(unique, userID)
+	}
+	return unique
+}
+
+// 新消息提及的用户及提及类型。@all 为房间所有成员，@here 为当前在线的成员，
+// 同时被单独提及的用户按单独提及记录
+func (dm *DatabaseManager) mentionRecipients(message *models.Message) (map[uint]string, error) {
+	recipients := make(map[uint]string)
+	if message.MentionScope != "" {
+		memberIDs, err := dm.GetRoomMemberIDs(message.RoomID)
+		if err != nil {
+			return nil, err
+		}
+		for _, memberID := range memberIDs {
+			if memberID == message.TalkerID {
+				continue
+			}
+			if message.MentionScope == models.MentionHere && (dm.IsOnline == nil || !dm.IsOnline(memberID)) {
+				continue
+			}
+			recipients[memberID] = message.MentionScope
+		}
+	}
+	for _, userID := range message.MentionIDList {
+		recipients[userID] = models.MentionUser
+	}
+	return recipients, nil
+}
+
+// MentionNotice 被提及时推送的事件内容，同一消息同一提及类型的用户共用一份，
+// 提及记录的 ID 通过未读提及列表获取
+type MentionNotice struct {
+	MsgID     string          `json:"msgId"`
+	TalkerID  uint            `json:"talkerId"`
+	RoomID    uint            `json:"roomId"`
+	Timestamp int64           `json:"timestamp"`
+	Scope     string          `json:"scope"`
+	Message   *models.Message `json:"message"`
+}
+
+// 每批写入的提及记录数量
+const mentionInsertBatch = 500
+
+// 保存提及记录并推送给被提及的用户，消息已经提及过的用户不会重复通知。
+// 提及记录批量写入，每种提及类型只推送一次。消息已经保存，失败时只记录日志
+func (dm *DatabaseManager) notifyMentions(message *models.Message, recipients map[uint]string) {
+	if len(recipients) == 0 {
+		return
+	}
+	var existing []uint
+	if err := dm.DB.Model(&models.Mention{}).Where("message_id = ?", message.ID).Pluck("user_id", &existing).Error; err != nil {
+		log.Printf("查询消息 %s 的提及记录失败: %v", message.MsgID, err)
+		return
+	}
+	for _, userID := range existing {
+		delete(recipients, userID)
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	mentions := make([]models.Mention, 0, len(recipients))
+	byScope := make(map[string][]uint)
+	for userID, scope := range recipients {
+		mentions = append(mentions, models.Mention{
+			UserID:    userID,
+			MessageID: message.ID,
+			MsgID:     message.MsgID,
+			TalkerID:  message.TalkerID,
+			RoomID:    message.RoomID,
+			Timestamp: message.Timestamp,
+			Scope:     scope,
+		})
+		byScope[scope] = append(byScope[scope], userID)
+	}
+	if err := dm.DB.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&mentions, mentionInsertBatch).Error; err != nil {
+		log.Printf("保存消息 %s 的提及记录失败: %v", message.MsgID, err)
+		return
+	}
+
+	for scope, userIDs := range byScope {
+		dm.publish(EventMention, MentionNotice{
+			MsgID:     message.MsgID,
+			TalkerID:  message.TalkerID,
+			RoomID:    message.RoomID,
+			Timestamp: message.Timestamp,
+			Scope:     scope,
+			Message:   message,
+		}, userIDs...)
+	}
+}
+
+// GetMentions 按时间倒序分页获取用户的未读提及，只包括仍在房间中的房间提及
+func (dm *DatabaseManager) GetMentions(query MentionQuery) (*MentionInbox, error) {
+	if query.RoomID != 0 {
+		if err := dm.CheckUserRoom(query.UserID, query.RoomID); err != nil {
+			return nil, err
+		}
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultMentionLimit
+	} else if query.Limit > MaxMentionLimit {
+		query.Limit = MaxMentionLimit
+	}
+
+	db := dm.unreadMentions(query.UserID).
+		Joins("LEFT JOIN user_rooms ON user_rooms.room_id = mentions.room_id AND user_rooms.user_id = mentions.user_id AND user_rooms.deleted_at IS NULL").
+		Where("mentions.room_id = 0 OR user_rooms.id IS NOT NULL")
+	if query.RoomID != 0 {
+		db = db.Where("mentions.room_id = ?", query.RoomID)
+	}
+	if query.Before != 0 {
+		db = db.Where("mentions.id < ?", query.Before)
+	}
+
+	inbox := &MentionInbox{Mentions: []models.Mention{}}
+	if err := db.Preload("Message").Order("mentions.id DESC").Limit(query.Limit + 1).Find(&inbox.Mentions).Error; err != nil {
+		return nil, err
+	}
+	if len(inbox.Mentions) > query.Limit {
+		inbox.Mentions, inbox.HasMore = inbox.Mentions[:query.Limit], true
+	}
+	if len(inbox.Mentions) > 0 {
+		inbox.NextBefore = inbox.Mentions[len(inbox.Mentions)-1].ID
+	}
+	return inbox, nil
+}
+
+// MarkMentionsRead 把指定的提及标记为已读，返回实际标记的数量
+func (dm *DatabaseManager) MarkMentionsRead(userID uint, mentionIDs []uint) (int64, error) {
+	if len(mentionIDs) == 0 {
+		return 0, nil
+	}
+	result := dm.unreadMentions(userID).Where("mentions.id IN ?", mentionIDs).UpdateColumn("read_at", time.Now())
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected > 0 {
+		dm.publish(EventMentionsRead, map[string]interface{}{"ids": mentionIDs}, userID)
+	}
+	return result.RowsAffected, nil
+}
+
+// UnreadMentionCount 会话中未读提及的数量
+func (dm *DatabaseManager) UnreadMentionCount(state *models.ConversationState) (int64, error) {
+	var count int64
+	err := conversationMentions(dm.unreadMentions(state.UserID), state).Count(&count).Error
+	return count, err
+}
+
+// 会话已读位置推进到 cursor 后，标记该位置及之前的提及为已读
+func (dm *DatabaseManager) readMentionsUpTo(state *models.ConversationState, cursor MessageCursor, now time.Time) error {
+	return conversationMentions(dm.unreadMentions(state.UserID), state).
+		Where("mentions.timestamp < ? OR (mentions.timestamp = ? AND mentions.message_id <= ?)", cursor.Timestamp, cursor.Timestamp, cursor.ID).
+		UpdateColumn("read_at", now).Error
+}
+
+func (dm *DatabaseManager) unreadMentions(userID uint) *gorm.DB {
+	return dm.DB.Model(&models.Mention{}).Where("mentions.user_id = ? AND mentions.read_at IS NULL", userID)
+}
+
+// 限定为 state 对应会话中的提及，单聊中的提及来自对方
+func conversationMentions(db *gorm.DB, state *models.ConversationState) *gorm.DB {
+	if state.RoomID != 0 {
+		return db.Where("mentions.room_id = ?", state.RoomID)
+	}
+	return db.Where("mentions.room_id = 0 AND mentions.talker_id = ?", state.PeerID)
+}
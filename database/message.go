@@ -1,29 +1,124 @@
 package database
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
 )
 
-// 消息相关操作
+// 消息相关操作。引用或回复话题时校验目标消息，并更新话题的回复统计和参与者；
+// 保存后通知被提及的用户
 func (dm *DatabaseManager) CreateMessage(message *models.Message) error {
-	return dm.DB.Create(message).Error
+	// 以下字段由服务端维护，忽略客户端传入的值。Timestamp 是历史分页、未读数和已读位置的排序依据，
+	// 按服务端保存的时间（毫秒）设置
+	message.Timestamp = time.Now().UnixMilli()
+	message.DeliveredAt, message.ReadAt, message.EditedAt = nil, nil, nil
+	message.RecalledAt, message.RecalledBy, message.Reactions = nil, 0, nil
+	message.ThreadReplyCount, message.ThreadLastReplyAt = 0, nil
+
+	if err := dm.checkScheduledMsgID(message); err != nil {
+		return err
+	}
+	root, err := dm.checkReplyTargets(message)
+	if err != nil {
+		return err
+	}
+	if err := dm.checkMentions(message); err != nil {
+		return err
+	}
+	if root == nil {
+		err = dm.DB.Create(message).Error
+	} else {
+		err = dm.createThreadReply(message, root)
+	}
+	if err != nil {
+		return err
+	}
+
+	recipients, err := dm.mentionRecipients(message)
+	if err != nil {
+		log.Printf("获取消息 %s 的提及对象失败: %v", message.MsgID, err)
+		return nil
+	}
+	dm.notifyMentions(message, recipients)
+	return nil
 }
 
-func (dm *DatabaseManager) GetFullMessage(id uint) (models.FullMessage, error) {
-	var fullMessage models.FullMessage
-	err := dm.DB.Model(&models.Message{}).Where("id = ?", id).
-		Preload("Talker").Preload("Listener").Preload("Room").
-		First(&fullMessage.Message).Error
+// 随消息推送的用户公开资料，不包括邮箱、手机号、管理员标记等私有字段
+var publicUserColumns = []string{"id", "created_at", "updated_at", "username", "wechat_id", "name", "alias", "avatar", "signature", "gender", "province", "city", "type"}
+
+// GetFullMessage 获取消息及其发送者、接收者、房间和表情回应，用于推送给客户端。
+// viewerID 为查询者，用于标记是否回应过
+func (dm *DatabaseManager) GetFullMessage(id, viewerID uint) (models.FullMessage, error) {
+	messages, err := dm.GetFullMessages([]uint{id}, viewerID)
+	if err != nil {
+		return models.FullMessage{}, err
+	}
+	fullMessage, ok := messages[id]
+	if !ok {
+		return fullMessage, gorm.ErrRecordNotFound
+	}
+	return fullMessage, nil
+}
+
+// GetFullMessages 批量获取 GetFullMessage 的结果，按消息 ID 索引，不存在的消息不返回。
+// 发送者和接收者只包含公开资料
+func (dm *DatabaseManager) GetFullMessages(ids []uint, viewerID uint) (map[uint]models.FullMessage, error) {
+	fullMessages := make(map[uint]models.FullMessage, len(ids))
+	if len(ids) == 0 {
+		return fullMessages, nil
+	}
+	var messages []models.Message
+	if err := dm.DB.Where("id IN ?", ids).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	if err := dm.AttachReactions(viewerID, messages); err != nil {
+		return nil, err
+	}
+
+	var userIDs, roomIDs []uint
+	for _, message := range messages {
+		userIDs = append(userIDs, message.TalkerID, message.ListenerID)
+		roomIDs = append(roomIDs, message.RoomID)
+	}
+	var users []models.User
+	if err := dm.DB.Select(publicUserColumns).Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	var rooms []models.Room
+	if err := dm.DB.Where("id IN ?", roomIDs).Find(&rooms).Error; err != nil {
+		return nil, err
+	}
+	usersByID := make(map[uint]*models.User, len(users))
+	for i := range users {
+		usersByID[users[i].ID] = &users[i]
+	}
+	roomsByID := make(map[uint]*models.Room, len(rooms))
+	for i := range rooms {
+		roomsByID[rooms[i].ID] = &rooms[i]
+	}
 
-	return fullMessage, err
+	for _, message := range messages {
+		fullMessages[message.ID] = models.FullMessage{
+			Message:  message,
+			Talker:   usersByID[message.TalkerID],
+			Listener: usersByID[message.ListenerID],
+			Room:     roomsByID[message.RoomID],
+		}
+	}
+	return fullMessages, nil
 }
 
 func (dm *DatabaseManager) GetMessageByID(msgID string) (*models.Message, error) {
 	var message models.Message
-	err := dm.DB.Preload("Talker").Preload("Listener").Preload("Room").
-		First(&message, "msg_id = ?", msgID).Error
-	if err != nil {
-
+	if err := dm.DB.First(&message, "msg_id = ?", msgID).Error; err != nil {
 		return nil, err
 	}
 	return &message, nil
@@ -32,9 +127,246 @@ func (dm *DatabaseManager) GetMessageByID(msgID string) (*models.Message, error)
 func (dm *DatabaseManager) GetChats(userID uint) ([]models.Message, error) {
 	var messages []models.Message
 	err := dm.DB.Model(&models.Message{}).
-		Preload("Talker").Preload("Listener").Preload("Room").
 		Joins("LEFT JOIN user_rooms ON messages.room_id = user_rooms.room_id AND user_rooms.user_id = ?", userID).
 		Where("messages.talker_id = ? OR messages.listener_id = ? OR user_rooms.user_id IS NOT NULL", userID, userID).
 		Order("timestamp DESC").Limit(400).Find(&messages).Error
 	return messages, err
 }
+
+// 历史消息分页大小
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 100
+)
+
+var (
+	ErrInvalidCursor       = errors.New("无效的分页游标")
+	ErrMessageNotFound     = errors.New("消息不存在")
+	ErrInvalidConversation = errors.New("必须且只能指定 peer_id 或 room_id 之一")
+	ErrConflictingCursors  = errors.New("before、after、around 只能指定一个")
+)
+
+// MessageCursor 消息在会话中的位置，历史消息按 (timestamp, id) 排序
+type MessageCursor struct {
+	Timestamp int64
+	ID        uint
+}
+
+func cursorOf(message *models.Message) MessageCursor {
+	return MessageCursor{Timestamp: message.Timestamp, ID: message.ID}
+}
+
+// Encode 编码为对客户端不透明的游标字符串
+func (c MessageCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.Timestamp, c.ID)))
+}
+
+func ParseMessageCursor(value string) (MessageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return MessageCursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return MessageCursor{}, ErrInvalidCursor
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return MessageCursor{}, ErrInvalidCursor
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return MessageCursor{}, ErrInvalidCursor
+	}
+	return MessageCursor{Timestamp: timestamp, ID: uint(id)}, nil
+}
+
+// HistoryQuery 单个会话的历史消息查询，PeerID（单聊）和 RoomID（群聊）只能指定一个；
+// Before、After 为游标，Around 为消息 MsgID，都不指定时返回最新的消息
+type HistoryQuery struct {
+	UserID uint
+	PeerID uint
+	RoomID uint
+	Before string
+	After  string
+	Around string
+	Limit  int
+	// HideThreadReplies 不返回话题中的回复，只保留根消息
+	HideThreadReplies bool
+}
+
+// MessageHistory 一页历史消息，Messages 按时间从旧到新排列。
+// PrevCursor 作为 before 获取更早的消息，NextCursor 作为 after 获取更新的消息
+type MessageHistory struct {
+	Messages   []models.Message `json:"messages"`
+	PrevCursor string           `json:"prevCursor,omitempty"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+	HasBefore  bool             `json:"hasBefore"`
+	HasAfter   bool             `json:"hasAfter"`
+}
+
+// GetMessageHistory 按游标分页获取会话历史，群聊需要是房间成员
+func (dm *DatabaseManager) GetMessageHistory(query HistoryQuery) (*MessageHistory, error) {
+	if (query.PeerID == 0) == (query.RoomID == 0) {
+		return nil, ErrInvalidConversation
+	}
+	if query.RoomID != 0 {
+		if err := dm.CheckUserRoom(query.UserID, query.RoomID); err != nil {
+			return nil, err
+		}
+	}
+	return dm.pageHistory(func() *gorm.DB {
+		db := dm.conversationMessages(query.UserID, query.PeerID, query.RoomID)
+		if query.HideThreadReplies {
+			db = db.Where("messages.thread_root_id IS NULL OR messages.thread_root_id = ''")
+		}
+		return db
+	}, query)
+}
+
+// 在 scope 限定的消息中按查询的游标分页
+func (dm *DatabaseManager) pageHistory(scope func() *gorm.DB, query HistoryQuery) (*MessageHistory, error) {
+	cursors := 0
+	for _, value := range []string{query.Before, query.After, query.Around} {
+		if value != "" {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		return nil, ErrConflictingCursors
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultHistoryLimit
+	} else if query.Limit > MaxHistoryLimit {
+		query.Limit = MaxHistoryLimit
+	}
+
+	history := &MessageHistory{}
+	var err error
+	switch {
+	case query.Before != "":
+		cursor, parseErr := ParseMessageCursor(query.Before)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		if history.Messages, history.HasBefore, err = historyPage(scope(), &cursor, true, query.Limit); err != nil {
+			return nil, err
+		}
+		if history.HasAfter, err = hasMessagesBeyond(scope(), cursor, false); err != nil {
+			return nil, err
+		}
+		history.setCursors(cursor)
+	case query.After != "":
+		cursor, parseErr := ParseMessageCursor(query.After)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		if history.Messages, history.HasAfter, err = historyPage(scope(), &cursor, false, query.Limit); err != nil {
+			return nil, err
+		}
+		if history.HasBefore, err = hasMessagesBeyond(scope(), cursor, true); err != nil {
+			return nil, err
+		}
+		history.setCursors(cursor)
+	case query.Around != "":
+		// 以目标消息为中心，前后各取约一半
+		var anchor models.Message
+		if err := scope().Where("messages.msg_id = ?", query.Around).First(&anchor).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrMessageNotFound
+			}
+			return nil, err
+		}
+		cursor := cursorOf(&anchor)
+		older, hasBefore, err := historyPage(scope(), &cursor, true, (query.Limit-1)/2)
+		if err != nil {
+			return nil, err
+		}
+		newer, hasAfter, err := historyPage(scope(), &cursor, false, query.Limit-1-len(older))
+		if err != nil {
+			return nil, err
+		}
+		history.Messages = append(append(older, anchor), newer...)
+		history.HasBefore, history.HasAfter = hasBefore, hasAfter
+		history.setCursors(cursor)
+	default:
+		if history.Messages, history.HasBefore, err = historyPage(scope(), nil, true, query.Limit); err != nil {
+			return nil, err
+		}
+		history.setCursors(MessageCursor{})
+	}
+	if err := dm.AttachReactions(query.UserID, history.Messages); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// 会话中的消息：房间的全部消息，或与 peerID 之间的单聊消息
+func (dm *DatabaseManager) conversationMessages(userID, peerID, roomID uint) *gorm.DB {
+	db := dm.DB.Model(&models.Message{})
+	if roomID != 0 {
+		return db.Where("messages.room_id = ?", roomID)
+	}
+	return db.Where("messages.room_id = 0 AND ((messages.talker_id = ? AND messages.listener_id = ?) OR (messages.talker_id = ? AND messages.listener_id = ?))",
+		userID, peerID, peerID, userID)
+}
+
+// 根据本页首尾消息设置游标，本页为空时沿用请求的游标，便于客户端继续轮询
+func (h *MessageHistory) setCursors(fallback MessageCursor) {
+	if len(h.Messages) == 0 {
+		if fallback != (MessageCursor{}) {
+			h.PrevCursor, h.NextCursor = fallback.Encode(), fallback.Encode()
+		}
+		return
+	}
+	h.PrevCursor = cursorOf(&h.Messages[0]).Encode()
+	h.NextCursor = cursorOf(&h.Messages[len(h.Messages)-1]).Encode()
+}
+
+// 从游标位置（不含）向更早（older）或更新的方向取 limit 条消息，结果按时间正序，
+// 多取一条用于判断该方向是否还有更多消息
+func historyPage(db *gorm.DB, cursor *MessageCursor, older bool, limit int) ([]models.Message, bool, error) {
+	messages := []models.Message{}
+	if limit <= 0 {
+		if cursor == nil {
+			return messages, false, nil
+		}
+		more, err := hasMessagesBeyond(db, *cursor, older)
+		return messages, more, err
+	}
+
+	order := "messages.timestamp ASC, messages.id ASC"
+	if older {
+		order = "messages.timestamp DESC, messages.id DESC"
+	}
+	if cursor != nil {
+		db = whereBeyond(db, *cursor, older)
+	}
+	if err := db.Order(order).Limit(limit + 1).Find(&messages).Error; err != nil {
+		return nil, false, err
+	}
+
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	if older {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, more, nil
+}
+
+func hasMessagesBeyond(db *gorm.DB, cursor MessageCursor, older bool) (bool, error) {
+	var ids []uint
+	err := whereBeyond(db, cursor, older).Limit(1).Pluck("messages.id", &ids).Error
+	return len(ids) > 0, err
+}
+
+func whereBeyond(db *gorm.DB, cursor MessageCursor, older bool) *gorm.DB {
+	if older {
+		return db.Where("messages.timestamp < ? OR (messages.timestamp = ? AND messages.id < ?)", cursor.Timestamp, cursor.Timestamp, cursor.ID)
+	}
+	return db.Where("messages.timestamp > ? OR (messages.timestamp = ? AND messages.id > ?)", cursor.Timestamp, cursor.Timestamp, cursor.ID)
+}
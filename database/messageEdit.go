@@ -0,0 +1,195 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+// 消息编辑和撤回推送给会话所有参与者的事件
+const (
+	EventMessageEdited   = "messageEdited"
+	EventMessageRecalled = "messageRecalled"
+)
+
+var (
+	ErrNotMessageSender    = errors.New("只能操作自己发送的消息")
+	ErrMessageRecalled     = errors.New("消息已撤回")
+	ErrEditWindowExpired   = errors.New("已超过可编辑时间")
+	ErrRecallWindowExpired = errors.New("已超过可撤回时间")
+	ErrEmptyMessage        = errors.New("消息内容不能为空")
+)
+
+// MessageTombstone 消息撤回后推送的占位，客户端据此删除本地内容
+type MessageTombstone struct {
+	MsgID      string    `json:"msgId"`
+	TalkerID   uint      `json:"talkerId"`
+	ListenerID uint      `json:"listenerId"`
+	RoomID     uint      `json:"roomId"`
+	RecalledBy uint      `json:"recalledBy"`
+	RecalledAt time.Time `json:"recalledAt"`
+}
+
+// EditMessage 修改消息内容，只允许发送者在 window 内编辑，旧版本保存到编辑历史。
+// 新增提及的用户会收到提及通知
+func (dm *DatabaseManager) EditMessage(userID uint, msgID string, text map[string]interface{}, mentionIDs []uint, window time.Duration) (*models.Message, error) {
+	if len(text) == 0 {
+		return nil, ErrEmptyMessage
+	}
+	message, err := dm.findMessage(msgID)
+	if err != nil {
+		return nil, err
+	}
+	if message.TalkerID != userID {
+		return nil, ErrNotMessageSender
+	}
+	if message.RecalledAt != nil {
+		return nil, ErrMessageRecalled
+	}
+	if time.Since(message.CreatedAt) > window {
+		return nil, ErrEditWindowExpired
+	}
+	mentionIDs = uniqueMentionIDs(userID, mentionIDs)
+	if err := dm.checkMentionMembers(message, mentionIDs); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	previous := models.MessageEdit{
+		MessageID:     message.ID,
+		MsgID:         message.MsgID,
+		Text:          message.Text,
+		MentionIDList: message.MentionIDList,
+		EditedBy:      userID,
+		CreatedAt:     now,
+	}
+	err = dm.DB.Transaction(func(tx *gorm.DB) error {
+		// 以未撤回为条件更新，防止与撤回并发时把内容写回已撤回的消息
+		message.Text, message.MentionIDList, message.EditedAt = text, mentionIDs, &now
+		result := tx.Model(message).Where("recalled_at IS NULL").Select("text", "mention_id_list", "edited_at").Updates(message)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrMessageRecalled
+		}
+		return tx.Create(&previous).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dm.publish(EventMessageEdited, message, dm.messageParticipants(message)...)
+	recipients := make(map[uint]string, len(mentionIDs))
+	for _, mentionID := range mentionIDs {
+		recipients[mentionID] = models.MentionUser
+	}
+	dm.notifyMentions(message, recipients)
+	return message, nil
+}
+
+// RecallMessage 撤回消息：发送者可以在 window 内撤回，房间管理员可以随时撤回房间中的消息。
+// 撤回后清空内容、编辑历史、表情回应和提及记录，只保留占位
+func (dm *DatabaseManager) RecallMessage(userID uint, msgID string, window time.Duration) (*MessageTombstone, error) {
+	message, err := dm.findMessage(msgID)
+	if err != nil {
+		return nil, err
+	}
+	if message.RecalledAt != nil {
+		return nil, ErrMessageRecalled
+	}
+	if message.TalkerID != userID {
+		if message.RoomID == 0 {
+			return nil, ErrNotMessageSender
+		}
+		if _, err := dm.CheckRoomPermission(userID, message.RoomID, ActionRecall); err != nil {
+			return nil, err
+		}
+	} else if time.Since(message.CreatedAt) > window {
+		return nil, ErrRecallWindowExpired
+	}
+
+	now := time.Now()
+	err = dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("message_id = ?", message.ID).Delete(&models.MessageEdit{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", message.ID).Delete(&models.MessageReaction{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", message.ID).Delete(&models.Mention{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(message).Updates(map[string]interface{}{
+			"text":            nil,
+			"mention_id_list": nil,
+			"recalled_at":     now,
+			"recalled_by":     userID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tombstone := &MessageTombstone{
+		MsgID:      message.MsgID,
+		TalkerID:   message.TalkerID,
+		ListenerID: message.ListenerID,
+		RoomID:     message.RoomID,
+		RecalledBy: userID,
+		RecalledAt: now,
+	}
+	dm.publish(EventMessageRecalled, tombstone, dm.messageParticipants(message)...)
+	return tombstone, nil
+}
+
+// GetMessageEdits 返回消息的编辑历史（按时间正序），只有会话参与者可以查看
+func (dm *DatabaseManager) GetMessageEdits(userID uint, msgID string) ([]models.MessageEdit, error) {
+	message, err := dm.findMessage(msgID)
+	if err != nil {
+		return nil, err
+	}
+	if err := dm.checkMessageAccess(userID, message); err != nil {
+		return nil, err
+	}
+
+	edits := []models.MessageEdit{}
+	err = dm.DB.Where("message_id = ?", message.ID).Order("id ASC").Find(&edits).Error
+	return edits, err
+}
+
+func (dm *DatabaseManager) findMessage(msgID string) (*models.Message, error) {
+	message, err := dm.GetMessageByID(msgID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMessageNotFound
+	}
+	return message, err
+}
+
+// 房间消息需要是房间成员，单聊消息需要是收发双方之一
+func (dm *DatabaseManager) checkMessageAccess(userID uint, message *models.Message) error {
+	if message.RoomID != 0 {
+		return dm.CheckUserRoom(userID, message.RoomID)
+	}
+	if message.TalkerID != userID && message.ListenerID != userID {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// 消息所在会话的全部参与者：房间的当前成员，或单聊双方
+func (dm *DatabaseManager) messageParticipants(message *models.Message) []uint {
+	if message.RoomID != 0 {
+		memberIDs, err := dm.GetRoomMemberIDs(message.RoomID)
+		if err != nil {
+			return nil
+		}
+		return memberIDs
+	}
+	if message.TalkerID == message.ListenerID {
+		return []uint{message.TalkerID}
+	}
+	return []uint{message.TalkerID, message.ListenerID}
+}
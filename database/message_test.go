@@ -0,0 +1,212 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Ireoo/sixin-server/models"
+)
+
+// 直接写入数据库，绕过 CreateMessage 对时间戳的设置，以便构造相同时间戳的消息
+func insertTestMessages(t *testing.T, dm *DatabaseManager, messages ...models.Message) []models.Message {
+	t.Helper()
+	for i := range messages {
+		if err := dm.DB.Create(&messages[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return messages
+}
+
+func historyMsgIDs(history *MessageHistory) []string {
+	ids := []string{}
+	for _, message := range history.Messages {
+		ids = append(ids, message.MsgID)
+	}
+	return ids
+}
+
+func TestGetMessageHistory(t *testing.T) {
+	dm := newTestManager(t)
+	alice := createTestUser(t, dm, "alice")
+	bob := createTestUser(t, dm, "bob")
+	carol := createTestUser(t, dm, "carol")
+
+	// m2、m3、m4 时间戳相同，按 ID 排序
+	timestamps := []int64{1000, 2000, 2000, 2000, 3000, 4000, 5000}
+	var direct []models.Message
+	for i, ts := range timestamps {
+		talker, listener := alice.ID, bob.ID
+		if i%2 == 1 {
+			talker, listener = bob.ID, alice.ID
+		}
+		direct = append(direct, models.Message{MsgID: fmt.Sprintf("m%d", i+1), TalkerID: talker, ListenerID: listener, Timestamp: ts})
+	}
+	messages := insertTestMessages(t, dm, direct...)
+	// 其他会话的消息不应出现在结果中
+	insertTestMessages(t, dm, models.Message{MsgID: "other", TalkerID: alice.ID, ListenerID: carol.ID, Timestamp: 2000})
+
+	cursor := func(msgID string) string {
+		for i := range messages {
+			if messages[i].MsgID == msgID {
+				return cursorOf(&messages[i]).Encode()
+			}
+		}
+		t.Fatalf("unknown message %s", msgID)
+		return ""
+	}
+
+	// 游标指向的消息客户端已经有了，不计入 HasBefore、HasAfter
+	tests := []struct {
+		name          string
+		query         HistoryQuery
+		want          []string
+		wantHasBefore bool
+		wantHasAfter  bool
+	}{
+		{"latest", HistoryQuery{}, []string{"m1", "m2", "m3", "m4", "m5", "m6", "m7"}, false, false},
+		{"latest page", HistoryQuery{Limit: 3}, []string{"m5", "m6", "m7"}, true, false},
+		{"before", HistoryQuery{Before: cursor("m5"), Limit: 2}, []string{"m3", "m4"}, true, true},
+		{"before first page", HistoryQuery{Before: cursor("m4")}, []string{"m1", "m2", "m3"}, false, true},
+		{"before equal timestamp", HistoryQuery{Before: cursor("m3")}, []string{"m1", "m2"}, false, true},
+		{"before newest", HistoryQuery{Before: cursor("m7")}, []string{"m1", "m2", "m3", "m4", "m5", "m6"}, false, false},
+		{"after", HistoryQuery{After: cursor("m2"), Limit: 2}, []string{"m3", "m4"}, true, true},
+		{"after oldest", HistoryQuery{After: cursor("m1"), Limit: 2}, []string{"m2", "m3"}, false, true},
+		{"after equal timestamp", HistoryQuery{After: cursor("m3"), Limit: 2}, []string{"m4", "m5"}, true, true},
+		{"after last page", HistoryQuery{After: cursor("m5")}, []string{"m6", "m7"}, true, false},
+		{"after newest", HistoryQuery{After: cursor("m7")}, []string{}, true, false},
+		{"around", HistoryQuery{Around: "m4", Limit: 3}, []string{"m3", "m4", "m5"}, true, true},
+		{"around even limit", HistoryQuery{Around: "m4", Limit: 4}, []string{"m3", "m4", "m5", "m6"}, true, true},
+		{"around oldest", HistoryQuery{Around: "m1", Limit: 3}, []string{"m1", "m2", "m3"}, false, true},
+		{"around newest", HistoryQuery{Around: "m7", Limit: 3}, []string{"m6", "m7"}, true, false},
+		{"around single", HistoryQuery{Around: "m4", Limit: 1}, []string{"m4"}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := tt.query
+			query.UserID, query.PeerID = alice.ID, bob.ID
+			history, err := dm.GetMessageHistory(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := historyMsgIDs(history); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %v, want %v", got, tt.want)
+			}
+			if history.HasBefore != tt.wantHasBefore || history.HasAfter != tt.wantHasAfter {
+				t.Errorf("hasBefore, hasAfter = %v, %v; want %v, %v", history.HasBefore, history.HasAfter, tt.wantHasBefore, tt.wantHasAfter)
+			}
+		})
+	}
+}
+
+// 依次用 PrevCursor 向前翻页能不重不漏地取完整个会话，空页沿用请求的游标
+func TestGetMessageHistoryCursorPaging(t *testing.T) {
+	dm := newTestManager(t)
+	alice := createTestUser(t, dm, "alice")
+	bob := createTestUser(t, dm, "bob")
+	var direct []models.Message
+	for i := 0; i < 7; i++ {
+		direct = append(direct, models.Message{MsgID: fmt.Sprintf("m%d", i+1), TalkerID: alice.ID, ListenerID: bob.ID, Timestamp: 1000})
+	}
+	insertTestMessages(t, dm, direct...)
+
+	var pages [][]string
+	query := HistoryQuery{UserID: alice.ID, PeerID: bob.ID, Limit: 3}
+	for {
+		history, err := dm.GetMessageHistory(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, historyMsgIDs(history))
+		if !history.HasBefore {
+			break
+		}
+		query.Before = history.PrevCursor
+	}
+	want := [][]string{{"m5", "m6", "m7"}, {"m2", "m3", "m4"}, {"m1"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Fatalf("pages = %v, want %v", pages, want)
+	}
+
+	last := HistoryQuery{UserID: alice.ID, PeerID: bob.ID, Limit: 1}
+	history, err := dm.GetMessageHistory(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last.After = history.NextCursor
+	empty, err := dm.GetMessageHistory(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Messages) != 0 || empty.NextCursor != history.NextCursor || empty.PrevCursor != history.NextCursor {
+		t.Errorf("empty page = %v, prev %q, next %q; want cursors %q", historyMsgIDs(empty), empty.PrevCursor, empty.NextCursor, history.NextCursor)
+	}
+}
+
+func TestGetMessageHistoryLimit(t *testing.T) {
+	dm := newTestManager(t)
+	alice := createTestUser(t, dm, "alice")
+	bob := createTestUser(t, dm, "bob")
+	var direct []models.Message
+	for i := 0; i < MaxHistoryLimit+20; i++ {
+		direct = append(direct, models.Message{MsgID: fmt.Sprintf("m%d", i+1), TalkerID: alice.ID, ListenerID: bob.ID, Timestamp: int64(i)})
+	}
+	if err := dm.DB.CreateInBatches(direct, 50).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{0, DefaultHistoryLimit},
+		{-1, DefaultHistoryLimit},
+		{10, 10},
+		{MaxHistoryLimit, MaxHistoryLimit},
+		{MaxHistoryLimit + 1, MaxHistoryLimit},
+	}
+	for _, tt := range tests {
+		history, err := dm.GetMessageHistory(HistoryQuery{UserID: alice.ID, PeerID: bob.ID, Limit: tt.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history.Messages) != tt.want || !history.HasBefore {
+			t.Errorf("limit %d: got %d messages, hasBefore %v; want %d, true", tt.limit, len(history.Messages), history.HasBefore, tt.want)
+		}
+	}
+}
+
+func TestGetMessageHistoryErrors(t *testing.T) {
+	dm := newTestManager(t)
+	alice := createTestUser(t, dm, "alice")
+	bob := createTestUser(t, dm, "bob")
+	room := &models.Room{Name: "room", OwnerID: alice.ID}
+	if err := dm.CreateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+	valid := MessageCursor{Timestamp: 1, ID: 1}.Encode()
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  error
+	}{
+		{"no conversation", HistoryQuery{UserID: alice.ID}, ErrInvalidConversation},
+		{"peer and room", HistoryQuery{UserID: alice.ID, PeerID: bob.ID, RoomID: room.ID}, ErrInvalidConversation},
+		{"not room member", HistoryQuery{UserID: bob.ID, RoomID: room.ID}, ErrNotRoomMember},
+		{"before and after", HistoryQuery{UserID: alice.ID, PeerID: bob.ID, Before: valid, After: valid}, ErrConflictingCursors},
+		{"after and around", HistoryQuery{UserID: alice.ID, PeerID: bob.ID, After: valid, Around: "m1"}, ErrConflictingCursors},
+		{"invalid cursor", HistoryQuery{UserID: alice.ID, PeerID: bob.ID, Before: "!!"}, ErrInvalidCursor},
+		{"malformed cursor", HistoryQuery{UserID: alice.ID, PeerID: bob.ID, After: "MTIz"}, ErrInvalidCursor},
+		{"unknown around", HistoryQuery{UserID: alice.ID, PeerID: bob.ID, Around: "missing"}, ErrMessageNotFound},
+		{"around in other conversation", HistoryQuery{UserID: alice.ID, RoomID: room.ID, Around: "direct"}, ErrMessageNotFound},
+	}
+	insertTestMessages(t, dm, models.Message{MsgID: "direct", TalkerID: alice.ID, ListenerID: bob.ID, Timestamp: 1000})
+	for _, tt := range tests {
+		if _, err := dm.GetMessageHistory(tt.query); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+// RoomAction 需要权限检查的房间操作
+type RoomAction string
+
+const (
+	ActionInvite       RoomAction = "invite"
+	ActionKick         RoomAction = "kick"
+	ActionRename       RoomAction = "rename"
+	ActionChangeAvatar RoomAction = "change_avatar"
+	ActionDeleteRoom   RoomAction = "delete_room"
+	ActionPost         RoomAction = "post"
+	ActionPin          RoomAction = "pin"
+	ActionRecall       RoomAction = "recall"
+	ActionMentionAll   RoomAction = "mention_all"
+	ActionManageAdmins RoomAction = "manage_admins"
+)
+
+// 各操作允许的角色，未列出的角色（包括非成员）一律拒绝
+var roomPermissions = map[RoomAction][]string{
+	ActionInvite:       {models.RoomRoleOwner, models.RoomRoleAdmin, models.RoomRoleMember},
+	ActionKick:         {models.RoomRoleOwner, models.RoomRoleAdmin},
+	ActionRename:       {models.RoomRoleOwner, models.RoomRoleAdmin},
+	ActionChangeAvatar: {models.RoomRoleOwner, models.RoomRoleAdmin},
+	ActionDeleteRoom:   {models.RoomRoleOwner},
+	ActionPost:         {models.RoomRoleOwner, models.RoomRoleAdmin, models.RoomRoleMember},
+	ActionPin:          {models.RoomRoleOwner, models.RoomRoleAdmin},
+	ActionRecall:       {models.RoomRoleOwner, models.RoomRoleAdmin},
+	ActionMentionAll:   {models.RoomRoleOwner, models.RoomRoleAdmin},
+	ActionManageAdmins: {models.RoomRoleOwner},
+}
+
+var actionNames = map[RoomAction]string{
+	ActionInvite:       "邀请成员",
+	ActionKick:         "移除成员",
+	ActionRename:       "修改房间名称",
+	ActionChangeAvatar: "修改房间头像",
+	ActionDeleteRoom:   "删除房间",
+	ActionPost:         "发送消息",
+	ActionPin:          "置顶消息",
+	ActionRecall:       "撤回他人消息",
+	ActionMentionAll:   "提及所有人",
+	ActionManageAdmins: "设置管理员",
+}
+
+var (
+	ErrRoomNotFound  = errors.New("房间不存在")
+	ErrNotRoomMember = errors.New("不是房间成员")
+	// 房主离开会使房间失去管理者，只能删除房间
+	ErrOwnerCannotLeave = errors.New("房主不能退出房间，请先删除房间")
+)
+
+// PermissionError 没有权限执行房间操作
+type PermissionError struct {
+	RoomID uint
+	Action RoomAction
+	Role   string // 为空表示不是房间成员
+}
+
+func (e *PermissionError) Error() string {
+	if e.Role == "" {
+		return fmt.Sprintf("没有权限%s：不是房间 %d 的成员", actionNames[e.Action], e.RoomID)
+	}
+	return fmt.Sprintf("没有权限%s：当前角色 %s 不允许该操作", actionNames[e.Action], e.Role)
+}
+
+// IsPermissionError 判断错误是否为权限不足
+func IsPermissionError(err error) bool {
+	var permissionErr *PermissionError
+	return errors.As(err, &permissionErr)
+}
+
+// RoleAllows 检查角色是否允许执行操作
+func RoleAllows(role string, action RoomAction) bool {
+	for _, allowed := range roomPermissions[action] {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRoomRole 获取用户在房间中的角色，不是成员时返回空字符串
+func (dm *DatabaseManager) GetRoomRole(userID, roomID uint) (string, error) {
+	var room models.Room
+	if err := dm.DB.Select("id", "owner_id").First(&room, roomID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrRoomNotFound
+		}
+		return "", err
+	}
+	if room.OwnerID == userID {
+		return models.RoomRoleOwner, nil
+	}
+
+	var userRoom models.UserRoom
+	err := dm.DB.Where("user_id = ? AND room_id = ?", userID, roomID).First(&userRoom).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var adminCount int64
+	if err := dm.DB.Table("room_admins").Where("room_id = ? AND user_id = ?", roomID, userID).Count(&adminCount).Error; err != nil {
+		return "", err
+	}
+	return memberRole(userRoom.Role, adminCount > 0), nil
+}
+
+// 非房主成员的角色：管理员优先，其次是成员记录中的访客或普通成员
+func memberRole(role string, isAdmin bool) string {
+	if isAdmin {
+		return models.RoomRoleAdmin
+	}
+	if role == models.RoomRoleGuest {
+		return models.RoomRoleGuest
+	}
+	return models.RoomRoleMember
+}
+
+// CheckRoomPermission 检查用户能否在房间中执行操作，返回用户角色；权限不足时返回 *PermissionError
+func (dm *DatabaseManager) CheckRoomPermission(userID, roomID uint, action RoomAction) (string, error) {
+	role, err := dm.GetRoomRole(userID, roomID)
+	if err != nil {
+		return "", err
+	}
+	if !RoleAllows(role, action) {
+		return role, &PermissionError{RoomID: roomID, Action: action, Role: role}
+	}
+	return role, nil
+}
+
+// CheckKickPermission 检查能否将目标用户移出房间：房主可以移除任何人，管理员只能移除普通成员和访客
+func (dm *DatabaseManager) CheckKickPermission(actorID, targetID, roomID uint) error {
+	actorRole, err := dm.CheckRoomPermission(actorID, roomID, ActionKick)
+	if err != nil {
+		return err
+	}
+
+	targetRole, err := dm.GetRoomRole(targetID, roomID)
+	if err != nil {
+		return err
+	}
+	if targetRole == "" {
+		return ErrNotRoomMember
+	}
+	if targetRole == models.RoomRoleOwner ||
+		(actorRole == models.RoomRoleAdmin && targetRole == models.RoomRoleAdmin) {
+		return &PermissionError{RoomID: roomID, Action: ActionKick, Role: actorRole}
+	}
+	return nil
+}
+
+// CheckRemoveMember 检查能否将用户移出房间：自己退出时房主不能退出，移除他人需要踢人权限
+func (dm *DatabaseManager) CheckRemoveMember(actorID, targetID, roomID uint) error {
+	if actorID != targetID {
+		return dm.CheckKickPermission(actorID, targetID, roomID)
+	}
+	role, err := dm.GetRoomRole(actorID, roomID)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return ErrNotRoomMember
+	}
+	if role == models.RoomRoleOwner {
+		return ErrOwnerCannotLeave
+	}
+	return nil
+}
+
+// CheckManageMember 检查能否修改成员的别名和隐私设置：自己可以修改，修改他人需要踢人权限
+func (dm *DatabaseManager) CheckManageMember(actorID, targetID, roomID uint) error {
+	if actorID == targetID {
+		return nil
+	}
+	return dm.CheckKickPermission(actorID, targetID, roomID)
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+)
+
+// UpdateLastSeen 记录用户最后在线时间
+func (dm *DatabaseManager) UpdateLastSeen(userID uint, at time.Time) error {
+	return dm.DB.Model(&models.User{}).Where("id = ?", userID).UpdateColumn("last_seen_at", at).Error
+}
+
+// GetLastSeen 批量获取用户最后在线时间，从未上线的用户不在结果中
+func (dm *DatabaseManager) GetLastSeen(userIDs []uint) (map[uint]time.Time, error) {
+	var users []models.User
+	if err := dm.DB.Select("id", "last_seen_at").Where("id IN ? AND last_seen_at IS NOT NULL", userIDs).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	lastSeen := make(map[uint]time.Time, len(users))
+	for _, user := range users {
+		lastSeen[user.ID] = *user.LastSeenAt
+	}
+	return lastSeen, nil
+}
+
+// PresenceAudience 可以看到用户在线状态的好友：用户好友列表中未设为私密的好友
+func (dm *DatabaseManager) PresenceAudience(userID uint) ([]uint, error) {
+	var friendIDs []uint
+	err := dm.DB.Model(&models.UserFriend{}).
+		Where("user_id = ? AND is_private = ?", userID, false).
+		Pluck("friend_id", &friendIDs).Error
+	return friendIDs, err
+}
+
+// PresenceVisibleTo 从 userIDs 中筛选出 viewerID 可以看到在线状态的用户（包括自己）
+func (dm *DatabaseManager) PresenceVisibleTo(viewerID uint, userIDs []uint) ([]uint, error) {
+	var visible []uint
+	err := dm.DB.Model(&models.UserFriend{}).
+		Where("user_id IN ? AND friend_id = ? AND is_private = ?", userIDs, viewerID, false).
+		Pluck("user_id", &visible).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, userID := range userIDs {
+		if userID == viewerID {
+			visible = append(visible, viewerID)
+			break
+		}
+	}
+	return visible, nil
+}
+
+var ErrNoDirectConversation = errors.New("与对方不是好友，也没有会话")
+
+// CheckTypingTarget 检查用户能否向会话发送输入状态：群聊需要是房间成员，
+// 单聊需要与对方是好友（任一方的好友列表中有对方）或已经有过消息
+func (dm *DatabaseManager) CheckTypingTarget(userID, peerID, roomID uint) error {
+	if err := dm.checkConversation(userID, peerID, roomID); err != nil {
+		return err
+	}
+	if roomID != 0 {
+		return nil
+	}
+
+	var count int64
+	err := dm.DB.Model(&models.UserFriend{}).
+		Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)", userID, peerID, peerID, userID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	var ids []uint
+	if err := dm.conversationMessages(userID, peerID, 0).Limit(1).Pluck("messages.id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return ErrNoDirectConversation
+	}
+	return nil
+}
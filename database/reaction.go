@@ -0,0 +1,207 @@
+package database
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm/clause"
+)
+
+// 表情回应变化推送给会话所有参与者的事件
+const (
+	EventReactionAdded   = "reactionAdded"
+	EventReactionRemoved = "reactionRemoved"
+)
+
+// maxEmojiLength 表情最多包含的字符数，组合表情由多个字符组成
+const maxEmojiLength = 16
+
+var ErrInvalidEmoji = errors.New("无效的表情")
+
+// 可以作为表情主体的码位范围：常用符号、杂项符号和装饰符号，以及 U+1F000 起的表情区块
+var emojiBaseRanges = [][2]rune{
+	{0x00A9, 0x00A9}, {0x00AE, 0x00AE}, {0x203C, 0x203C}, {0x2049, 0x2049},
+	{0x2122, 0x2122}, {0x2139, 0x2139}, {0x2194, 0x2199}, {0x21A9, 0x21AA},
+	{0x231A, 0x231B}, {0x2328, 0x2328}, {0x23CF, 0x23CF}, {0x23E9, 0x23F3},
+	{0x23F8, 0x23FA}, {0x24C2, 0x24C2}, {0x25AA, 0x25AB}, {0x25B6, 0x25B6},
+	{0x25C0, 0x25C0}, {0x25FB, 0x25FE}, {0x2600, 0x27BF}, {0x2934, 0x2935},
+	{0x2B05, 0x2B07}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x3030, 0x3030}, {0x303D, 0x303D}, {0x3297, 0x3297}, {0x3299, 0x3299},
+	{0x1F000, 0x1FAFF},
+}
+
+// 组合表情中跟在主体后面的码位
+const (
+	emojiZWJ          = 0x200D // 连接两个表情
+	emojiPresentation = 0xFE0F // 以表情样式显示
+	textPresentation  = 0xFE0E
+	emojiKeycap       = 0x20E3 // 键帽，跟在 0-9、#、* 之后
+)
+
+func isEmojiBase(r rune) bool {
+	for _, span := range emojiBaseRanges {
+		if r >= span[0] && r <= span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// 修饰符：肤色、样式选择符，以及区旗使用的标签字符
+func isEmojiModifier(r rune) bool {
+	return (r >= 0x1F3FB && r <= 0x1F3FF) || r == emojiPresentation || r == textPresentation || (r >= 0xE0020 && r <= 0xE007F)
+}
+
+// isEmoji 判断 value 是否为单个表情或组合表情：由表情主体开始，主体之后只能跟修饰符，
+// 多个主体之间用零宽连接符连接；国旗为两个区域指示符号，键帽表情为 0-9、#、* 加可选的 U+FE0F 和 U+20E3
+func isEmoji(value string) bool {
+	if value == "" || !utf8.ValidString(value) || utf8.RuneCountInString(value) > maxEmojiLength {
+		return false
+	}
+	runes := []rune(value)
+	if r := runes[0]; (r >= '0' && r <= '9') || r == '#' || r == '*' {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == emojiPresentation {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == emojiKeycap
+	}
+
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	expectBase := true
+	for _, r := range runes {
+		switch {
+		case expectBase:
+			if !isEmojiBase(r) || isEmojiModifier(r) || isRegionalIndicator(r) {
+				return false
+			}
+			expectBase = false
+		case r == emojiZWJ:
+			expectBase = true
+		case !isEmojiModifier(r):
+			return false
+		}
+	}
+	return !expectBase
+}
+
+// 区域指示符号，两个组成一面国旗
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// ReactionDelta 表情回应的变化，Count 为变化后该表情的回应人数
+type ReactionDelta struct {
+	MsgID      string `json:"msgId"`
+	TalkerID   uint   `json:"talkerId"`
+	ListenerID uint   `json:"listenerId"`
+	RoomID     uint   `json:"roomId"`
+	UserID     uint   `json:"userId"`
+	Emoji      string `json:"emoji"`
+	Count      int64  `json:"count"`
+}
+
+// AddReaction 添加表情回应，重复添加不会产生变化
+func (dm *DatabaseManager) AddReaction(userID uint, msgID, emoji string) (*ReactionDelta, error) {
+	message, err := dm.reactableMessage(userID, msgID, emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	reaction := models.MessageReaction{MessageID: message.ID, UserID: userID, Emoji: emoji}
+	result := dm.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return dm.reactionChanged(message, userID, emoji, EventReactionAdded, result.RowsAffected > 0)
+}
+
+// RemoveReaction 取消表情回应，未回应过时不会产生变化
+func (dm *DatabaseManager) RemoveReaction(userID uint, msgID, emoji string) (*ReactionDelta, error) {
+	message, err := dm.reactableMessage(userID, msgID, emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	result := dm.DB.Where("message_id = ? AND user_id = ? AND emoji = ?", message.ID, userID, emoji).Delete(&models.MessageReaction{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return dm.reactionChanged(message, userID, emoji, EventReactionRemoved, result.RowsAffected > 0)
+}
+
+// AttachReactions 为消息填充表情回应汇总，viewerID 用于标记查询者是否回应过
+func (dm *DatabaseManager) AttachReactions(viewerID uint, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	index := make(map[uint]int, len(messages))
+	ids := make([]uint, 0, len(messages))
+	for i := range messages {
+		index[messages[i].ID] = i
+		ids = append(ids, messages[i].ID)
+	}
+
+	var rows []struct {
+		MessageID uint
+		Emoji     string
+		Count     int64
+		Reacted   bool
+	}
+	err := dm.DB.Model(&models.MessageReaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, MAX(CASE WHEN user_id = ? THEN 1 ELSE 0 END) AS reacted", viewerID).
+		Where("message_id IN ?", ids).
+		Group("message_id, emoji").
+		Order("MIN(id)").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		message := &messages[index[row.MessageID]]
+		message.Reactions = append(message.Reactions, models.ReactionCount{Emoji: row.Emoji, Count: row.Count, Reacted: row.Reacted})
+	}
+	return nil
+}
+
+// 可以回应的消息：查询者是会话参与者，消息未撤回
+func (dm *DatabaseManager) reactableMessage(userID uint, msgID, emoji string) (*models.Message, error) {
+	if !isEmoji(emoji) {
+		return nil, ErrInvalidEmoji
+	}
+	message, err := dm.findMessage(msgID)
+	if err != nil {
+		return nil, err
+	}
+	if err := dm.checkMessageAccess(userID, message); err != nil {
+		return nil, err
+	}
+	if message.RecalledAt != nil {
+		return nil, ErrMessageRecalled
+	}
+	return message, nil
+}
+
+// 有变化时推送给会话参与者
+func (dm *DatabaseManager) reactionChanged(message *models.Message, userID uint, emoji, event string, changed bool) (*ReactionDelta, error) {
+	delta := &ReactionDelta{
+		MsgID:      message.MsgID,
+		TalkerID:   message.TalkerID,
+		ListenerID: message.ListenerID,
+		RoomID:     message.RoomID,
+		UserID:     userID,
+		Emoji:      emoji,
+	}
+	err := dm.DB.Model(&models.MessageReaction{}).Where("message_id = ? AND emoji = ?", message.ID, emoji).Count(&delta.Count).Error
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		dm.publish(event, delta, dm.messageParticipants(message)...)
+	}
+	return delta, nil
+}
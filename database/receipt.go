@@ -0,0 +1,298 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+// 回执类型
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// EventReceipt 推送给消息发送者的回执事件
+const EventReceipt = "receipt"
+
+// MaxReceiptQuery 一次最多查询回执的消息数量
+const MaxReceiptQuery = 100
+
+var ErrTooManyReceipts = fmt.Errorf("一次最多查询 %d 条消息的回执", MaxReceiptQuery)
+
+// Receipt 推送给发送者的回执：UserID 已收到（或已读）MsgID 及之前的全部消息
+type Receipt struct {
+	Type   string    `json:"type"`
+	UserID uint      `json:"userId"` // 确认的用户，单聊中即会话对方
+	RoomID uint      `json:"roomId,omitempty"`
+	MsgID  string    `json:"msgId"`
+	Cursor string    `json:"cursor"`
+	At     time.Time `json:"at"`
+}
+
+// MessageReceipt 单条消息的回执汇总。群聊只统计数量，不逐个记录成员；
+// 单聊的数量为 0 或 1，并带有送达和已读时间
+type MessageReceipt struct {
+	MsgID          string     `json:"msgId"`
+	RecipientCount int64      `json:"recipientCount"`
+	DeliveredCount int64      `json:"deliveredCount"`
+	ReadCount      int64      `json:"readCount"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	ReadAt         *time.Time `json:"readAt,omitempty"`
+}
+
+// MemberCursor 房间成员的送达和已读位置
+type MemberCursor struct {
+	UserID          uint   `json:"userId"`
+	DeliveredCursor string `json:"deliveredCursor,omitempty"`
+	ReadCursor      string `json:"readCursor,omitempty"`
+}
+
+// MarkConversationDelivered 把送达位置推进到 msgID 对应的消息，msgID 为空时推进到最新消息
+func (dm *DatabaseManager) MarkConversationDelivered(userID, peerID, roomID uint, msgID string) (*models.ConversationState, error) {
+	return dm.advanceConversation(userID, peerID, roomID, msgID, ReceiptDelivered)
+}
+
+// 推进会话的送达或已读位置，已读同时推进送达位置。位置只前进不后退，
+// 推进后更新单聊消息的送达、已读时间，并向范围内消息的发送者推送回执；
+// 已读位置之前的提及同时标记为已读
+func (dm *DatabaseManager) advanceConversation(userID, peerID, roomID uint, msgID, kind string) (*models.ConversationState, error) {
+	if err := dm.checkConversation(userID, peerID, roomID); err != nil {
+		return nil, err
+	}
+
+	query := dm.conversationMessages(userID, peerID, roomID)
+	if msgID != "" {
+		query = query.Where("messages.msg_id = ?", msgID)
+	}
+	var target []models.Message
+	if err := query.Order("messages.timestamp DESC, messages.id DESC").Limit(1).Find(&target).Error; err != nil {
+		return nil, err
+	}
+	if len(target) == 0 && msgID != "" {
+		return nil, ErrMessageNotFound
+	}
+
+	var state models.ConversationState
+	var delivered, read *MessageCursor
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := conversationState(tx, userID, peerID, roomID, &state); err != nil {
+			return err
+		}
+		if len(target) == 0 {
+			return nil
+		}
+
+		next := cursorOf(&target[0])
+		updates := make(map[string]interface{})
+		if current := deliveredCursorOf(&state); next.after(current) {
+			delivered = &current
+			updates["last_delivered_timestamp"], updates["last_delivered_id"] = next.Timestamp, next.ID
+			state.LastDeliveredTimestamp, state.LastDeliveredID = next.Timestamp, next.ID
+		}
+		if current := (MessageCursor{Timestamp: state.LastReadTimestamp, ID: state.LastReadID}); kind == ReceiptRead && next.after(current) {
+			read = &current
+			updates["last_read_timestamp"], updates["last_read_id"] = next.Timestamp, next.ID
+			state.LastReadTimestamp, state.LastReadID = next.Timestamp, next.ID
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(&state).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 已读回执包含送达，只有单纯送达时才推送送达回执
+	now := time.Now()
+	if read != nil {
+		if err := dm.readMentionsUpTo(&state, cursorOf(&target[0]), now); err != nil {
+			return nil, err
+		}
+		err = dm.applyReceipt(ReceiptRead, &state, *read, &target[0], now)
+	} else if delivered != nil {
+		err = dm.applyReceipt(ReceiptDelivered, &state, *delivered, &target[0], now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// 回执覆盖 (from, to] 范围内他人发送的消息
+func (dm *DatabaseManager) applyReceipt(kind string, state *models.ConversationState, from MessageCursor, to *models.Message, now time.Time) error {
+	inRange := func() *gorm.DB {
+		db := whereBeyond(dm.conversationMessages(state.UserID, state.PeerID, state.RoomID), from, false)
+		return whereBeyond(db, MessageCursor{Timestamp: to.Timestamp, ID: to.ID + 1}, true).
+			Where("messages.talker_id <> ?", state.UserID)
+	}
+
+	var senderIDs []uint
+	if state.RoomID == 0 {
+		result := inRange().Where("messages.delivered_at IS NULL").UpdateColumn("delivered_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		affected := result.RowsAffected
+		if kind == ReceiptRead {
+			result = inRange().Where("messages.read_at IS NULL").UpdateColumn("read_at", now)
+			if result.Error != nil {
+				return result.Error
+			}
+			affected += result.RowsAffected
+		}
+		if affected > 0 {
+			senderIDs = []uint{state.PeerID}
+		}
+	} else if err := inRange().Distinct("messages.talker_id").Pluck("messages.talker_id", &senderIDs).Error; err != nil {
+		return err
+	}
+
+	dm.publish(EventReceipt, Receipt{
+		Type:   kind,
+		UserID: state.UserID,
+		RoomID: state.RoomID,
+		MsgID:  to.MsgID,
+		Cursor: cursorOf(to).Encode(),
+		At:     now,
+	}, senderIDs...)
+	return nil
+}
+
+// GetReceipts 查询会话中指定消息的回执。群聊按成员的送达、已读位置汇总数量，
+// 只统计当前成员，不包括发送者本人
+func (dm *DatabaseManager) GetReceipts(userID, peerID, roomID uint, msgIDs []string) ([]MessageReceipt, error) {
+	if err := dm.checkConversation(userID, peerID, roomID); err != nil {
+		return nil, err
+	}
+	if len(msgIDs) > MaxReceiptQuery {
+		return nil, ErrTooManyReceipts
+	}
+
+	receipts := []MessageReceipt{}
+	if len(msgIDs) == 0 {
+		return receipts, nil
+	}
+	var messages []models.Message
+	err := dm.conversationMessages(userID, peerID, roomID).
+		Where("messages.msg_id IN ?", msgIDs).
+		Order("messages.timestamp ASC, messages.id ASC").
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if roomID == 0 {
+		for _, message := range messages {
+			receipt := MessageReceipt{MsgID: message.MsgID, RecipientCount: 1, DeliveredAt: message.DeliveredAt, ReadAt: message.ReadAt}
+			if message.DeliveredAt != nil {
+				receipt.DeliveredCount = 1
+			}
+			if message.ReadAt != nil {
+				receipt.ReadCount = 1
+			}
+			receipts = append(receipts, receipt)
+		}
+		return receipts, nil
+	}
+
+	// 成员数和发送者是否仍是成员只查询一次，送达和已读数量用一条分组查询统计
+	var memberCount int64
+	if err := dm.DB.Model(&models.UserRoom{}).Where("room_id = ?", roomID).Count(&memberCount).Error; err != nil {
+		return nil, err
+	}
+	messageIDs := make([]uint, 0, len(messages))
+	talkerIDs := make([]uint, 0, len(messages))
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+		talkerIDs = append(talkerIDs, message.TalkerID)
+	}
+	var memberTalkers []uint
+	if err := dm.DB.Model(&models.UserRoom{}).Where("room_id = ? AND user_id IN ?", roomID, talkerIDs).Pluck("user_id", &memberTalkers).Error; err != nil {
+		return nil, err
+	}
+	isMember := make(map[uint]bool, len(memberTalkers))
+	for _, talkerID := range memberTalkers {
+		isMember[talkerID] = true
+	}
+
+	const readCond = "conversation_states.last_read_timestamp > messages.timestamp OR " +
+		"(conversation_states.last_read_timestamp = messages.timestamp AND conversation_states.last_read_id >= messages.id)"
+	const deliveredCond = "conversation_states.last_delivered_timestamp > messages.timestamp OR " +
+		"(conversation_states.last_delivered_timestamp = messages.timestamp AND conversation_states.last_delivered_id >= messages.id)"
+	var counts []struct {
+		MessageID      uint
+		ReadCount      int64
+		DeliveredCount int64
+	}
+	err = dm.DB.Model(&models.Message{}).
+		Select("messages.id AS message_id, "+
+			"SUM(CASE WHEN "+readCond+" THEN 1 ELSE 0 END) AS read_count, "+
+			"SUM(CASE WHEN "+readCond+" OR "+deliveredCond+" THEN 1 ELSE 0 END) AS delivered_count").
+		Joins("JOIN conversation_states ON conversation_states.room_id = messages.room_id AND conversation_states.user_id <> messages.talker_id AND conversation_states.deleted_at IS NULL").
+		Joins("JOIN user_rooms ON user_rooms.user_id = conversation_states.user_id AND user_rooms.room_id = conversation_states.room_id AND user_rooms.deleted_at IS NULL").
+		Where("messages.id IN ?", messageIDs).
+		Group("messages.id").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	countsByID := make(map[uint]int, len(counts))
+	for i, count := range counts {
+		countsByID[count.MessageID] = i
+	}
+
+	for _, message := range messages {
+		receipt := MessageReceipt{MsgID: message.MsgID, RecipientCount: memberCount, DeliveredAt: message.DeliveredAt, ReadAt: message.ReadAt}
+		if isMember[message.TalkerID] {
+			receipt.RecipientCount--
+		}
+		if i, ok := countsByID[message.ID]; ok {
+			receipt.ReadCount, receipt.DeliveredCount = counts[i].ReadCount, counts[i].DeliveredCount
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+// GetRoomMemberCursors 返回房间中有送达或已读记录的成员位置
+func (dm *DatabaseManager) GetRoomMemberCursors(userID, roomID uint) ([]MemberCursor, error) {
+	if err := dm.CheckUserRoom(userID, roomID); err != nil {
+		return nil, err
+	}
+
+	var states []models.ConversationState
+	err := dm.DB.Model(&models.ConversationState{}).
+		Joins("JOIN user_rooms ON user_rooms.user_id = conversation_states.user_id AND user_rooms.room_id = conversation_states.room_id AND user_rooms.deleted_at IS NULL").
+		Where("conversation_states.room_id = ? AND (conversation_states.last_delivered_id <> 0 OR conversation_states.last_read_id <> 0)", roomID).
+		Find(&states).Error
+	if err != nil {
+		return nil, err
+	}
+
+	cursors := make([]MemberCursor, 0, len(states))
+	for i := range states {
+		cursor := MemberCursor{UserID: states[i].UserID, ReadCursor: readCursor(&states[i])}
+		if delivered := deliveredCursorOf(&states[i]); delivered.ID != 0 {
+			cursor.DeliveredCursor = delivered.Encode()
+		}
+		cursors = append(cursors, cursor)
+	}
+	return cursors, nil
+}
+
+// 送达位置，早于已读位置时以已读位置为准（兼容送达字段加入之前的已读记录）
+func deliveredCursorOf(state *models.ConversationState) MessageCursor {
+	delivered := MessageCursor{Timestamp: state.LastDeliveredTimestamp, ID: state.LastDeliveredID}
+	read := MessageCursor{Timestamp: state.LastReadTimestamp, ID: state.LastReadID}
+	if read.after(delivered) {
+		return read
+	}
+	return delivered
+}
+
+func (c MessageCursor) after(other MessageCursor) bool {
+	return c.Timestamp > other.Timestamp || (c.Timestamp == other.Timestamp && c.ID > other.ID)
+}
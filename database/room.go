@@ -1,40 +1,131 @@
 package database
 
 import (
+	"errors"
+
 	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
 )
 
 func (dm *DatabaseManager) GetRoomMembers(roomID uint) ([]models.User, error) {
 	var members []models.User
 	err := dm.DB.Model(&models.User{}).
-		Joins("JOIN user_rooms ON users.id = user_rooms.user_id").
-		Where("user_rooms.id = ?", roomID).
+		Joins("JOIN user_rooms ON users.id = user_rooms.user_id AND user_rooms.deleted_at IS NULL").
+		Where("user_rooms.room_id = ?", roomID).
 		Find(&members).Error
 	return members, err
 }
 
+// GetRoomMemberIDs 获取房间所有成员的用户 ID
+func (dm *DatabaseManager) GetRoomMemberIDs(roomID uint) ([]uint, error) {
+	var userIDs []uint
+	err := dm.DB.Model(&models.UserRoom{}).Where("room_id = ?", roomID).Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
 func (dm *DatabaseManager) GetRooms(userID uint) ([]models.Room, error) {
 	var rooms []models.Room
-	err := dm.DB.Model(&models.Room{}).Where("user_id = ?", userID).Find(&rooms).Error
+	err := dm.DB.Model(&models.Room{}).
+		Joins("JOIN user_rooms ON rooms.id = user_rooms.room_id AND user_rooms.deleted_at IS NULL").
+		Where("user_rooms.user_id = ?", userID).
+		Find(&rooms).Error
 	return rooms, err
 }
 
-func (dm *DatabaseManager) UpdateRoomByOwner(userId, id uint, updatedRoom models.Room) error {
-	// 根据userid是ownerid是否是这个房间的管理者，如果是就修改用户这个房间信息
-	var room models.Room
-	err := dm.DB.Model(&models.Room{}).Where("owner_id = ? AND id = ?", userId, id).First(&room).Error
+// UpdateRoomInfo 更新房间名称、头像等公共信息，调用方负责权限检查
+func (dm *DatabaseManager) UpdateRoomInfo(roomID uint, updates map[string]interface{}) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	result := dm.DB.Model(&models.Room{}).Where("id = ?", roomID).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRoomNotFound
+	}
+
+	event := map[string]interface{}{"roomId": roomID}
+	for column, value := range updates {
+		event[column] = value
+	}
+	dm.publishToRoom(roomID, EventRoomUpdated, event)
+	return nil
+}
+
+// CreateRoom 创建房间，并将房主加入成员列表
+func (dm *DatabaseManager) CreateRoom(room *models.Room) error {
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Room{}).Omit("Owner", "Members", "Admins", "Messages").Create(room).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.UserRoom{UserID: room.OwnerID, RoomID: room.ID, Role: models.RoomRoleMember}).Error
+	})
 	if err != nil {
 		return err
 	}
+	dm.membershipChanged(room.ID, true, room.OwnerID)
+	dm.publish(EventRoomMemberAdded, map[string]interface{}{
+		"roomId": room.ID, "userId": room.OwnerID, "role": models.RoomRoleOwner, "room": room,
+	}, room.OwnerID)
+	return nil
+}
 
-	updatedRoom.OwnerID = userId
-	updatedRoom.Members = room.Members
-
-	return dm.DB.Model(&models.Room{}).Where("owner_id = ? AND id = ?", userId, id).Updates(updatedRoom).Error
+// DeleteRoom 删除房间及其成员、管理员、置顶和会话状态记录，调用方负责权限检查
+func (dm *DatabaseManager) DeleteRoom(roomID uint) error {
+	memberIDs, err := dm.GetRoomMemberIDs(roomID)
+	if err != nil {
+		return err
+	}
+	err = dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("room_id = ?", roomID).Delete(&models.UserRoom{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM room_admins WHERE room_id = ?", roomID).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("room_id = ?", roomID).Delete(&models.PinnedMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("room_id = ?", roomID).Delete(&models.ConversationState{}).Error; err != nil {
+			return err
+		}
+		result := tx.Delete(&models.Room{}, roomID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRoomNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dm.membershipChanged(roomID, false, memberIDs...)
+	dm.publish(EventRoomDeleted, map[string]interface{}{"roomId": roomID}, memberIDs...)
+	return nil
 }
 
-func (dm *DatabaseManager) CreateRoom(room *models.Room) error {
-	return dm.DB.Model(&models.Room{}).Create(room).Error
+// SetRoomAdmin 设置或取消房间管理员，目标必须是房间成员
+func (dm *DatabaseManager) SetRoomAdmin(roomID, userID uint, isAdmin bool) error {
+	if err := dm.CheckUserRoom(userID, roomID); err != nil {
+		return err
+	}
+
+	room := &models.Room{Model: gorm.Model{ID: roomID}}
+	user := &models.User{Model: gorm.Model{ID: userID}}
+	var err error
+	if isAdmin {
+		err = dm.DB.Model(room).Association("Admins").Append(user)
+	} else {
+		err = dm.DB.Model(room).Association("Admins").Delete(user)
+	}
+	if err != nil {
+		return err
+	}
+	dm.publishToRoom(roomID, EventRoomAdminChanged, map[string]interface{}{"roomId": roomID, "userId": userID, "isAdmin": isAdmin})
+	return nil
 }
 
 func (dm *DatabaseManager) GetAllRooms() ([]models.Room, error) {
@@ -42,3 +133,46 @@ func (dm *DatabaseManager) GetAllRooms() ([]models.Room, error) {
 	err := dm.DB.Preload("Owner").Preload("Members").Find(&rooms).Error
 	return rooms, err
 }
+
+// PinMessage 置顶房间中的消息，消息必须属于该房间
+func (dm *DatabaseManager) PinMessage(roomID uint, msgID string, userID uint) (*models.PinnedMessage, error) {
+	var message models.Message
+	err := dm.DB.Select("id", "room_id").Where("msg_id = ?", msgID).First(&message).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && message.RoomID != roomID) {
+		return nil, errors.New("消息不存在")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := dm.DB.Model(&models.PinnedMessage{}).Where("room_id = ? AND msg_id = ?", roomID, msgID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errors.New("消息已置顶")
+	}
+
+	pinned := &models.PinnedMessage{RoomID: roomID, MsgID: msgID, PinnedBy: userID}
+	if err := dm.DB.Create(pinned).Error; err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
+
+func (dm *DatabaseManager) UnpinMessage(roomID uint, msgID string) error {
+	result := dm.DB.Unscoped().Where("room_id = ? AND msg_id = ?", roomID, msgID).Delete(&models.PinnedMessage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("消息未置顶")
+	}
+	return nil
+}
+
+func (dm *DatabaseManager) GetPinnedMessages(roomID uint) ([]models.PinnedMessage, error) {
+	var pinned []models.PinnedMessage
+	err := dm.DB.Where("room_id = ?", roomID).Order("id DESC").Find(&pinned).Error
+	return pinned, err
+}
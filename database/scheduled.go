@@ -0,0 +1,242 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+// EventScheduledMessageUpdated 定时消息创建、修改、取消、发送或发送失败后推送给作者所有设备的事件
+const EventScheduledMessageUpdated = "scheduledMessageUpdated"
+
+var (
+	ErrScheduledNotFound   = errors.New("定时消息不存在")
+	ErrScheduledNotPending = errors.New("定时消息已发送或已取消")
+	ErrInvalidSendTime     = errors.New("发送时间必须晚于当前时间且在允许的范围内")
+	ErrTooManyScheduled    = errors.New("待发送的定时消息过多")
+	ErrDuplicateMsgID      = errors.New("消息 ID 已存在")
+)
+
+// ScheduledMessageUpdate 修改待发送的定时消息，nil 表示不修改
+type ScheduledMessageUpdate struct {
+	Text          map[string]interface{} `json:"text"`
+	MentionIDList *[]uint                `json:"mentionIdList"`
+	SendAt        *time.Time             `json:"sendAt"`
+}
+
+// CreateScheduledMessage 保存定时消息。创建时按当前的成员和权限校验，发送时还会再次检查；
+// maxDelay 为发送时间最远可以设置在多久之后，maxPending 为每个用户最多待发送的数量
+func (dm *DatabaseManager) CreateScheduledMessage(scheduled *models.ScheduledMessage, maxDelay time.Duration, maxPending int) error {
+	if err := dm.checkScheduledMessage(scheduled, maxDelay); err != nil {
+		return err
+	}
+
+	var pending int64
+	if err := dm.DB.Model(&models.ScheduledMessage{}).Where("user_id = ? AND status = ?", scheduled.UserID, models.ScheduledPending).Count(&pending).Error; err != nil {
+		return err
+	}
+	if pending >= int64(maxPending) {
+		return ErrTooManyScheduled
+	}
+
+	if scheduled.MsgID == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		scheduled.MsgID = hex.EncodeToString(buf)
+	} else {
+		var count int64
+		if err := dm.DB.Model(&models.Message{}).Unscoped().Where("msg_id = ?", scheduled.MsgID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			err := dm.DB.Model(&models.ScheduledMessage{}).Where("msg_id = ?", scheduled.MsgID).Count(&count).Error
+			if err != nil {
+				return err
+			}
+		}
+		if count > 0 {
+			return ErrDuplicateMsgID
+		}
+	}
+
+	scheduled.ID, scheduled.Status, scheduled.Error, scheduled.SentAt = 0, models.ScheduledPending, "", nil
+	if err := dm.DB.Create(scheduled).Error; err != nil {
+		return err
+	}
+	dm.publish(EventScheduledMessageUpdated, scheduled, scheduled.UserID)
+	return nil
+}
+
+// UpdateScheduledMessage 修改待发送定时消息的内容、提及或发送时间
+func (dm *DatabaseManager) UpdateScheduledMessage(userID, id uint, update ScheduledMessageUpdate, maxDelay time.Duration) (*models.ScheduledMessage, error) {
+	scheduled, err := dm.pendingScheduledMessage(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if update.Text != nil {
+		scheduled.Text = update.Text
+	}
+	if update.MentionIDList != nil {
+		scheduled.MentionIDList = *update.MentionIDList
+	}
+	if update.SendAt != nil {
+		scheduled.SendAt = *update.SendAt
+	}
+	if err := dm.checkScheduledMessage(scheduled, maxDelay); err != nil {
+		return nil, err
+	}
+
+	// 只修改仍未被发送任务领取的消息
+	result := dm.DB.Model(scheduled).Where("status = ?", models.ScheduledPending).
+		Select("text", "mention_id_list", "send_at").Updates(scheduled)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrScheduledNotPending
+	}
+	dm.publish(EventScheduledMessageUpdated, scheduled, userID)
+	return scheduled, nil
+}
+
+// CancelScheduledMessage 取消待发送的定时消息
+func (dm *DatabaseManager) CancelScheduledMessage(userID, id uint) (*models.ScheduledMessage, error) {
+	scheduled, err := dm.pendingScheduledMessage(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	result := dm.DB.Model(scheduled).Where("status = ?", models.ScheduledPending).Update("status", models.ScheduledCanceled)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrScheduledNotPending
+	}
+	dm.publish(EventScheduledMessageUpdated, scheduled, userID)
+	return scheduled, nil
+}
+
+// ListScheduledMessages 返回用户尚未发送成功的定时消息（待发送、发送中和发送失败），按发送时间排列
+func (dm *DatabaseManager) ListScheduledMessages(userID uint) ([]models.ScheduledMessage, error) {
+	scheduled := []models.ScheduledMessage{}
+	err := dm.DB.Where("user_id = ? AND status IN ?", userID,
+		[]string{models.ScheduledPending, models.ScheduledSending, models.ScheduledFailed}).
+		Order("send_at ASC, id ASC").Find(&scheduled).Error
+	return scheduled, err
+}
+
+// RequeueScheduledMessages 把上次运行中领取但未完成的定时消息重新排队，服务启动时调用
+func (dm *DatabaseManager) RequeueScheduledMessages() (int64, error) {
+	result := dm.DB.Model(&models.ScheduledMessage{}).Where("status = ?", models.ScheduledSending).
+		Update("status", models.ScheduledPending)
+	return result.RowsAffected, result.Error
+}
+
+// DueScheduledMessages 返回 now 之前到期的待发送定时消息的 ID，最多 limit 条
+func (dm *DatabaseManager) DueScheduledMessages(now time.Time, limit int) ([]uint, error) {
+	var ids []uint
+	err := dm.DB.Model(&models.ScheduledMessage{}).
+		Where("status = ? AND send_at <= ?", models.ScheduledPending, now).
+		Order("send_at ASC, id ASC").Limit(limit).Pluck("id", &ids).Error
+	return ids, err
+}
+
+// ClaimScheduledMessage 领取到期的定时消息准备发送，已被修改为更晚发送、取消或被领取时返回 nil
+func (dm *DatabaseManager) ClaimScheduledMessage(id uint, now time.Time) (*models.ScheduledMessage, error) {
+	result := dm.DB.Model(&models.ScheduledMessage{}).
+		Where("id = ? AND status = ? AND send_at <= ?", id, models.ScheduledPending, now).
+		Update("status", models.ScheduledSending)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	var scheduled models.ScheduledMessage
+	if err := dm.DB.First(&scheduled, id).Error; err != nil {
+		return nil, err
+	}
+	return &scheduled, nil
+}
+
+// FinishScheduledMessage 记录定时消息的发送结果并通知作者，sendErr 为空表示发送成功
+func (dm *DatabaseManager) FinishScheduledMessage(scheduled *models.ScheduledMessage, sendErr error) error {
+	updates := map[string]interface{}{"status": models.ScheduledSent, "error": ""}
+	if sendErr != nil {
+		updates["status"], updates["error"] = models.ScheduledFailed, sendErr.Error()
+	} else {
+		now := time.Now()
+		updates["sent_at"], scheduled.SentAt = now, &now
+	}
+	if err := dm.DB.Model(scheduled).Updates(updates).Error; err != nil {
+		return err
+	}
+	scheduled.Status, scheduled.Error = updates["status"].(string), updates["error"].(string)
+	dm.publish(EventScheduledMessageUpdated, scheduled, scheduled.UserID)
+	return nil
+}
+
+// 定时消息的 MsgID 在创建时预留，只有发送任务以作者身份发送时才能使用
+func (dm *DatabaseManager) checkScheduledMsgID(message *models.Message) error {
+	if message.MsgID == "" {
+		return nil
+	}
+	var count int64
+	err := dm.DB.Model(&models.ScheduledMessage{}).
+		Where("msg_id = ? AND NOT (user_id = ? AND status = ?)", message.MsgID, message.TalkerID, models.ScheduledSending).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicateMsgID
+	}
+	return nil
+}
+
+func (dm *DatabaseManager) pendingScheduledMessage(userID, id uint) (*models.ScheduledMessage, error) {
+	var scheduled models.ScheduledMessage
+	err := dm.DB.Where("id = ? AND user_id = ?", id, userID).First(&scheduled).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrScheduledNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scheduled.Status != models.ScheduledPending {
+		return nil, ErrScheduledNotPending
+	}
+	return &scheduled, nil
+}
+
+// 按发送普通消息的规则检查定时消息：会话、发送权限、引用和话题、提及，并整理提及列表和话题根消息
+func (dm *DatabaseManager) checkScheduledMessage(scheduled *models.ScheduledMessage, maxDelay time.Duration) error {
+	now := time.Now()
+	if !scheduled.SendAt.After(now) || scheduled.SendAt.After(now.Add(maxDelay)) {
+		return ErrInvalidSendTime
+	}
+	if len(scheduled.Text) == 0 {
+		return ErrEmptyMessage
+	}
+	if err := dm.checkConversation(scheduled.UserID, scheduled.ListenerID, scheduled.RoomID); err != nil {
+		return err
+	}
+	if scheduled.RoomID != 0 {
+		if _, err := dm.CheckRoomPermission(scheduled.UserID, scheduled.RoomID, ActionPost); err != nil {
+			return err
+		}
+	}
+
+	message := scheduled.ToMessage()
+	if _, err := dm.checkReplyTargets(message); err != nil {
+		return err
+	}
+	if err := dm.checkMentions(message); err != nil {
+		return err
+	}
+	scheduled.ThreadRootID, scheduled.MentionIDList = message.ThreadRootID, message.MentionIDList
+	return nil
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSessionNotFound     = errors.New("会话不存在")
+	ErrSessionRevoked      = errors.New("会话已失效")
+	ErrRefreshTokenReused  = errors.New("刷新令牌已被使用，会话已撤销")
+	ErrRefreshTokenExpired = errors.New("刷新令牌已过期")
+)
+
+// 刷新令牌只保存哈希值
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (dm *DatabaseManager) CreateSession(userID uint, refreshToken string, expiresAt time.Time, device models.Session) (*models.Session, error) {
+	session := &models.Session{
+		UserID:           userID,
+		RefreshTokenHash: hashToken(refreshToken),
+		ExpiresAt:        expiresAt,
+		DeviceType:       device.DeviceType,
+		IP:               device.IP,
+		UserAgent:        device.UserAgent,
+		LastSeenAt:       time.Now(),
+	}
+	if err := dm.DB.Create(session).Error; err != nil {
+		return nil, fmt.Errorf("创建会话失败: %w", err)
+	}
+	return session, nil
+}
+
+// RotateRefreshToken 用新的刷新令牌替换旧令牌。
+// 如果旧令牌已经被轮换过（重放），说明令牌可能泄露，会撤销整个会话。
+func (dm *DatabaseManager) RotateRefreshToken(oldToken, newToken string, expiresAt time.Time) (*models.Session, error) {
+	oldHash := hashToken(oldToken)
+
+	var session models.Session
+	err := dm.DB.Where("refresh_token_hash = ?", oldHash).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if err := dm.DB.Where("previous_token_hash = ?", oldHash).First(&session).Error; err == nil {
+			if err := dm.RevokeSession(session.ID); err != nil {
+				return nil, err
+			}
+			return &session, ErrRefreshTokenReused
+		}
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if session.RevokedAt != nil {
+		return &session, ErrSessionRevoked
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return &session, ErrRefreshTokenExpired
+	}
+	// 用户已删除或未激活时撤销会话，不再签发新令牌
+	var active int64
+	if err := dm.DB.Model(&models.User{}).Where("id = ? AND status = ?", session.UserID, models.UserStatusActive).Count(&active).Error; err != nil {
+		return nil, err
+	}
+	if active == 0 {
+		if err := dm.RevokeSession(session.ID); err != nil {
+			return nil, err
+		}
+		return &session, ErrSessionRevoked
+	}
+
+	// 以旧哈希为条件更新，防止并发刷新同时成功
+	result := dm.DB.Model(&models.Session{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, oldHash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":  hashToken(newToken),
+			"previous_token_hash": oldHash,
+			"expires_at":          expiresAt,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrRefreshTokenReused
+	}
+
+	session.ExpiresAt = expiresAt
+	return &session, nil
+}
+
+func (dm *DatabaseManager) RevokeSession(sessionID uint) error {
+	return dm.DB.Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeUserSessions 撤销用户的所有会话（可保留一个），返回被撤销的会话 ID
+func (dm *DatabaseManager) RevokeUserSessions(userID, exceptSessionID uint) ([]uint, error) {
+	var sessionIDs []uint
+	err := dm.DB.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, exceptSessionID).
+		Pluck("id", &sessionIDs).Error
+	if err != nil || len(sessionIDs) == 0 {
+		return nil, err
+	}
+
+	err = dm.DB.Model(&models.Session{}).
+		Where("id IN ?", sessionIDs).
+		Update("revoked_at", time.Now()).Error
+	return sessionIDs, err
+}
+
+// IsSessionActive 会话存在、未撤销且未过期时返回 true
+func (dm *DatabaseManager) IsSessionActive(sessionID uint) (bool, error) {
+	var count int64
+	err := dm.DB.Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// TouchSession 更新会话的最后活跃时间，设备信息为空时保持原值
+func (dm *DatabaseManager) TouchSession(sessionID uint, device models.Session) error {
+	updates := map[string]interface{}{"last_seen_at": time.Now()}
+	if device.DeviceType != "" {
+		updates["device_type"] = device.DeviceType
+	}
+	if device.IP != "" {
+		updates["ip"] = device.IP
+	}
+	if device.UserAgent != "" {
+		updates["user_agent"] = device.UserAgent
+	}
+	return dm.DB.Model(&models.Session{}).Where("id = ?", sessionID).Updates(updates).Error
+}
+
+// GetActiveSessions 获取用户所有未撤销且未过期的会话，按最后活跃时间倒序
+func (dm *DatabaseManager) GetActiveSessions(userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := dm.DB.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeUserSession 撤销属于该用户的指定会话
+func (dm *DatabaseManager) RevokeUserSession(userID, sessionID uint) error {
+	result := dm.DB.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+)
+
+func TestDeleteUserRevokesSessions(t *testing.T) {
+	dm := newTestManager(t)
+	alice := createTestUser(t, dm, "alice")
+	bob := createTestUser(t, dm, "bob")
+	expiresAt := time.Now().Add(time.Hour)
+
+	first, err := dm.CreateSession(alice.ID, "alice-1", expiresAt, models.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dm.CreateSession(alice.ID, "alice-2", expiresAt, models.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := dm.CreateSession(bob.ID, "bob-1", expiresAt, models.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := dm.DeleteUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 {
+		t.Fatalf("revoked sessions = %v, want %d and %d", revoked, first.ID, second.ID)
+	}
+	for _, session := range []*models.Session{first, second} {
+		if active, err := dm.IsSessionActive(session.ID); err != nil || active {
+			t.Errorf("session %d active = %v, %v; want false", session.ID, active, err)
+		}
+	}
+	if active, err := dm.IsSessionActive(other.ID); err != nil || !active {
+		t.Errorf("other user's session active = %v, %v; want true", active, err)
+	}
+}
+
+func TestRotateRefreshTokenRequiresActiveUser(t *testing.T) {
+	dm := newTestManager(t)
+	alice := createTestUser(t, dm, "alice")
+	bob := createTestUser(t, dm, "bob")
+	expiresAt := time.Now().Add(time.Hour)
+
+	if _, err := dm.CreateSession(alice.ID, "alice-1", expiresAt, models.Session{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.RotateRefreshToken("alice-1", "alice-2", expiresAt); err != nil {
+		t.Fatalf("active user: %v", err)
+	}
+
+	// 直接软删除，模拟撤销会话之前遗留的会话
+	if err := dm.DB.Delete(&models.User{}, alice.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	session, err := dm.RotateRefreshToken("alice-2", "alice-3", expiresAt)
+	if !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("deleted user: got %v, want %v", err, ErrSessionRevoked)
+	}
+	if active, _ := dm.IsSessionActive(session.ID); active {
+		t.Error("deleted user's session is still active")
+	}
+
+	if _, err := dm.CreateSession(bob.ID, "bob-1", expiresAt, models.Session{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.DB.Model(&models.User{}).Where("id = ?", bob.ID).Update("status", models.UserStatusPending).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.RotateRefreshToken("bob-1", "bob-2", expiresAt); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("pending user: got %v, want %v", err, ErrSessionRevoked)
+	}
+}
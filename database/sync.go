@@ -0,0 +1,186 @@
+package database
+
+import (
+	"github.com/Ireoo/sixin-server/models"
+)
+
+// 同步事件名，事件内容中的 ID 字段均为驼峰命名
+const (
+	EventFriendAdded       = "friendAdded"
+	EventFriendRemoved     = "friendRemoved"
+	EventFriendUpdated     = "friendUpdated"
+	EventRoomUpdated       = "roomUpdated"
+	EventRoomDeleted       = "roomDeleted"
+	EventRoomMemberAdded   = "roomMemberAdded"
+	EventRoomMemberRemoved = "roomMemberRemoved"
+	EventRoomMemberUpdated = "roomMemberUpdated"
+	EventRoomAdminChanged  = "roomAdminChanged"
+)
+
+// 增量同步每次返回的事件数量
+const (
+	DefaultSyncLimit = 200
+	MaxSyncLimit     = 1000
+)
+
+func (dm *DatabaseManager) publish(event string, data interface{}, userIDs ...uint) {
+	if dm.OnUserEvent != nil && len(userIDs) > 0 {
+		dm.OnUserEvent(event, data, userIDs...)
+	}
+}
+
+// 通知房间当前的全部成员，extra 为已经不在房间中但也需要通知的用户
+func (dm *DatabaseManager) publishToRoom(roomID uint, event string, data interface{}, extra ...uint) {
+	memberIDs, err := dm.GetRoomMemberIDs(roomID)
+	if err != nil {
+		return
+	}
+	dm.publish(event, data, append(memberIDs, extra...)...)
+}
+
+// SyncEvent 增量同步中的一个事件
+type SyncEvent struct {
+	Seq   uint64      `json:"seq"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// FriendEntry 全量同步中的好友
+type FriendEntry struct {
+	FriendID  uint         `json:"friendId"`
+	Alias     string       `json:"alias"`
+	IsPrivate bool         `json:"isPrivate"`
+	User      *models.User `json:"user,omitempty"`
+}
+
+// RoomEntry 全量同步中的房间及自己的成员设置
+type RoomEntry struct {
+	Room      *models.Room `json:"room"`
+	Alias     string       `json:"alias"`
+	IsPrivate bool         `json:"isPrivate"`
+	Role      string       `json:"role"`
+}
+
+// SyncSnapshot 需要全量同步时返回的当前状态
+type SyncSnapshot struct {
+	Self          models.User    `json:"self"`
+	Friends       []FriendEntry  `json:"friends"`
+	Rooms         []RoomEntry    `json:"rooms"`
+	Conversations []Conversation `json:"conversations"`
+}
+
+// SyncResult 同步结果。Resync 为 true 表示客户端落后太多（所需事件已被清理）或序号无效，
+// 此时 Snapshot 为当前全量状态，客户端替换本地数据后从 LatestSeq 继续增量同步
+type SyncResult struct {
+	Events    []SyncEvent   `json:"events"`
+	LatestSeq uint64        `json:"latestSeq"`
+	HasMore   bool          `json:"hasMore"`
+	Resync    bool          `json:"resync"`
+	Snapshot  *SyncSnapshot `json:"snapshot,omitempty"`
+}
+
+// Sync 返回序号 since 之后的事件。sessionID 不为 0 时同时确认该设备已收到 since 及之前的事件
+func (dm *DatabaseManager) Sync(userID, sessionID uint, since uint64, limit int) (*SyncResult, error) {
+	if limit <= 0 {
+		limit = DefaultSyncLimit
+	} else if limit > MaxSyncLimit {
+		limit = MaxSyncLimit
+	}
+
+	latest, err := dm.LatestEventSeq(userID)
+	if err != nil {
+		return nil, err
+	}
+	result := &SyncResult{Events: []SyncEvent{}, LatestSeq: latest}
+
+	resync := since > latest
+	if !resync && since < latest {
+		var oldest []uint64
+		if err := dm.DB.Model(&models.UserEvent{}).Where("user_id = ?", userID).
+			Order("seq ASC").Limit(1).Pluck("seq", &oldest).Error; err != nil {
+			return nil, err
+		}
+		resync = len(oldest) == 0 || oldest[0] > since+1
+	}
+	if resync {
+		result.Resync = true
+		if result.Snapshot, err = dm.syncSnapshot(userID); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	events, err := dm.GetUserEventsSince(userID, since, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > limit {
+		events, result.HasMore = events[:limit], true
+	}
+	data, err := dm.EventData(userID, events)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range events {
+		if data[i] != nil {
+			result.Events = append(result.Events, SyncEvent{Seq: e.Seq, Event: e.Event, Data: data[i]})
+		}
+	}
+
+	if sessionID != 0 && since > 0 {
+		if _, err := dm.AckEvents(sessionID, userID, since); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (dm *DatabaseManager) syncSnapshot(userID uint) (*SyncSnapshot, error) {
+	snapshot := &SyncSnapshot{Friends: []FriendEntry{}, Rooms: []RoomEntry{}}
+	var err error
+	if snapshot.Self, err = dm.GetUserInfo(userID); err != nil {
+		return nil, err
+	}
+
+	var friendships []models.UserFriend
+	if err := dm.DB.Preload("Friend").Where("user_id = ?", userID).Find(&friendships).Error; err != nil {
+		return nil, err
+	}
+	for _, friendship := range friendships {
+		snapshot.Friends = append(snapshot.Friends, FriendEntry{
+			FriendID:  friendship.FriendID,
+			Alias:     friendship.Alias,
+			IsPrivate: friendship.IsPrivate,
+			User:      friendship.Friend,
+		})
+	}
+
+	var memberships []models.UserRoom
+	if err := dm.DB.Preload("Room").Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	// 角色与 GetRoomRole 相同，管理员身份一次查询
+	var adminRoomIDs []uint
+	if err := dm.DB.Table("room_admins").Where("user_id = ?", userID).Pluck("room_id", &adminRoomIDs).Error; err != nil {
+		return nil, err
+	}
+	isAdmin := make(map[uint]bool, len(adminRoomIDs))
+	for _, roomID := range adminRoomIDs {
+		isAdmin[roomID] = true
+	}
+	for _, membership := range memberships {
+		if membership.Room == nil {
+			continue
+		}
+		role := memberRole(membership.Role, isAdmin[membership.RoomID])
+		if membership.Room.OwnerID == userID {
+			role = models.RoomRoleOwner
+		}
+		snapshot.Rooms = append(snapshot.Rooms, RoomEntry{Room: membership.Room, Alias: membership.Alias, IsPrivate: membership.IsPrivate, Role: role})
+	}
+
+	if snapshot.Conversations, err = dm.GetConversations(userID); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EventThreadUpdated 话题有新回复时推送给参与者的事件
+const EventThreadUpdated = "threadUpdated"
+
+var ErrInvalidReply = errors.New("引用或回复的消息不属于该会话")
+
+// ThreadUpdate 话题的最新统计和新回复
+type ThreadUpdate struct {
+	RootMsgID   string          `json:"rootMsgId"`
+	RoomID      uint            `json:"roomId"`
+	TalkerID    uint            `json:"talkerId"`
+	ListenerID  uint            `json:"listenerId"`
+	ReplyCount  int             `json:"replyCount"`
+	LastReplyAt time.Time       `json:"lastReplyAt"`
+	Reply       *models.Message `json:"reply"`
+}
+
+// ThreadPage 话题的根消息和一页回复
+type ThreadPage struct {
+	Root *models.Message `json:"root"`
+	*MessageHistory
+}
+
+// 引用和话题根消息必须属于同一会话。回复话题中的回复时归入同一个根消息，话题不嵌套。
+// 返回话题根消息，不是话题回复时返回 nil
+func (dm *DatabaseManager) checkReplyTargets(message *models.Message) (*models.Message, error) {
+	if message.QuoteMsgID == "" && message.ThreadRootID == "" {
+		return nil, nil
+	}
+	find := func(msgID string) (*models.Message, error) {
+		var target models.Message
+		err := dm.conversationMessages(message.TalkerID, message.ListenerID, message.RoomID).
+			Where("messages.msg_id = ?", msgID).First(&target).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidReply
+		}
+		return &target, err
+	}
+
+	if message.QuoteMsgID != "" {
+		if _, err := find(message.QuoteMsgID); err != nil {
+			return nil, err
+		}
+	}
+	if message.ThreadRootID == "" {
+		return nil, nil
+	}
+	root, err := find(message.ThreadRootID)
+	if err != nil {
+		return nil, err
+	}
+	if root.ThreadRootID != "" {
+		if root, err = find(root.ThreadRootID); err != nil {
+			return nil, err
+		}
+		message.ThreadRootID = root.MsgID
+	}
+	return root, nil
+}
+
+// 保存话题回复，更新根消息的回复统计，记录参与者并通知
+func (dm *DatabaseManager) createThreadReply(message, root *models.Message) error {
+	now := time.Now()
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		err := tx.Model(root).UpdateColumns(map[string]interface{}{
+			"thread_reply_count":   gorm.Expr("thread_reply_count + 1"),
+			"thread_last_reply_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		participants := []models.ThreadParticipant{
+			{RootMessageID: root.ID, UserID: root.TalkerID},
+			{RootMessageID: root.ID, UserID: message.TalkerID},
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&participants).Error; err != nil {
+			return err
+		}
+		return tx.First(root, root.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	participantIDs, err := dm.threadParticipants(root)
+	if err != nil {
+		return err
+	}
+	dm.publish(EventThreadUpdated, ThreadUpdate{
+		RootMsgID:   root.MsgID,
+		RoomID:      root.RoomID,
+		TalkerID:    root.TalkerID,
+		ListenerID:  root.ListenerID,
+		ReplyCount:  root.ThreadReplyCount,
+		LastReplyAt: now,
+		Reply:       message,
+	}, participantIDs...)
+	return nil
+}
+
+// 话题参与者，房间话题只包括仍在房间中的成员
+func (dm *DatabaseManager) threadParticipants(root *models.Message) ([]uint, error) {
+	query := dm.DB.Model(&models.ThreadParticipant{}).Where("thread_participants.root_message_id = ?", root.ID)
+	if root.RoomID != 0 {
+		query = query.Joins("JOIN user_rooms ON user_rooms.user_id = thread_participants.user_id AND user_rooms.room_id = ? AND user_rooms.deleted_at IS NULL", root.RoomID)
+	}
+	var userIDs []uint
+	err := query.Pluck("thread_participants.user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// GetThread 按游标分页获取话题回复，query 中只使用 UserID 和分页参数
+func (dm *DatabaseManager) GetThread(rootMsgID string, query HistoryQuery) (*ThreadPage, error) {
+	root, err := dm.findMessage(rootMsgID)
+	if err != nil {
+		return nil, err
+	}
+	if err := dm.checkMessageAccess(query.UserID, root); err != nil {
+		return nil, err
+	}
+
+	history, err := dm.pageHistory(func() *gorm.DB {
+		return dm.DB.Model(&models.Message{}).Where("messages.thread_root_id = ?", root.MsgID)
+	}, query)
+	if err != nil {
+		return nil, err
+	}
+	roots := []models.Message{*root}
+	if err := dm.AttachReactions(query.UserID, roots); err != nil {
+		return nil, err
+	}
+	return &ThreadPage{Root: &roots[0], MessageHistory: history}, nil
+}
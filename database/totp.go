@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrTOTPCodeReused = errors.New("验证码已被使用")
+
+// SetTOTPSecret 保存待确认的 TOTP 密钥，确认前不会生效
+func (dm *DatabaseManager) SetTOTPSecret(userID uint, secret string) error {
+	return dm.DB.Model(&models.User{}).Where("id = ? AND totp_enabled = ?", userID, false).
+		Update("totp_secret", secret).Error
+}
+
+// EnableTOTP 启用两步验证并保存恢复码哈希，step 为确认时使用的验证码时间步
+func (dm *DatabaseManager) EnableTOTP(userID uint, step int64, recoveryCodes []string) error {
+	result := dm.DB.Model(&models.User{}).Where("id = ? AND totp_enabled = ?", userID, false).
+		Select("totp_enabled", "totp_last_step", "recovery_codes").
+		Updates(&models.User{
+			TOTPEnabled:   true,
+			TOTPLastStep:  step,
+			RecoveryCodes: hashRecoveryCodes(recoveryCodes),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("两步验证已启用")
+	}
+	return nil
+}
+
+// DisableTOTP 关闭两步验证并清除密钥和恢复码
+func (dm *DatabaseManager) DisableTOTP(userID uint) error {
+	return dm.DB.Model(&models.User{}).Where("id = ?", userID).
+		Select("totp_enabled", "totp_secret", "totp_last_step", "recovery_codes").
+		Updates(&models.User{RecoveryCodes: []string{}}).Error
+}
+
+// ReplaceRecoveryCodes 用新的恢复码替换全部旧恢复码
+func (dm *DatabaseManager) ReplaceRecoveryCodes(userID uint, recoveryCodes []string) error {
+	return dm.DB.Model(&models.User{}).Where("id = ? AND totp_enabled = ?", userID, true).
+		Select("recovery_codes").
+		Updates(&models.User{RecoveryCodes: hashRecoveryCodes(recoveryCodes)}).Error
+}
+
+// UseTOTPStep 记录已使用的验证码时间步，同一时间步或更早的验证码不能再次使用
+func (dm *DatabaseManager) UseTOTPStep(userID uint, step int64) error {
+	result := dm.DB.Model(&models.User{}).Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+// ConsumeRecoveryCode 校验并作废一个恢复码，返回剩余数量
+func (dm *DatabaseManager) ConsumeRecoveryCode(userID uint, code string) (int, error) {
+	remaining := 0
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		// 加行锁，防止同一个恢复码被并发使用两次
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "recovery_codes").First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		codeHash := hashToken(normalizeRecoveryCode(code))
+		for i, stored := range user.RecoveryCodes {
+			if stored != codeHash {
+				continue
+			}
+			codes := append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			if err := tx.Model(&user).Select("recovery_codes").Updates(&models.User{RecoveryCodes: codes}).Error; err != nil {
+				return err
+			}
+			remaining = len(codes)
+			return nil
+		}
+		return ErrVerificationInvalid
+	})
+	return remaining, err
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return hashes
+}
+
+// 恢复码忽略大小写和分隔符，方便用户输入
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
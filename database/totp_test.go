@@ -0,0 +1,100 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Ireoo/sixin-server/internal/totp"
+	"github.com/Ireoo/sixin-server/models"
+)
+
+func enableTestTOTP(t *testing.T, dm *DatabaseManager, userID uint, step int64, codes []string) {
+	t.Helper()
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.SetTOTPSecret(userID, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.EnableTOTP(userID, step, codes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUseTOTPStepRejectsReplay(t *testing.T) {
+	dm := newTestManager(t)
+	user := createTestUser(t, dm, "alice")
+	step := totp.Step(time.Now())
+	// 启用时确认用的验证码同样不能再次使用
+	enableTestTOTP(t, dm, user.ID, step, nil)
+
+	tests := []struct {
+		name    string
+		step    int64
+		wantErr error
+	}{
+		{"confirmation step", step, ErrTOTPCodeReused},
+		{"earlier step", step - 1, ErrTOTPCodeReused},
+		{"next step", step + 1, nil},
+		{"same step again", step + 1, ErrTOTPCodeReused},
+		{"skipped ahead", step + 3, nil},
+		{"older than last used", step + 2, ErrTOTPCodeReused},
+	}
+	for _, tt := range tests {
+		if err := dm.UseTOTPStep(user.ID, tt.step); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	var stored models.User
+	if err := dm.DB.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.TOTPLastStep != step+3 {
+		t.Errorf("TOTPLastStep = %d, want %d", stored.TOTPLastStep, step+3)
+	}
+}
+
+func TestConsumeRecoveryCode(t *testing.T) {
+	dm := newTestManager(t)
+	user := createTestUser(t, dm, "alice")
+	enableTestTOTP(t, dm, user.ID, 1, []string{"abcde-fghij", "klmno-pqrst", "uvwxy-z2345"})
+
+	tests := []struct {
+		name          string
+		code          string
+		wantRemaining int
+		wantErr       error
+	}{
+		{"valid code", "abcde-fghij", 2, nil},
+		{"reused code", "abcde-fghij", 0, ErrVerificationInvalid},
+		{"case and separators ignored", " KLMNO PQRST ", 1, nil},
+		{"reused after normalization", "klmnopqrst", 0, ErrVerificationInvalid},
+		{"unknown code", "zzzzz-zzzzz", 0, ErrVerificationInvalid},
+		{"last code", "uvwxy-z2345", 0, nil},
+	}
+	for _, tt := range tests {
+		remaining, err := dm.ConsumeRecoveryCode(user.ID, tt.code)
+		if !errors.Is(err, tt.wantErr) || remaining != tt.wantRemaining {
+			t.Errorf("%s: got %d, %v; want %d, %v", tt.name, remaining, err, tt.wantRemaining, tt.wantErr)
+		}
+	}
+}
+
+func TestReplaceRecoveryCodesInvalidatesOldCodes(t *testing.T) {
+	dm := newTestManager(t)
+	user := createTestUser(t, dm, "alice")
+	enableTestTOTP(t, dm, user.ID, 1, []string{"abcde-fghij"})
+
+	if err := dm.ReplaceRecoveryCodes(user.ID, []string{"klmno-pqrst"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.ConsumeRecoveryCode(user.ID, "abcde-fghij"); !errors.Is(err, ErrVerificationInvalid) {
+		t.Errorf("old code: got %v, want %v", err, ErrVerificationInvalid)
+	}
+	if remaining, err := dm.ConsumeRecoveryCode(user.ID, "klmno-pqrst"); err != nil || remaining != 0 {
+		t.Errorf("new code: got %d, %v; want 0, nil", remaining, err)
+	}
+}
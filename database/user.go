@@ -2,6 +2,7 @@ package database
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Ireoo/sixin-server/models"
 	"golang.org/x/crypto/bcrypt"
@@ -65,6 +66,14 @@ func (dm *DatabaseManager) UpdateUserOwn(userId uint, updatedUser *models.User)
 	updatedUser.ID = userId
 	updatedUser.Password = ""  // 不允许通过此方法更新密码
 	updatedUser.SecretKey = "" // 不允许更新密钥
+	updatedUser.Status = ""    // 不允许绕过邮箱验证
+	updatedUser.Email = ""     // 修改邮箱需要验证新邮箱，见 ChangeEmail
+	updatedUser.EmailVerifiedAt = nil
+	updatedUser.IsAdmin = false
+	updatedUser.TOTPSecret = "" // 两步验证只能通过专用接口修改
+	updatedUser.TOTPEnabled = false
+	updatedUser.TOTPLastStep = 0
+	updatedUser.RecoveryCodes = nil
 
 	// 根据userId修改用户自己的信息updatedUser
 	result := dm.DB.Model(existingUser).Updates(updatedUser)
@@ -77,8 +86,31 @@ func (dm *DatabaseManager) UpdateUserOwn(userId uint, updatedUser *models.User)
 	return nil
 }
 
-func (dm *DatabaseManager) DeleteUser(id uint) error {
-	return dm.DB.Delete(&models.User{}, id).Error
+// UpdateUserPassword 哈希并保存新密码
+func (dm *DatabaseManager) UpdateUserPassword(userID uint, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("无法哈希密码: %v", err)
+	}
+	return dm.DB.Model(&models.User{}).Where("id = ?", userID).Update("password", string(hashedPassword)).Error
+}
+
+// DeleteUser 删除用户并撤销其所有会话，返回被撤销的会话 ID，调用方负责断开对应的连接
+func (dm *DatabaseManager) DeleteUser(id uint) ([]uint, error) {
+	var sessionIDs []uint
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&models.User{}, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", id).Pluck("id", &sessionIDs).Error; err != nil {
+			return err
+		}
+		if len(sessionIDs) == 0 {
+			return nil
+		}
+		return tx.Model(&models.Session{}).Where("id IN ?", sessionIDs).Update("revoked_at", time.Now()).Error
+	})
+	return sessionIDs, err
 }
 
 func (dm *DatabaseManager) CreateUser(user *models.User) error {
@@ -10,11 +10,15 @@ func (dm *DatabaseManager) AddFriend(userID, friendID uint, alias string, isPriv
 		Alias:     alias,
 		IsPrivate: isPrivate,
 	}
-	return dm.DB.Create(&userFriend).Error
+	if err := dm.DB.Create(&userFriend).Error; err != nil {
+		return err
+	}
+	dm.publish(EventFriendAdded, map[string]interface{}{"friendId": friendID, "alias": alias, "isPrivate": isPrivate}, userID)
+	return nil
 }
 
 func (dm *DatabaseManager) RemoveFriend(userID, friendID uint) error {
-	return dm.DB.Where("user_id = ? AND friend_id = ?", userID, friendID).Delete(&models.UserFriend{}).Error
+	return dm.DeleteUserFriend(userID, friendID)
 }
 
 func (dm *DatabaseManager) GetFriends(userID uint) ([]models.User, error) {
@@ -26,19 +30,36 @@ func (dm *DatabaseManager) GetFriends(userID uint) ([]models.User, error) {
 }
 
 func (dm *DatabaseManager) UpdateFriendAlias(userID, friendID uint, newAlias string) error {
-	return dm.DB.Model(&models.UserFriend{}).
+	err := dm.DB.Model(&models.UserFriend{}).
 		Where("user_id = ? AND friend_id = ?", userID, friendID).
 		Update("alias", newAlias).Error
+	if err != nil {
+		return err
+	}
+	dm.publish(EventFriendUpdated, map[string]interface{}{"friendId": friendID, "alias": newAlias}, userID)
+	return nil
 }
 
 func (dm *DatabaseManager) SetFriendPrivacy(userID, friendID uint, isPrivate bool) error {
-	return dm.DB.Model(&models.UserFriend{}).
+	err := dm.DB.Model(&models.UserFriend{}).
 		Where("user_id = ? AND friend_id = ?", userID, friendID).
 		Update("is_private", isPrivate).Error
+	if err != nil {
+		return err
+	}
+	dm.publish(EventFriendUpdated, map[string]interface{}{"friendId": friendID, "isPrivate": isPrivate}, userID)
+	return nil
 }
 
 func (dm *DatabaseManager) DeleteUserFriend(userID, friendID uint) error {
-	return dm.DB.Where("user_id = ? AND friend_id = ?", userID, friendID).Delete(&models.UserFriend{}).Error
+	result := dm.DB.Where("user_id = ? AND friend_id = ?", userID, friendID).Delete(&models.UserFriend{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		dm.publish(EventFriendRemoved, map[string]interface{}{"friendId": friendID}, userID)
+	}
+	return nil
 }
 
 func (dm *DatabaseManager) UpdateUser(userId, id uint, updatedUser models.UserFriend) error {
@@ -57,6 +78,9 @@ func (dm *DatabaseManager) UpdateUser(userId, id uint, updatedUser models.UserFr
 			if err != nil {
 				return err
 			}
+			dm.publish(EventFriendUpdated, map[string]interface{}{
+				"friendId": updatedUser.FriendID, "alias": userFriend.Alias, "isPrivate": userFriend.IsPrivate,
+			}, userId)
 		}
 	}
 
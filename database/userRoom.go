@@ -1,7 +1,11 @@
 package database
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
@@ -18,22 +22,28 @@ func (dm *DatabaseManager) JoinRoom(userID uint, roomID uint, alias string) erro
 }
 
 func (dm *DatabaseManager) CheckUserRoom(userID, roomID uint) error {
-	var userRoom models.UserRoom
+	var count int64
 	if err := dm.DB.Model(&models.UserRoom{}).
-		Where("user_id = ? AND id = ?", userID, roomID).
-		First(&userRoom).Error; err != nil {
+		Where("user_id = ? AND room_id = ?", userID, roomID).
+		Count(&count).Error; err != nil {
 		return err
 	}
+	if count == 0 {
+		return ErrNotRoomMember
+	}
 	return nil
 }
 
+// GetRoomAliasByUsers 获取房间内所有成员的别名，只有房间成员可以查看
 func (dm *DatabaseManager) GetRoomAliasByUsers(userID, roomID uint) (map[uint]string, error) {
+	if err := dm.CheckUserRoom(userID, roomID); err != nil {
+		return nil, err
+	}
+
 	var userRooms []models.UserRoom
 	aliases := make(map[uint]string)
-
-	// 修正查询条件并添加 roomID 过滤
 	if err := dm.DB.Model(&models.UserRoom{}).
-		Where("user_id = ? AND id = ?", userID, roomID).
+		Where("room_id = ?", roomID).
 		Find(&userRooms).Error; err != nil {
 		return nil, err
 	}
@@ -45,79 +55,108 @@ func (dm *DatabaseManager) GetRoomAliasByUsers(userID, roomID uint) (map[uint]st
 	return aliases, nil
 }
 
+// 更新成员自己的房间设置，不是成员时返回 ErrNotRoomMember，不会隐式加入房间
+func (dm *DatabaseManager) updateMembership(userID, roomID uint, updates map[string]interface{}) error {
+	result := dm.DB.Model(&models.UserRoom{}).Where("user_id = ? AND room_id = ?", userID, roomID).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotRoomMember
+	}
+
+	// 别名和私密设置只属于成员自己，只通知本人
+	event := map[string]interface{}{"roomId": roomID, "userId": userID}
+	if alias, ok := updates["alias"]; ok {
+		event["alias"] = alias
+	}
+	if isPrivate, ok := updates["is_private"]; ok {
+		event["isPrivate"] = isPrivate
+	}
+	dm.publish(EventRoomMemberUpdated, event, userID)
+	return nil
+}
+
 func (dm *DatabaseManager) SetRoomMemberPrivacy(userID, roomID uint, isPrivate bool) error {
-	return dm.DB.Model(&models.UserRoom{}).Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "user_id"}, {Name: "room_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"is_private"}),
-	}).Create(&models.UserRoom{
-		UserID:    userID,
-		RoomID:    roomID,
-		IsPrivate: isPrivate,
-	}).Error
+	return dm.updateMembership(userID, roomID, map[string]interface{}{"is_private": isPrivate})
 }
 
 func (dm *DatabaseManager) UpdateRoomAlias(userID, roomID uint, newAlias string) error {
-	return dm.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "user_id"}, {Name: "room_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"alias"}),
-	}).Create(&models.UserRoom{
-		UserID: userID,
-		RoomID: roomID,
-		Alias:  newAlias,
-	}).Error
+	return dm.updateMembership(userID, roomID, map[string]interface{}{"alias": newAlias})
 }
 
 func (dm *DatabaseManager) SetRoomPrivacy(userID, roomID uint, isPrivate bool) error {
-	return dm.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "user_id"}, {Name: "room_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"is_private"}),
-	}).Create(&models.UserRoom{
-		UserID:    userID,
-		RoomID:    roomID,
-		IsPrivate: isPrivate,
-	}).Error
+	return dm.updateMembership(userID, roomID, map[string]interface{}{"is_private": isPrivate})
 }
 
 func (dm *DatabaseManager) UpdateRoomMemberAlias(userID, roomID uint, alias string) error {
-	return dm.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "user_id"}, {Name: "room_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"alias"}),
-	}).Create(&models.UserRoom{
-		UserID: userID,
-		RoomID: roomID,
-		Alias:  alias,
-	}).Error
+	return dm.updateMembership(userID, roomID, map[string]interface{}{"alias": alias})
 }
 
-func (dm *DatabaseManager) AddUserToRoom(userID, roomID uint, alias string, isPrivate bool) error {
+var ErrAlreadyRoomMember = errors.New("已经是房间成员")
+
+// AddUserToRoom 添加房间成员，role 为空时为普通成员，调用方负责邀请权限检查
+func (dm *DatabaseManager) AddUserToRoom(userID, roomID uint, alias string, isPrivate bool, role string) error {
+	if role == "" {
+		role = models.RoomRoleMember
+	}
+	if role != models.RoomRoleMember && role != models.RoomRoleGuest {
+		return fmt.Errorf("无效的成员角色: %s", role)
+	}
+	if err := dm.CheckUserRoom(userID, roomID); err == nil {
+		return ErrAlreadyRoomMember
+	} else if !errors.Is(err, ErrNotRoomMember) {
+		return err
+	}
+
 	userRoom := models.UserRoom{
 		UserID:    userID,
 		RoomID:    roomID,
 		Alias:     alias,
 		IsPrivate: isPrivate,
+		Role:      role,
 	}
-	return dm.DB.Create(&userRoom).Error
-}
+	if err := dm.DB.Create(&userRoom).Error; err != nil {
+		return err
+	}
+	dm.membershipChanged(roomID, true, userID)
 
-func (dm *DatabaseManager) RemoveUserFromRoom(userID, roomID uint) error {
-	return dm.DB.Model(&models.UserRoom{}).Where("user_id = ? AND room_id = ?", userID, roomID).Delete(&models.UserRoom{}).Error
+	event := map[string]interface{}{"roomId": roomID, "userId": userID, "role": role}
+	var room models.Room
+	if err := dm.DB.First(&room, roomID).Error; err == nil {
+		event["room"] = room
+	}
+	dm.publishToRoom(roomID, EventRoomMemberAdded, event)
+	return nil
 }
 
-func (dm *DatabaseManager) DeleteRoom(userId, id uint) error {
-	// 根据userid获取用户房间id信息,然后删除用户这个房间信息
-	var userRooms []models.UserRoom
-	err := dm.DB.Model(&models.UserRoom{}).Where("user_id = ?", userId).Find(&userRooms).Error
+// RemoveUserFromRoom 移除房间成员，同时取消其管理员身份
+func (dm *DatabaseManager) RemoveUserFromRoom(userID, roomID uint) error {
+	err := dm.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("user_id = ? AND room_id = ?", userID, roomID).Delete(&models.UserRoom{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotRoomMember
+		}
+		return tx.Exec("DELETE FROM room_admins WHERE room_id = ? AND user_id = ?", roomID, userID).Error
+	})
 	if err != nil {
 		return err
 	}
-	for _, userRoom := range userRooms {
-		if userRoom.RoomID == id {
-			return dm.DB.Delete(&models.UserRoom{}, userRoom.ID).Error
-		}
-	}
+	dm.membershipChanged(roomID, false, userID)
+	dm.publishToRoom(roomID, EventRoomMemberRemoved, map[string]interface{}{"roomId": roomID, "userId": userID}, userID)
 	return nil
 }
 
+// GetUserRoomIDs 获取用户所在的全部房间 ID
+func (dm *DatabaseManager) GetUserRoomIDs(userID uint) ([]uint, error) {
+	var roomIDs []uint
+	err := dm.DB.Model(&models.UserRoom{}).Where("user_id = ?", userID).Pluck("room_id", &roomIDs).Error
+	return roomIDs, err
+}
+
 func (dm *DatabaseManager) UpdateRoom(userId, id uint, updatedRoom models.UserRoom) error {
 	// 根据userid获取用户房间id信息,然后修改用户这个房间信息
 	var userRooms []models.UserRoom
@@ -141,16 +180,14 @@ func (dm *DatabaseManager) UpdateRoom(userId, id uint, updatedRoom models.UserRo
 }
 
 func (dm *DatabaseManager) GetRoomByID(userId, id uint) (models.Room, error) {
-	// 获取userid
-	var userRooms []models.UserRoom
-	err := dm.DB.Model(&models.UserRoom{}).Where("user_id = ? AND room_id = ?", userId, id).Find(&userRooms).Error
-	if err != nil {
+	// 只有房间成员可以查看房间信息
+	if err := dm.CheckUserRoom(userId, id); err != nil {
 		return models.Room{}, err
 	}
 
 	// 获取room信息
 	var room models.Room
-	err = dm.DB.Model(&models.Room{}).Where("id = ?", id).First(&room).Error
+	err := dm.DB.Model(&models.Room{}).Where("id = ?", id).First(&room).Error
 	if err != nil {
 		return models.Room{}, err
 	}
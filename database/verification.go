@@ -0,0 +1,142 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Ireoo/sixin-server/models"
+	"gorm.io/gorm"
+)
+
+// 验证码允许的最大错误次数，超过后该验证码作废
+const maxVerificationAttempts = 5
+
+var (
+	ErrVerificationInvalid = errors.New("验证码无效或已过期")
+)
+
+var ErrEmailTaken = errors.New("邮箱已被使用")
+
+// CreateVerificationToken 创建新的验证令牌，并使该用户同用途的旧令牌失效
+func (dm *DatabaseManager) CreateVerificationToken(userID uint, purpose, token, code string, expiresAt time.Time) error {
+	return dm.createVerificationToken(userID, purpose, "", token, code, expiresAt)
+}
+
+// CreateEmailChangeToken 创建修改邮箱的验证令牌，验证通过后 email 才会生效
+func (dm *DatabaseManager) CreateEmailChangeToken(userID uint, email, token, code string, expiresAt time.Time) error {
+	return dm.createVerificationToken(userID, models.TokenPurposeEmailChange, email, token, code, expiresAt)
+}
+
+func (dm *DatabaseManager) createVerificationToken(userID uint, purpose, email, token, code string, expiresAt time.Time) error {
+	return dm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.VerificationToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("expires_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		verification := &models.VerificationToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			Email:     email,
+			TokenHash: hashToken(token),
+			ExpiresAt: expiresAt,
+		}
+		if code != "" {
+			verification.CodeHash = hashToken(fmt.Sprintf("%d:%s", userID, code))
+		}
+		return tx.Create(verification).Error
+	})
+}
+
+// ConsumeVerificationToken 校验链接中的令牌，成功后标记为已使用
+func (dm *DatabaseManager) ConsumeVerificationToken(purpose, token string) (*models.VerificationToken, error) {
+	var verification models.VerificationToken
+	err := dm.DB.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), purpose, time.Now()).
+		First(&verification).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVerificationInvalid
+		}
+		return nil, err
+	}
+	return &verification, dm.markVerificationUsed(verification.ID)
+}
+
+// ConsumeVerificationCode 校验用户输入的验证码，错误次数过多时验证码作废
+func (dm *DatabaseManager) ConsumeVerificationCode(userID uint, purpose, code string) (*models.VerificationToken, error) {
+	var verification models.VerificationToken
+	err := dm.DB.Where("user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ? AND code_hash <> ''", userID, purpose, time.Now()).
+		Order("id DESC").First(&verification).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVerificationInvalid
+		}
+		return nil, err
+	}
+
+	if verification.Attempts >= maxVerificationAttempts || verification.CodeHash != hashToken(fmt.Sprintf("%d:%s", userID, code)) {
+		dm.DB.Model(&models.VerificationToken{}).Where("id = ?", verification.ID).
+			Update("attempts", gorm.Expr("attempts + 1"))
+		return nil, ErrVerificationInvalid
+	}
+	return &verification, dm.markVerificationUsed(verification.ID)
+}
+
+func (dm *DatabaseManager) markVerificationUsed(id uint) error {
+	result := dm.DB.Model(&models.VerificationToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		// 并发请求已经使用了该令牌
+		return ErrVerificationInvalid
+	}
+	return nil
+}
+
+// GetVerificationSendStats 返回指定时间之后发送的令牌数量和最近一次发送时间，用于限制重发频率
+func (dm *DatabaseManager) GetVerificationSendStats(userID uint, purpose string, since time.Time) (int64, time.Time, error) {
+	var count int64
+	if err := dm.DB.Model(&models.VerificationToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, since).
+		Count(&count).Error; err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var latest models.VerificationToken
+	err := dm.DB.Where("user_id = ? AND purpose = ?", userID, purpose).Order("id DESC").First(&latest).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, time.Time{}, err
+	}
+	return count, latest.CreatedAt, nil
+}
+
+// ActivateUser 标记邮箱已验证并激活账号
+func (dm *DatabaseManager) ActivateUser(userID uint) error {
+	now := time.Now()
+	return dm.DB.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"status":            models.UserStatusActive,
+		"email_verified_at": &now,
+	}).Error
+}
+
+// ChangeEmail 将用户邮箱改为已验证的新邮箱，新邮箱已被其他用户使用时返回 ErrEmailTaken
+func (dm *DatabaseManager) ChangeEmail(userID uint, email string) error {
+	return dm.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.User{}).Where("email = ? AND id <> ?", email, userID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrEmailTaken
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"email":             email,
+			"email_verified_at": time.Now(),
+		}).Error
+	})
+}
@@ -0,0 +1,474 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/models"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	// 两次发送验证邮件的最短间隔
+	verificationResendInterval = time.Minute
+	// 每小时最多发送的验证邮件数量
+	verificationHourlyLimit = 5
+	passwordResetTTL        = time.Hour
+	minPasswordLength       = 8
+)
+
+// 生成验证令牌和验证码并发送验证邮件
+func (hm *HTTPManager) sendVerificationEmail(user *models.User) error {
+	token, err := middleware.GenerateRefreshToken()
+	if err != nil {
+		return err
+	}
+	code := hm.baseInstance.GenerateVerificationCode()
+
+	if err := hm.dbManager.CreateVerificationToken(user.ID, models.TokenPurposeEmailVerify, token, code, time.Now().Add(emailVerificationTTL)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/api/verify-email?token=%s", hm.baseInstance.Cfg.PublicURL, url.QueryEscape(token))
+	body := fmt.Sprintf(`<p>%s，您好：</p>
+<p>您的邮箱验证码为 <b>%s</b>，%d 小时内有效。</p>
+<p>也可以点击以下链接完成验证：<a href="%s">%s</a></p>`,
+		html.EscapeString(user.Username), code, int(emailVerificationTTL.Hours()), link, link)
+
+	return hm.baseInstance.SendEmail(user.Email, "邮箱验证", body)
+}
+
+// 支持链接中的 token（GET/POST），或邮箱加验证码（POST）
+func (hm *HTTPManager) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var verifyData struct {
+		Token string `json:"token"`
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+	if r.Method == http.MethodGet {
+		verifyData.Token = r.URL.Query().Get("token")
+	} else if err := json.NewDecoder(r.Body).Decode(&verifyData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+
+	var verification *models.VerificationToken
+	var err error
+	switch {
+	case verifyData.Token != "":
+		verification, err = hm.dbManager.ConsumeVerificationToken(models.TokenPurposeEmailVerify, verifyData.Token)
+	case verifyData.Email != "" && verifyData.Code != "":
+		user, lookupErr := hm.dbManager.GetUserByEmail(verifyData.Email)
+		if lookupErr != nil || user == nil {
+			err = database.ErrVerificationInvalid
+			break
+		}
+		verification, err = hm.dbManager.ConsumeVerificationCode(user.ID, models.TokenPurposeEmailVerify, verifyData.Code)
+	default:
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("缺少验证令牌或验证码"))
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, database.ErrVerificationInvalid) {
+			status = http.StatusBadRequest
+		}
+		sendJSONResponse(w, status, nil, err)
+		return
+	}
+
+	if err := hm.dbManager.ActivateUser(verification.UserID); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("激活账号失败: %v", err))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "邮箱验证成功"}, nil)
+}
+
+func (hm *HTTPManager) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	var resendData struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resendData); err != nil || resendData.Email == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+
+	// 无论邮箱是否存在都返回相同结果，避免泄露注册信息
+	response := map[string]string{"message": "如果该邮箱存在且未验证，验证邮件已发送"}
+
+	user, err := hm.dbManager.GetUserByEmail(resendData.Email)
+	if err != nil || user == nil || user.Status != models.UserStatusPending {
+		sendJSONResponse(w, http.StatusOK, response, nil)
+		return
+	}
+
+	count, lastSentAt, err := hm.dbManager.GetVerificationSendStats(user.ID, models.TokenPurposeEmailVerify, time.Now().Add(-time.Hour))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if wait := time.Until(lastSentAt.Add(verificationResendInterval)); wait > 0 {
+		sendRetryAfter(w, wait)
+		return
+	}
+	if count >= verificationHourlyLimit {
+		sendRetryAfter(w, time.Hour)
+		return
+	}
+
+	if err := hm.sendVerificationEmail(user); err != nil {
+		log.Printf("发送验证邮件给用户 %d 失败: %v", user.ID, err)
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("发送验证邮件失败"))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, response, nil)
+}
+
+// 返回 429 并设置 Retry-After 头
+func sendRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Seconds() + 0.999)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendJSONResponse(w, http.StatusTooManyRequests, map[string]int{"retry_after": seconds}, fmt.Errorf("请求过于频繁，请 %d 秒后再试", seconds))
+}
+
+// 发送密码重置邮件，令牌一次有效
+func (hm *HTTPManager) sendPasswordResetEmail(user *models.User) error {
+	token, err := middleware.GenerateRefreshToken()
+	if err != nil {
+		return err
+	}
+
+	if err := hm.dbManager.CreateVerificationToken(user.ID, models.TokenPurposePasswordReset, token, "", time.Now().Add(passwordResetTTL)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", hm.baseInstance.Cfg.PublicURL, url.QueryEscape(token))
+	body := fmt.Sprintf(`<p>%s，您好：</p>
+<p>我们收到了重置密码的请求，请在 %d 分钟内点击以下链接设置新密码：<a href="%s">%s</a></p>
+<p>重置令牌：<code>%s</code></p>
+<p>如果不是您本人操作，请忽略此邮件。</p>`,
+		html.EscapeString(user.Username), int(passwordResetTTL.Minutes()), link, link, token)
+
+	return hm.baseInstance.SendEmail(user.Email, "重置密码", body)
+}
+
+func (hm *HTTPManager) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var forgotData struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&forgotData); err != nil || forgotData.Email == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+
+	// 无论邮箱是否存在都返回相同结果，避免泄露注册信息
+	response := map[string]string{"message": "如果该邮箱已注册，重置邮件已发送"}
+
+	user, err := hm.dbManager.GetUserByEmail(forgotData.Email)
+	if err != nil || user == nil {
+		sendJSONResponse(w, http.StatusOK, response, nil)
+		return
+	}
+
+	count, lastSentAt, err := hm.dbManager.GetVerificationSendStats(user.ID, models.TokenPurposePasswordReset, time.Now().Add(-time.Hour))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if wait := time.Until(lastSentAt.Add(verificationResendInterval)); wait > 0 {
+		sendRetryAfter(w, wait)
+		return
+	}
+	if count >= verificationHourlyLimit {
+		sendRetryAfter(w, time.Hour)
+		return
+	}
+
+	if err := hm.sendPasswordResetEmail(user); err != nil {
+		log.Printf("发送重置密码邮件给用户 %d 失败: %v", user.ID, err)
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("发送重置邮件失败"))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, response, nil)
+}
+
+func (hm *HTTPManager) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var resetData struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resetData); err != nil || resetData.Token == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+	if err := validatePassword(resetData.Password); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	verification, err := hm.dbManager.ConsumeVerificationToken(models.TokenPurposePasswordReset, resetData.Token)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, database.ErrVerificationInvalid) {
+			status = http.StatusBadRequest
+		}
+		sendJSONResponse(w, status, nil, err)
+		return
+	}
+
+	if err := hm.dbManager.UpdateUserPassword(verification.UserID, resetData.Password); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	// 能收到重置邮件说明邮箱有效，未验证的账号一并激活
+	user, err := hm.dbManager.GetUserInfo(verification.UserID)
+	if err == nil && user.Status == models.UserStatusPending {
+		if err := hm.dbManager.ActivateUser(user.ID); err != nil {
+			log.Printf("激活用户 %d 失败: %v", user.ID, err)
+		}
+	}
+
+	// 重置密码后所有会话都需要重新登录
+	hm.revokeOtherSessions(verification.UserID, 0)
+	ac := auditContext(r)
+	ac.ActorID = verification.UserID
+	hm.dbManager.Audit(ac, models.AuditLog{Action: models.AuditPasswordReset, TargetType: models.AuditTargetUser, TargetID: verification.UserID}, nil, nil)
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "密码已重置，请重新登录"}, nil)
+}
+
+func (hm *HTTPManager) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	sessionID, err := middleware.GetSessionIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var changeData struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&changeData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+	if err := validatePassword(changeData.NewPassword); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	user, err := hm.dbManager.GetUserInfo(userID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if _, err := hm.dbManager.AuthenticateUser(user.Username, changeData.CurrentPassword); err != nil {
+		sendJSONResponse(w, http.StatusForbidden, nil, fmt.Errorf("当前密码不正确"))
+		return
+	}
+
+	if err := hm.dbManager.UpdateUserPassword(userID, changeData.NewPassword); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	// 保留当前会话，其他设备需要重新登录
+	hm.revokeOtherSessions(userID, sessionID)
+	hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditPasswordChange, TargetType: models.AuditTargetUser, TargetID: userID}, nil, nil)
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "密码修改成功"}, nil)
+}
+
+// 发送修改邮箱的验证邮件到新邮箱，验证通过前邮箱保持不变
+func (hm *HTTPManager) sendEmailChangeEmail(user *models.User, email string) error {
+	token, err := middleware.GenerateRefreshToken()
+	if err != nil {
+		return err
+	}
+	code := hm.baseInstance.GenerateVerificationCode()
+
+	if err := hm.dbManager.CreateEmailChangeToken(user.ID, email, token, code, time.Now().Add(emailVerificationTTL)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/api/email/change/verify?token=%s", hm.baseInstance.Cfg.PublicURL, url.QueryEscape(token))
+	body := fmt.Sprintf(`<p>%s，您好：</p>
+<p>您正在将账号邮箱修改为此邮箱，验证码为 <b>%s</b>，%d 小时内有效。</p>
+<p>也可以点击以下链接完成验证：<a href="%s">%s</a></p>
+<p>如果不是您本人操作，请忽略此邮件。</p>`,
+		html.EscapeString(user.Username), code, int(emailVerificationTTL.Hours()), link, link)
+
+	return hm.baseInstance.SendEmail(email, "验证新邮箱", body)
+}
+
+// 申请修改邮箱：校验当前密码后向新邮箱发送验证邮件
+func (hm *HTTPManager) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var changeData struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&changeData); err != nil || changeData.Email == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+
+	user, err := hm.dbManager.GetUserInfo(userID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if changeData.Email == user.Email {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("新邮箱与当前邮箱相同"))
+		return
+	}
+	if _, err := hm.dbManager.AuthenticateUser(user.Username, changeData.CurrentPassword); err != nil {
+		sendJSONResponse(w, http.StatusForbidden, nil, fmt.Errorf("当前密码不正确"))
+		return
+	}
+	existing, err := hm.dbManager.GetUserByEmail(changeData.Email)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if existing != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, database.ErrEmailTaken)
+		return
+	}
+
+	count, lastSentAt, err := hm.dbManager.GetVerificationSendStats(userID, models.TokenPurposeEmailChange, time.Now().Add(-time.Hour))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if wait := time.Until(lastSentAt.Add(verificationResendInterval)); wait > 0 {
+		sendRetryAfter(w, wait)
+		return
+	}
+	if count >= verificationHourlyLimit {
+		sendRetryAfter(w, time.Hour)
+		return
+	}
+
+	if err := hm.sendEmailChangeEmail(&user, changeData.Email); err != nil {
+		log.Printf("发送修改邮箱验证邮件给用户 %d 失败: %v", userID, err)
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("发送验证邮件失败"))
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "验证邮件已发送到新邮箱"}, nil)
+}
+
+// 通过新邮箱收到的链接确认修改邮箱，支持 GET 和 POST
+func (hm *HTTPManager) handleVerifyEmailChange(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var verifyData struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&verifyData); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+			return
+		}
+		token = verifyData.Token
+	}
+	if token == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("缺少验证令牌"))
+		return
+	}
+
+	verification, err := hm.dbManager.ConsumeVerificationToken(models.TokenPurposeEmailChange, token)
+	hm.applyEmailChange(w, r, verification, err)
+}
+
+// 登录后输入新邮箱收到的验证码确认修改邮箱
+func (hm *HTTPManager) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var confirmData struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&confirmData); err != nil || confirmData.Code == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("缺少验证码"))
+		return
+	}
+
+	verification, err := hm.dbManager.ConsumeVerificationCode(userID, models.TokenPurposeEmailChange, confirmData.Code)
+	hm.applyEmailChange(w, r, verification, err)
+}
+
+// 验证通过后保存新邮箱并标记为已验证
+func (hm *HTTPManager) applyEmailChange(w http.ResponseWriter, r *http.Request, verification *models.VerificationToken, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, database.ErrVerificationInvalid) {
+			status = http.StatusBadRequest
+		}
+		sendJSONResponse(w, status, nil, err)
+		return
+	}
+
+	before, err := hm.dbManager.GetUserInfo(verification.UserID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if err := hm.dbManager.ChangeEmail(verification.UserID, verification.Email); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, database.ErrEmailTaken) {
+			status = http.StatusConflict
+		}
+		sendJSONResponse(w, status, nil, err)
+		return
+	}
+	ac := auditContext(r)
+	ac.ActorID = verification.UserID
+	hm.dbManager.Audit(ac, models.AuditLog{Action: models.AuditEmailChange, TargetType: models.AuditTargetUser, TargetID: verification.UserID},
+		map[string]string{"email": before.Email}, map[string]string{"email": verification.Email})
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "邮箱修改成功"}, nil)
+}
+
+// 撤销用户除 exceptSessionID 以外的会话并断开对应连接
+func (hm *HTTPManager) revokeOtherSessions(userID, exceptSessionID uint) {
+	sessionIDs, err := hm.dbManager.RevokeUserSessions(userID, exceptSessionID)
+	if err != nil {
+		log.Printf("撤销用户 %d 的会话失败: %v", userID, err)
+		return
+	}
+	hm.baseInstance.DisconnectSessions(sessionIDs...)
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("密码长度不能少于 %d 位", minPasswordLength)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/models"
+)
+
+// 管理接口只允许 IsAdmin 用户访问，需挂在认证中间件之后
+func (hm *HTTPManager) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := hm.currentUser(r)
+		if err != nil {
+			sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+			return
+		}
+		if !user.IsAdmin {
+			sendJSONResponse(w, http.StatusForbidden, nil, fmt.Errorf("需要管理员权限"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GET 锁定记录列表，active=true 时只返回仍在生效的
+func (hm *HTTPManager) handleListLockouts(w http.ResponseWriter, r *http.Request) {
+	activeOnly := r.URL.Query().Get("active") == "true"
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	lockouts, err := hm.dbManager.ListLockouts(activeOnly, limit)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, lockouts, nil)
+}
+
+// 解除账号（username）或 IP 的锁定，并清除失败计数
+func (hm *HTTPManager) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	adminID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var unlockData struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&unlockData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+
+	lockoutType, key := models.LockoutTypeAccount, unlockData.Username
+	if unlockData.IP != "" {
+		lockoutType, key = models.LockoutTypeIP, unlockData.IP
+	}
+	if key == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("需要指定用户名或 IP"))
+		return
+	}
+
+	lockouts, err := hm.dbManager.Unlock(lockoutType, key, adminID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	hm.loginGuard.Reset(lockoutType, key)
+
+	entry := models.AuditLog{Action: models.AuditUnlock, TargetType: models.AuditTargetIP}
+	if lockoutType == models.LockoutTypeAccount {
+		entry.TargetType = models.AuditTargetUser
+		if len(lockouts) > 0 {
+			entry.TargetID = lockouts[0].UserID
+		}
+	}
+	hm.dbManager.Audit(auditContext(r), entry, nil, map[string]interface{}{"type": lockoutType, "key": key, "unlocked": len(lockouts)})
+
+	sendJSONResponse(w, http.StatusOK, map[string]interface{}{"unlocked": len(lockouts)}, nil)
+}
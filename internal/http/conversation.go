@@ -0,0 +1,98 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/models"
+)
+
+// 会话状态变化时推送给用户所有设备的事件
+const conversationUpdatedEvent = "conversationUpdated"
+
+// GET 会话列表，PUT 修改会话的免打扰、置顶和归档状态
+func (hm *HTTPManager) handleConversations(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		conversations, err := hm.dbManager.GetConversations(userID)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "获取会话列表失败"}, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, conversations, nil)
+	case http.MethodPut:
+		var request struct {
+			PeerID uint `json:"peer_id"`
+			RoomID uint `json:"room_id"`
+			database.ConversationSettings
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+			return
+		}
+		state, err := hm.dbManager.UpdateConversationSettings(userID, request.PeerID, request.RoomID, request.ConversationSettings)
+		if err != nil {
+			sendJSONResponse(w, conversationErrorStatus(err), nil, err)
+			return
+		}
+		hm.sendConversationStatus(w, state)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, errors.New("方法不允许"))
+	}
+}
+
+// POST 标记会话已读，msg_id 为空时标记到最新消息
+func (hm *HTTPManager) handleConversationRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, errors.New("方法不允许"))
+		return
+	}
+
+	var request struct {
+		PeerID uint   `json:"peer_id"`
+		RoomID uint   `json:"room_id"`
+		MsgID  string `json:"msg_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+		return
+	}
+	state, err := hm.dbManager.MarkConversationRead(userID, request.PeerID, request.RoomID, request.MsgID)
+	if err != nil {
+		sendJSONResponse(w, conversationErrorStatus(err), nil, err)
+		return
+	}
+	hm.sendConversationStatus(w, state)
+}
+
+// 返回会话最新状态，并同步到用户的其他设备
+func (hm *HTTPManager) sendConversationStatus(w http.ResponseWriter, state *models.ConversationState) {
+	status, err := hm.dbManager.ConversationStatusOf(state)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	hm.baseInstance.EmitToUsers(conversationUpdatedEvent, status, state.UserID)
+	sendJSONResponse(w, http.StatusOK, status, nil)
+}
+
+func conversationErrorStatus(err error) int {
+	if errors.Is(err, database.ErrPeerNotFound) {
+		return http.StatusNotFound
+	}
+	return historyErrorStatus(err)
+}
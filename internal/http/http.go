@@ -2,6 +2,7 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,21 +14,31 @@ import (
 	"github.com/Ireoo/sixin-server/database"
 	"github.com/Ireoo/sixin-server/internal/handlers"
 	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/internal/oidc"
 	"github.com/Ireoo/sixin-server/models"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/patrickmn/go-cache"
 )
 
 type HTTPManager struct {
 	dbManager    *database.DatabaseManager
 	baseInstance *base.Base
+	mfaAttempts  *cache.Cache   // 两步验证挑战令牌的提交次数，按 jti 记录
+	oidcProvider *oidc.Provider // 未配置 OIDC 时为 nil
+	oidcStates   *cache.Cache   // 进行中的 OIDC 授权请求，按 state 记录
+	loginGuard   *loginGuard
 }
 
 func NewHTTPManager(baseInst *base.Base) *HTTPManager {
-	return &HTTPManager{
+	hm := &HTTPManager{
+		dbManager:    baseInst.DbManager,
 		baseInstance: baseInst,
+		mfaAttempts:  cache.New(10*time.Minute, 10*time.Minute),
+		oidcStates:   cache.New(oidcStateTTL, 10*time.Minute),
+		loginGuard:   newLoginGuard(baseInst.DbManager),
 	}
+	hm.oidcProvider = hm.newOIDCProvider()
+	return hm
 }
 
 type statusResponseWriter struct {
@@ -75,6 +86,15 @@ func ChainMiddlewares(handler http.HandlerFunc, middlewares ...func(http.Handler
 
 func (hm *HTTPManager) HandleRoutes() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/ping", "/api/login", "/api/register", "/api/token/refresh", "/api/verify-email",
+			"/api/verify-email/resend", "/api/login/2fa", "/api/oidc/login", "/api/oidc/callback",
+			"/api/password/forgot", "/api/password/reset":
+			if !hm.allowRequest(w, r, r.URL.Path) {
+				return
+			}
+		}
+
 		switch r.URL.Path {
 		case "/api/ping":
 			handlers.Ping(w, r)
@@ -82,16 +102,72 @@ func (hm *HTTPManager) HandleRoutes() http.HandlerFunc {
 			hm.handleLogin(w, r)
 		case "/api/register":
 			hm.handleRegister(w, r)
+		case "/api/token/refresh":
+			hm.handleRefreshToken(w, r)
+		case "/api/verify-email":
+			hm.handleVerifyEmail(w, r)
+		case "/api/verify-email/resend":
+			hm.handleResendVerification(w, r)
+		case "/api/login/2fa":
+			hm.handleLoginTwoFactor(w, r)
+		case "/api/oidc/login":
+			hm.handleOIDCLogin(w, r)
+		case "/api/oidc/callback":
+			hm.handleOIDCCallback(w, r)
+		case "/api/password/forgot":
+			hm.handleForgotPassword(w, r)
+		case "/api/password/reset":
+			hm.handleResetPassword(w, r)
 		default:
 			// 对其他所有路由应用身份验证中间件
 			middleware.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !hm.allowRequest(w, r, r.URL.Path) {
+					return
+				}
+
 				switch r.URL.Path {
+				case "/api/logout":
+					hm.handleLogout(w, r)
+				case "/api/password/change":
+					hm.handleChangePassword(w, r)
+				case "/api/2fa":
+					hm.handleTwoFactorStatus(w, r)
+				case "/api/2fa/setup":
+					hm.handleTwoFactorSetup(w, r)
+				case "/api/2fa/enable":
+					hm.handleTwoFactorEnable(w, r)
+				case "/api/2fa/disable":
+					hm.handleTwoFactorDisable(w, r)
+				case "/api/2fa/recovery-codes":
+					hm.handleRecoveryCodes(w, r)
+				case "/api/sessions":
+					hm.handleSessions(w, r)
+				case "/api/admin/lockouts":
+					hm.adminOnly(hm.handleListLockouts)(w, r)
+				case "/api/admin/unlock":
+					hm.adminOnly(hm.handleUnlock)(w, r)
+				case "/api/admin/audit-logs":
+					hm.adminOnly(hm.handleAuditLogs)(w, r)
 				case "/api/users":
 					hm.handleUsers(w, r)
 				case "/api/rooms":
 					hm.handleRooms(w, r)
 				case "/api/message":
 					hm.handleMessage(w, r)
+				case "/api/messages":
+					hm.handleMessageHistory(w, r)
+				case "/api/conversations":
+					hm.handleConversations(w, r)
+				case "/api/conversations/read":
+					hm.handleConversationRead(w, r)
+				case "/api/sync":
+					hm.handleSync(w, r)
+				case "/api/mentions":
+					hm.handleMentions(w, r)
+				case "/api/mentions/read":
+					hm.handleMentionsRead(w, r)
+				case "/api/scheduled-messages":
+					hm.handleScheduledMessages(w, r)
 				case "/api/room-members":
 					hm.handleRoomMembers(w, r)
 				case "/api/room-privacy":
@@ -101,8 +177,24 @@ func (hm *HTTPManager) HandleRoutes() http.HandlerFunc {
 				default:
 					if strings.HasPrefix(r.URL.Path, "/api/users/") {
 						hm.handleUserByID(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/rooms/") && strings.HasSuffix(r.URL.Path, "/admins") {
+						hm.handleRoomAdmins(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/rooms/") && strings.HasSuffix(r.URL.Path, "/pins") {
+						hm.handleRoomPins(w, r)
 					} else if strings.HasPrefix(r.URL.Path, "/api/rooms/") {
 						hm.handleRoomByID(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/messages/") && strings.HasSuffix(r.URL.Path, "/reactions") {
+						hm.handleMessageReactions(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/messages/") && strings.HasSuffix(r.URL.Path, "/thread") {
+						hm.handleMessageThread(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/messages/") && strings.HasSuffix(r.URL.Path, "/edits") {
+						hm.handleMessageEdits(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/messages/") {
+						hm.handleMessageByID(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/scheduled-messages/") {
+						hm.handleScheduledMessageByID(w, r)
+					} else if strings.HasPrefix(r.URL.Path, "/api/sessions/") {
+						hm.handleSessionByID(w, r)
 					} else {
 						http.NotFound(w, r)
 					}
@@ -158,6 +250,8 @@ func (hm *HTTPManager) handleRooms(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		rooms, err := hm.dbManager.GetRooms(userID)
 		sendJSONResponse(w, http.StatusOK, rooms, err)
+	case http.MethodPost:
+		hm.handleCreateRoom(w, r, userID)
 	default:
 		sendJSONResponse(w, http.StatusNotFound, map[string]string{"message": "方法不允许"}, fmt.Errorf("方法不允许"))
 	}
@@ -181,27 +275,12 @@ func (hm *HTTPManager) handleMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	message.TalkerID = userID
-	err = hm.dbManager.CreateMessage(&message)
+	fullMessage, err := hm.baseInstance.PostMessage(&message)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "保存消息失败"}, err)
+		sendJSONResponse(w, messageErrorStatus(err), map[string]string{"message": "发送消息失败"}, err)
 		return
 	}
 
-	fullMessage, err := hm.dbManager.GetFullMessage(message.ID)
-	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "加载完整消息数据失败"}, err)
-		return
-	}
-
-	var recipientID uint
-	if message.ListenerID != 0 {
-		recipientID = message.ListenerID
-	} else {
-		recipientID = message.RoomID
-	}
-
-	hm.baseInstance.SendMessageToUsers(fullMessage, message.TalkerID, recipientID)
-
 	sendJSONResponse(w, http.StatusOK, fullMessage, nil)
 }
 
@@ -229,10 +308,19 @@ func (hm *HTTPManager) handleUserByID(w http.ResponseWriter, r *http.Request) {
 			sendJSONResponse(w, http.StatusBadRequest, nil, err)
 			return
 		}
+		before, _ := hm.dbManager.GetFriendship(userID, updatedUser.FriendID)
 		err := hm.dbManager.UpdateUser(userID, uint(id), updatedUser)
+		if err == nil {
+			hm.dbManager.AuditFriendChange(auditContext(r), before, &updatedUser.Alias, &updatedUser.IsPrivate)
+		}
 		sendJSONResponse(w, http.StatusOK, updatedUser, err)
 	case http.MethodDelete:
+		before, _ := hm.dbManager.GetFriendship(userID, uint(id))
 		err := hm.dbManager.DeleteUserFriend(userID, uint(id))
+		if err == nil && before != nil {
+			hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditFriendRemove, TargetType: models.AuditTargetUser, TargetID: uint(id)},
+				map[string]interface{}{"alias": before.Alias, "isPrivate": before.IsPrivate}, nil)
+		}
 		sendJSONResponse(w, http.StatusOK, map[string]string{"message": "用户删除成功"}, err)
 	default:
 		sendJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"message": "方法不允许"}, fmt.Errorf("方法不允许"))
@@ -257,18 +345,60 @@ func (hm *HTTPManager) handleRoomByID(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		room, err := hm.dbManager.GetRoomByID(userID, uint(id))
-		sendJSONResponse(w, http.StatusOK, room, err)
+		if err != nil {
+			sendJSONResponse(w, roomErrorStatus(err), nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, room, nil)
 	case http.MethodPut:
-		var updatedRoom models.UserRoom
-		if err := json.NewDecoder(r.Body).Decode(&updatedRoom); err != nil {
+		var roomUpdate struct {
+			Name   *string `json:"name"`
+			Avatar *string `json:"avatar"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&roomUpdate); err != nil {
 			sendJSONResponse(w, http.StatusBadRequest, nil, err)
 			return
 		}
-		err := hm.dbManager.UpdateRoom(userID, uint(id), updatedRoom)
-		sendJSONResponse(w, http.StatusOK, updatedRoom, err)
+
+		// 名称和头像分别检查权限
+		updates := make(map[string]interface{})
+		if roomUpdate.Name != nil {
+			if _, err := hm.dbManager.CheckRoomPermission(userID, uint(id), database.ActionRename); err != nil {
+				sendJSONResponse(w, roomErrorStatus(err), nil, err)
+				return
+			}
+			updates["name"] = *roomUpdate.Name
+		}
+		if roomUpdate.Avatar != nil {
+			if _, err := hm.dbManager.CheckRoomPermission(userID, uint(id), database.ActionChangeAvatar); err != nil {
+				sendJSONResponse(w, roomErrorStatus(err), nil, err)
+				return
+			}
+			updates["avatar"] = *roomUpdate.Avatar
+		}
+		before, _ := hm.dbManager.GetRoomByID(userID, uint(id))
+		if err := hm.dbManager.UpdateRoomInfo(uint(id), updates); err != nil {
+			sendJSONResponse(w, roomErrorStatus(err), nil, err)
+			return
+		}
+		if len(updates) > 0 {
+			hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditRoomUpdate, TargetType: models.AuditTargetRoom, TargetID: uint(id), RoomID: uint(id)},
+				map[string]string{"name": before.Name, "avatar": before.Avatar}, updates)
+		}
+		sendJSONResponse(w, http.StatusOK, map[string]string{"message": "房间信息更新成功"}, nil)
 	case http.MethodDelete:
-		err := hm.dbManager.DeleteRoom(userID, uint(id))
-		sendJSONResponse(w, http.StatusOK, map[string]string{"message": "房间删除成功"}, err)
+		if _, err := hm.dbManager.CheckRoomPermission(userID, uint(id), database.ActionDeleteRoom); err != nil {
+			sendJSONResponse(w, roomErrorStatus(err), nil, err)
+			return
+		}
+		before, _ := hm.dbManager.GetRoomByID(userID, uint(id))
+		if err := hm.dbManager.DeleteRoom(uint(id)); err != nil {
+			sendJSONResponse(w, roomErrorStatus(err), nil, err)
+			return
+		}
+		hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditRoomDelete, TargetType: models.AuditTargetRoom, TargetID: uint(id), RoomID: uint(id)},
+			map[string]interface{}{"name": before.Name, "ownerId": before.OwnerID}, nil)
+		sendJSONResponse(w, http.StatusOK, map[string]string{"message": "房间删除成功"}, nil)
 	default:
 		sendJSONResponse(w, http.StatusNotFound, map[string]string{"message": "方法不允许"}, fmt.Errorf("方法不允许"))
 	}
@@ -305,21 +435,42 @@ func (hm *HTTPManager) handleRoomMembers(w http.ResponseWriter, r *http.Request)
 }
 
 func (hm *HTTPManager) handleAddUserToRoom(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
 	var roomRequest struct {
 		UserID    uint   `json:"user_id"`
 		RoomID    uint   `json:"room_id"`
 		Alias     string `json:"alias"`
 		IsPrivate bool   `json:"is_private"`
+		Role      string `json:"role"` // member 或 guest，默认 member
 	}
 	if err := json.NewDecoder(r.Body).Decode(&roomRequest); err != nil {
 		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
 		return
 	}
-	err := hm.dbManager.AddUserToRoom(roomRequest.UserID, roomRequest.RoomID, roomRequest.Alias, roomRequest.IsPrivate)
-	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "用户成功添加到房间"}, err)
+	if _, err := hm.dbManager.CheckRoomPermission(userID, roomRequest.RoomID, database.ActionInvite); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+	if err := hm.dbManager.AddUserToRoom(roomRequest.UserID, roomRequest.RoomID, roomRequest.Alias, roomRequest.IsPrivate, roomRequest.Role); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+	hm.dbManager.AuditMemberAdd(auditContext(r), roomRequest.UserID, roomRequest.RoomID)
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "用户成功添加到房间"}, nil)
 }
 
 func (hm *HTTPManager) handleRemoveUserFromRoom(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
 	var roomRequest struct {
 		UserID uint `json:"user_id"`
 		RoomID uint `json:"room_id"`
@@ -328,15 +479,27 @@ func (hm *HTTPManager) handleRemoveUserFromRoom(w http.ResponseWriter, r *http.R
 		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
 		return
 	}
-	err := hm.dbManager.RemoveUserFromRoom(roomRequest.UserID, roomRequest.RoomID)
+	if err := hm.dbManager.CheckRemoveMember(userID, roomRequest.UserID, roomRequest.RoomID); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+	before, _ := hm.dbManager.GetMembership(roomRequest.UserID, roomRequest.RoomID)
+	err = hm.dbManager.RemoveUserFromRoom(roomRequest.UserID, roomRequest.RoomID)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "用户从房间中删除失败"}, err)
+		sendJSONResponse(w, roomErrorStatus(err), map[string]string{"message": "用户从房间中删除失败"}, err)
 		return
 	}
+	hm.dbManager.AuditMemberRemove(auditContext(r), before)
 	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "用户从房间中删除成功"}, nil)
 }
 
 func (hm *HTTPManager) handleUpdateRoomMember(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
 	var roomRequest struct {
 		UserID    uint   `json:"user_id"`
 		RoomID    uint   `json:"room_id"`
@@ -347,17 +510,23 @@ func (hm *HTTPManager) handleUpdateRoomMember(w http.ResponseWriter, r *http.Req
 		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
 		return
 	}
+	if err := hm.dbManager.CheckManageMember(userID, roomRequest.UserID, roomRequest.RoomID); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
 
-	err := hm.dbManager.UpdateRoomMemberAlias(roomRequest.UserID, roomRequest.RoomID, roomRequest.Alias)
+	before, _ := hm.dbManager.GetMembership(roomRequest.UserID, roomRequest.RoomID)
+	err = hm.dbManager.UpdateRoomMemberAlias(roomRequest.UserID, roomRequest.RoomID, roomRequest.Alias)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "更新房间成员别名失败"}, err)
+		sendJSONResponse(w, roomErrorStatus(err), map[string]string{"message": "更新房间成员别名失败"}, err)
 		return
 	}
 	err = hm.dbManager.SetRoomMemberPrivacy(roomRequest.UserID, roomRequest.RoomID, roomRequest.IsPrivate)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "设置房间成员隐私失败"}, err)
+		sendJSONResponse(w, roomErrorStatus(err), map[string]string{"message": "设置房间成员隐私失败"}, err)
 		return
 	}
+	hm.dbManager.AuditMemberChange(auditContext(r), before, &roomRequest.Alias, &roomRequest.IsPrivate)
 	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "房间成员信息更新成功"}, nil)
 }
 
@@ -366,6 +535,11 @@ func (hm *HTTPManager) handleSetRoomPrivacy(w http.ResponseWriter, r *http.Reque
 		sendJSONResponse(w, http.StatusNotFound, map[string]string{"message": "方法不允许"}, fmt.Errorf("方法不允许"))
 		return
 	}
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
 
 	var roomRequest struct {
 		UserID    uint `json:"user_id"`
@@ -376,11 +550,17 @@ func (hm *HTTPManager) handleSetRoomPrivacy(w http.ResponseWriter, r *http.Reque
 		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
 		return
 	}
-	err := hm.dbManager.SetRoomPrivacy(roomRequest.UserID, roomRequest.RoomID, roomRequest.IsPrivate)
+	if err := hm.dbManager.CheckManageMember(userID, roomRequest.UserID, roomRequest.RoomID); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+	before, _ := hm.dbManager.GetMembership(roomRequest.UserID, roomRequest.RoomID)
+	err = hm.dbManager.SetRoomPrivacy(roomRequest.UserID, roomRequest.RoomID, roomRequest.IsPrivate)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "房间隐私设置更新失败"}, err)
+		sendJSONResponse(w, roomErrorStatus(err), map[string]string{"message": "房间隐私设置更新失败"}, err)
 		return
 	}
+	hm.dbManager.AuditMemberChange(auditContext(r), before, nil, &roomRequest.IsPrivate)
 	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "房间隐私设置更新成功"}, nil)
 }
 
@@ -390,7 +570,15 @@ func (hm *HTTPManager) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var userData *models.User
+	// User 的密码字段不参与 JSON 序列化，注册请求单独解析
+	var userData struct {
+		Username string            `json:"username"`
+		Password string            `json:"password"`
+		Email    string            `json:"email"`
+		WechatID string            `json:"wechatId"`
+		Name     string            `json:"name"`
+		Phone    map[string]string `json:"phone"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
 		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
 		return
@@ -423,37 +611,37 @@ func (hm *HTTPManager) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 创建新用户
+	// 创建待验证的新用户，密码由 CreateUser 统一哈希
 	newUser := &models.User{
 		Username: userData.Username,
+		Password: userData.Password,
 		Email:    userData.Email,
 		WechatID: userData.WechatID,
 		Name:     userData.Name,
 		Phone:    userData.Phone,
+		Status:   models.UserStatusPending,
 	}
 
-	// 生成密码哈希
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userData.Password), bcrypt.DefaultCost)
-	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("密码加密失败"))
-		return
-	}
-	newUser.Password = string(hashedPassword)
-
 	// 创建用户
-	err = hm.baseInstance.DbManager.CreateUser(newUser)
+	err := hm.baseInstance.DbManager.CreateUser(newUser)
 	if err != nil {
 		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("创建用户失败: %v", err))
 		return
 	}
+	hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditRegister, TargetType: models.AuditTargetUser, TargetID: newUser.ID},
+		nil, map[string]string{"username": newUser.Username, "email": newUser.Email})
 
-	// 移除敏感信息
-	newUser.Password = ""
-	newUser.SecretKey = ""
+	// 邮件发送失败不影响注册，用户可以通过重发接口再次获取
+	emailSent := true
+	if err := hm.sendVerificationEmail(newUser); err != nil {
+		log.Printf("发送验证邮件给用户 %d 失败: %v", newUser.ID, err)
+		emailSent = false
+	}
 
 	sendJSONResponse(w, http.StatusOK, map[string]interface{}{
-		"message": "用户注册成功",
-		"user":    newUser,
+		"message":    "注册成功，请查收验证邮件完成激活",
+		"user":       newUser,
+		"email_sent": emailSent,
 	}, nil)
 }
 
@@ -472,26 +660,233 @@ func (hm *HTTPManager) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 先检查失败次数，锁定期间即使密码正确也拒绝
+	ip := middleware.ClientIP(r)
+	wait, err := hm.loginGuard.Check(loginData.Username, ip)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if wait > 0 {
+		sendRetryAfter(w, wait)
+		return
+	}
+
 	user, err := hm.baseInstance.DbManager.AuthenticateUser(loginData.Username, loginData.Password)
+	if err != nil {
+		hm.loginGuard.Fail(loginData.Username, ip)
+		hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditLoginFailed, TargetType: models.AuditTargetUser},
+			nil, map[string]string{"username": loginData.Username})
+		sendJSONResponse(w, http.StatusUnauthorized, nil, database.ErrInvalidCredentials)
+		return
+	}
+	if user.Status == models.UserStatusPending {
+		sendJSONResponse(w, http.StatusForbidden, map[string]string{"message": "请先验证邮箱"}, fmt.Errorf("邮箱未验证"))
+		return
+	}
+
+	// 启用了两步验证时只返回挑战令牌，验证码通过后才签发访问令牌，失败计数也在验证码通过后才清除
+	if user.TOTPEnabled {
+		challenge, err := middleware.GenerateMFAChallenge(user.ID)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("生成挑战令牌失败"))
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"mfa_required":    true,
+			"challenge_token": challenge,
+		}, nil)
+		return
+	}
+	hm.loginGuard.Succeed(loginData.Username)
+
+	tokens, err := hm.createSession(r, user.ID)
 	if err != nil {
 		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
 		return
 	}
+	hm.auditLogin(r, user.ID, tokens, "password")
 
-	// 创建 JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
+	sendJSONResponse(w, http.StatusOK, tokens, nil)
+}
+
+// 创建登录会话，返回短期访问令牌和刷新令牌
+func (hm *HTTPManager) createSession(r *http.Request, userID uint) (map[string]interface{}, error) {
+	return hm.createSessionForDevice(userID, sessionDevice(r))
+}
+
+func (hm *HTTPManager) createSessionForDevice(userID uint, device models.Session) (map[string]interface{}, error) {
+	refreshToken, err := middleware.GenerateRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("生成刷新令牌失败")
+	}
+
+	if device.DeviceType == "" {
+		device.DeviceType = "web"
+	}
 
-	// 使用密钥签名 token（这里使用一个示例密钥，实际应用中应该使用更安全的方式存储和管理密钥）
-	tokenString, err := token.SignedString([]byte("your_secret_key"))
+	session, err := hm.dbManager.CreateSession(userID, refreshToken, time.Now().Add(hm.baseInstance.Cfg.RefreshTokenTTL), device)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("生成 token 失败"))
+		return nil, err
+	}
+
+	return hm.tokenResponse(userID, session.ID, refreshToken)
+}
+
+// 从请求中读取设备信息，设备类型与 WebSocket 连接一样使用 type 查询参数
+func sessionDevice(r *http.Request) models.Session {
+	return models.Session{
+		DeviceType: r.URL.Query().Get("type"),
+		IP:         middleware.ClientIP(r),
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+func (hm *HTTPManager) tokenResponse(userID, sessionID uint, refreshToken string) (map[string]interface{}, error) {
+	tokenString, err := middleware.GenerateJWT(userID, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("生成 token 失败")
+	}
+
+	return map[string]interface{}{
+		"token":         tokenString,
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int64(middleware.AccessTokenTTL().Seconds()),
+		"session_id":    sessionID,
+	}, nil
+}
+
+func (hm *HTTPManager) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var refreshData struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&refreshData); err != nil || refreshData.RefreshToken == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+
+	newRefreshToken, err := middleware.GenerateRefreshToken()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("生成刷新令牌失败"))
+		return
+	}
+
+	session, err := hm.dbManager.RotateRefreshToken(refreshData.RefreshToken, newRefreshToken, time.Now().Add(hm.baseInstance.Cfg.RefreshTokenTTL))
+	if err != nil {
+		if (errors.Is(err, database.ErrRefreshTokenReused) || errors.Is(err, database.ErrSessionRevoked)) && session != nil {
+			// 令牌被重放或会话已失效，断开该会话的所有连接
+			hm.baseInstance.DisconnectSessions(session.ID)
+		}
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	if err := hm.dbManager.TouchSession(session.ID, sessionDevice(r)); err != nil {
+		log.Printf("更新会话 %d 活跃时间失败: %v", session.ID, err)
+	}
+
+	tokens, err := hm.tokenResponse(session.UserID, session.ID, newRefreshToken)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, tokens, nil)
+}
+
+func (hm *HTTPManager) handleLogout(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := middleware.GetSessionIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	if err := hm.dbManager.RevokeSession(sessionID); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("撤销会话失败: %v", err))
+		return
+	}
+	hm.baseInstance.DisconnectSessions(sessionID)
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "已退出登录"}, nil)
+}
+
+func (hm *HTTPManager) handleSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	currentSessionID, err := middleware.GetSessionIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := hm.dbManager.GetActiveSessions(userID)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == currentSessionID
+		}
+		sendJSONResponse(w, http.StatusOK, sessions, nil)
+	case http.MethodDelete:
+		// 退出除当前会话以外的所有设备
+		sessionIDs, err := hm.dbManager.RevokeUserSessions(userID, currentSessionID)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		hm.baseInstance.DisconnectSessions(sessionIDs...)
+		sendJSONResponse(w, http.StatusOK, map[string]interface{}{"message": "已退出其他设备", "sessions": sessionIDs}, nil)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"message": "方法不允许"}, fmt.Errorf("方法不允许"))
+	}
+}
+
+func (hm *HTTPManager) handleSessionByID(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	if err := hm.dbManager.RevokeUserSession(userID, uint(id)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, database.ErrSessionNotFound) {
+			status = http.StatusNotFound
+		}
+		sendJSONResponse(w, status, nil, err)
 		return
 	}
+	hm.baseInstance.DisconnectSessions(uint(id))
 
-	sendJSONResponse(w, http.StatusOK, map[string]string{"token": tokenString}, nil)
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "会话已退出"}, nil)
+}
+
+// 公开 JWT 验证公钥，供其他服务验证本服务签发的 token
+func (hm *HTTPManager) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	keyRing := middleware.GetKeyRing()
+	if keyRing == nil {
+		sendJSONResponse(w, http.StatusServiceUnavailable, nil, fmt.Errorf("JWT 密钥环未初始化"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(keyRing.JWKS()); err != nil {
+		log.Println("编码 JWKS 失败:", err)
+	}
 }
 
 func (hm *HTTPManager) handleGetRoomAliasByUsers(w http.ResponseWriter, r *http.Request) {
@@ -501,8 +896,8 @@ func (hm *HTTPManager) handleGetRoomAliasByUsers(w http.ResponseWriter, r *http.
 	}
 
 	// 从 auth 中获取 userID
-	userID, ok := r.Context().Value("userID").(uint)
-	if !ok {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
 		sendJSONResponse(w, http.StatusUnauthorized, nil, fmt.Errorf("无法获取用户ID"))
 		return
 	}
@@ -520,7 +915,7 @@ func (hm *HTTPManager) handleGetRoomAliasByUsers(w http.ResponseWriter, r *http.
 
 	aliases, err := hm.baseInstance.DbManager.GetRoomAliasByUsers(userID, uint(roomID))
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
 		return
 	}
 
@@ -528,21 +923,63 @@ func (hm *HTTPManager) handleGetRoomAliasByUsers(w http.ResponseWriter, r *http.
 }
 
 func (hm *HTTPManager) SetupRoutes(r *mux.Router) {
-	r.HandleFunc("/api/ping", handlers.Ping).Methods("GET")
-	r.HandleFunc("/api/login", hm.handleLogin).Methods("POST")
-	r.HandleFunc("/api/register", hm.handleRegister).Methods("POST")
+	// 公开路由，按 IP 限流
+	public := r.NewRoute().Subrouter()
+	public.Use(hm.rateLimit)
+
+	public.HandleFunc("/api/ping", handlers.Ping).Methods("GET")
+	public.HandleFunc("/api/login", hm.handleLogin).Methods("POST")
+	public.HandleFunc("/api/register", hm.handleRegister).Methods("POST")
+	public.HandleFunc("/api/token/refresh", hm.handleRefreshToken).Methods("POST")
+	public.HandleFunc("/api/verify-email", hm.handleVerifyEmail).Methods("GET", "POST")
+	public.HandleFunc("/api/verify-email/resend", hm.handleResendVerification).Methods("POST")
+	public.HandleFunc("/api/email/change/verify", hm.handleVerifyEmailChange).Methods("GET", "POST")
+	public.HandleFunc("/api/login/2fa", hm.handleLoginTwoFactor).Methods("POST")
+	public.HandleFunc("/api/oidc/login", hm.handleOIDCLogin).Methods("GET")
+	public.HandleFunc("/api/oidc/callback", hm.handleOIDCCallback).Methods("GET")
+	public.HandleFunc("/api/password/forgot", hm.handleForgotPassword).Methods("POST")
+	public.HandleFunc("/api/password/reset", hm.handleResetPassword).Methods("POST")
+	public.HandleFunc("/.well-known/jwks.json", hm.handleJWKS).Methods("GET")
 
 	// 受保护的路由
 	protected := r.PathPrefix("/api").Subrouter()
-	protected.Use(middleware.AuthMiddleware)
-
+	protected.Use(middleware.AuthMiddleware, hm.rateLimit)
+
+	protected.HandleFunc("/logout", hm.handleLogout).Methods("POST")
+	protected.HandleFunc("/password/change", hm.handleChangePassword).Methods("POST")
+	protected.HandleFunc("/email/change", hm.handleChangeEmail).Methods("POST")
+	protected.HandleFunc("/email/change/confirm", hm.handleConfirmEmailChange).Methods("POST")
+	protected.HandleFunc("/2fa", hm.handleTwoFactorStatus).Methods("GET")
+	protected.HandleFunc("/2fa/setup", hm.handleTwoFactorSetup).Methods("POST")
+	protected.HandleFunc("/2fa/enable", hm.handleTwoFactorEnable).Methods("POST")
+	protected.HandleFunc("/2fa/disable", hm.handleTwoFactorDisable).Methods("POST")
+	protected.HandleFunc("/2fa/recovery-codes", hm.handleRecoveryCodes).Methods("POST")
+	protected.HandleFunc("/sessions", hm.handleSessions).Methods("GET", "DELETE")
+	protected.HandleFunc("/admin/lockouts", hm.adminOnly(hm.handleListLockouts)).Methods("GET")
+	protected.HandleFunc("/admin/unlock", hm.adminOnly(hm.handleUnlock)).Methods("POST")
+	protected.HandleFunc("/admin/audit-logs", hm.adminOnly(hm.handleAuditLogs)).Methods("GET")
+	protected.HandleFunc("/sessions/{id:[0-9]+}", hm.handleSessionByID).Methods("DELETE")
 	protected.HandleFunc("/users", hm.handleUsers).Methods("GET")
-	protected.HandleFunc("/rooms", hm.handleRooms).Methods("GET")
+	protected.HandleFunc("/rooms", hm.handleRooms).Methods("GET", "POST")
 	protected.HandleFunc("/message", hm.handleMessage).Methods("POST")
+	protected.HandleFunc("/messages", hm.handleMessageHistory).Methods("GET")
+	protected.HandleFunc("/messages/{msgId}", hm.handleMessageByID).Methods("PUT", "DELETE")
+	protected.HandleFunc("/messages/{msgId}/edits", hm.handleMessageEdits).Methods("GET")
+	protected.HandleFunc("/messages/{msgId}/thread", hm.handleMessageThread).Methods("GET")
+	protected.HandleFunc("/messages/{msgId}/reactions", hm.handleMessageReactions).Methods("POST", "DELETE")
+	protected.HandleFunc("/conversations", hm.handleConversations).Methods("GET", "PUT")
+	protected.HandleFunc("/conversations/read", hm.handleConversationRead).Methods("POST")
+	protected.HandleFunc("/sync", hm.handleSync).Methods("GET")
+	protected.HandleFunc("/mentions", hm.handleMentions).Methods("GET")
+	protected.HandleFunc("/mentions/read", hm.handleMentionsRead).Methods("POST")
+	protected.HandleFunc("/scheduled-messages", hm.handleScheduledMessages).Methods("GET", "POST")
+	protected.HandleFunc("/scheduled-messages/{id:[0-9]+}", hm.handleScheduledMessageByID).Methods("PUT", "DELETE")
 	protected.HandleFunc("/room-members", hm.handleRoomMembers).Methods("POST", "DELETE", "PUT")
 	protected.HandleFunc("/room-privacy", hm.handleSetRoomPrivacy).Methods("PUT")
 	protected.HandleFunc("/getRoomAliasByUsers", hm.handleGetRoomAliasByUsers).Methods("GET")
 
 	protected.HandleFunc("/users/{id:[0-9]+}", hm.handleUserByID).Methods("GET", "PUT", "DELETE")
 	protected.HandleFunc("/rooms/{id:[0-9]+}", hm.handleRoomByID).Methods("GET", "PUT", "DELETE")
+	protected.HandleFunc("/rooms/{id:[0-9]+}/admins", hm.handleRoomAdmins).Methods("POST", "DELETE")
+	protected.HandleFunc("/rooms/{id:[0-9]+}/pins", hm.handleRoomPins).Methods("GET", "POST", "DELETE")
 }
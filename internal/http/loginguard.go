@@ -0,0 +1,151 @@
+package http
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/models"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// 失败计数的统计窗口，窗口内没有新的失败则清零
+	loginFailureWindow = 15 * time.Minute
+	// 同一账号连续失败达到该次数后开始递增等待时间
+	loginDelayAfter = 3
+	loginMaxDelay   = time.Minute
+	// 同一账号失败达到该次数后锁定
+	accountLockoutThreshold = 10
+	// 同一 IP 失败达到该次数后锁定（覆盖撞库时对大量账号各试几次的情况）
+	ipLockoutThreshold = 50
+	lockoutDuration    = 15 * time.Minute
+)
+
+// 某个账号或 IP 的失败记录
+type loginFailures struct {
+	Count       int
+	NextAttempt time.Time // 递增等待：在此之前的尝试直接拒绝
+}
+
+// loginGuard 按账号和 IP 统计登录失败次数，实现递增等待和临时锁定。
+// 计数保存在内存中，锁定记录写入数据库，重启后仍然生效，管理员可以提前解锁。
+type loginGuard struct {
+	mu       sync.Mutex
+	failures *cache.Cache
+	db       *database.DatabaseManager
+}
+
+func newLoginGuard(db *database.DatabaseManager) *loginGuard {
+	return &loginGuard{
+		failures: cache.New(loginFailureWindow, 5*time.Minute),
+		db:       db,
+	}
+}
+
+func accountKey(username string) string { return "user:" + username }
+func ipKey(ip string) string            { return "ip:" + ip }
+
+// Check 返回需要等待的时间，为 0 表示允许尝试
+func (g *loginGuard) Check(username, ip string) (time.Duration, error) {
+	now := time.Now()
+
+	g.mu.Lock()
+	var wait time.Duration
+	for _, key := range []string{accountKey(username), ipKey(ip)} {
+		if v, found := g.failures.Get(key); found {
+			if d := v.(*loginFailures).NextAttempt.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	g.mu.Unlock()
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for _, lock := range []struct{ typ, key string }{{models.LockoutTypeAccount, username}, {models.LockoutTypeIP, ip}} {
+		lockout, err := g.db.GetActiveLockout(lock.typ, lock.key)
+		if err != nil {
+			return 0, err
+		}
+		if lockout != nil {
+			if d := lockout.LockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait, nil
+}
+
+// Fail 记录一次失败，达到阈值时写入锁定记录
+func (g *loginGuard) Fail(username, ip string) {
+	accountCount := g.increment(accountKey(username), true)
+	ipCount := g.increment(ipKey(ip), false)
+
+	if accountCount == accountLockoutThreshold {
+		lockout := &models.AccountLockout{
+			Type:        models.LockoutTypeAccount,
+			Username:    username,
+			IP:          ip,
+			Failures:    accountCount,
+			LockedUntil: time.Now().Add(lockoutDuration),
+		}
+		if user, err := g.db.GetUserByUsername(username); err == nil && user != nil {
+			lockout.UserID = user.ID
+		}
+		g.lock(accountKey(username), lockout)
+	}
+	if ipCount == ipLockoutThreshold {
+		g.lock(ipKey(ip), &models.AccountLockout{
+			Type:        models.LockoutTypeIP,
+			IP:          ip,
+			Failures:    ipCount,
+			LockedUntil: time.Now().Add(lockoutDuration),
+		})
+	}
+}
+
+// Succeed 登录成功后清除该账号的失败计数
+func (g *loginGuard) Succeed(username string) {
+	g.failures.Delete(accountKey(username))
+}
+
+// Reset 管理员解锁时清除内存中的计数
+func (g *loginGuard) Reset(lockoutType, key string) {
+	if lockoutType == models.LockoutTypeIP {
+		g.failures.Delete(ipKey(key))
+		return
+	}
+	g.failures.Delete(accountKey(key))
+}
+
+func (g *loginGuard) increment(key string, progressive bool) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	record := &loginFailures{}
+	if v, found := g.failures.Get(key); found {
+		record = v.(*loginFailures)
+	}
+	record.Count++
+	if progressive && record.Count >= loginDelayAfter {
+		// 1s、2s、4s……直到上限
+		delay := time.Second << uint(record.Count-loginDelayAfter)
+		if delay > loginMaxDelay || delay <= 0 {
+			delay = loginMaxDelay
+		}
+		record.NextAttempt = time.Now().Add(delay)
+	}
+	g.failures.Set(key, record, cache.DefaultExpiration)
+	return record.Count
+}
+
+func (g *loginGuard) lock(key string, lockout *models.AccountLockout) {
+	log.Printf("登录失败次数过多，锁定 %s 至 %s", key, lockout.LockedUntil.Format(time.RFC3339))
+	if err := g.db.CreateLockout(lockout); err != nil {
+		log.Printf("保存锁定记录失败: %v", err)
+	}
+	g.failures.Delete(key)
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
+)
+
+// GET 未读提及收件箱，room_id 只返回该房间的提及，before 为上一页返回的 nextBefore，limit 为每页条数
+func (hm *HTTPManager) handleMentions(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	if r.Method != http.MethodGet {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("方法不允许"))
+		return
+	}
+
+	params := r.URL.Query()
+	query := database.MentionQuery{UserID: userID}
+	for name, target := range map[string]*uint{"room_id": &query.RoomID, "before": &query.Before} {
+		if value := params.Get(name); value != "" {
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的参数 %s: %s", name, value))
+				return
+			}
+			*target = uint(id)
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的参数 limit: %s", value))
+			return
+		}
+		query.Limit = limit
+	}
+
+	inbox, err := hm.dbManager.GetMentions(query)
+	if err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, inbox, nil)
+}
+
+// POST 把指定的提及标记为已读，请求体为 {"ids": [...]}。用户的其他设备会收到 mentionsRead 事件
+func (hm *HTTPManager) handleMentionsRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("方法不允许"))
+		return
+	}
+
+	var request struct {
+		IDs []uint `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+		return
+	}
+	count, err := hm.dbManager.MarkMentionsRead(userID, request.IDs)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, map[string]int64{"read": count}, nil)
+}
@@ -0,0 +1,211 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/gorilla/mux"
+)
+
+// 历史消息查询错误对应的 HTTP 状态码
+func historyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidCursor), errors.Is(err, database.ErrInvalidConversation),
+		errors.Is(err, database.ErrConflictingCursors):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrMessageNotFound):
+		return http.StatusNotFound
+	default:
+		return roomErrorStatus(err)
+	}
+}
+
+// GET 单个会话的历史消息，peer_id（单聊）或 room_id（群聊）指定会话，
+// before、after 为上一页返回的游标，around 为消息 msgId，limit 为每页条数，
+// hide_thread_replies=true 时不返回话题中的回复
+func (hm *HTTPManager) handleMessageHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	if r.Method != http.MethodGet {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("方法不允许"))
+		return
+	}
+
+	params := r.URL.Query()
+	query, err := historyQueryFromParams(userID, params)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	query.HideThreadReplies = params.Get("hide_thread_replies") == "true"
+	for name, target := range map[string]*uint{"peer_id": &query.PeerID, "room_id": &query.RoomID} {
+		if value := params.Get(name); value != "" {
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的参数 %s: %s", name, value))
+				return
+			}
+			*target = uint(id)
+		}
+	}
+
+	history, err := hm.dbManager.GetMessageHistory(query)
+	if err != nil {
+		sendJSONResponse(w, historyErrorStatus(err), nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, history, nil)
+}
+
+// 解析分页参数 before、after、around 和 limit
+func historyQueryFromParams(userID uint, params url.Values) (database.HistoryQuery, error) {
+	query := database.HistoryQuery{
+		UserID: userID,
+		Before: params.Get("before"),
+		After:  params.Get("after"),
+		Around: params.Get("around"),
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return query, fmt.Errorf("无效的参数 limit: %s", value)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+// GET 话题的根消息和一页回复，分页参数与历史消息相同
+func (hm *HTTPManager) handleMessageThread(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	query, err := historyQueryFromParams(userID, r.URL.Query())
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	thread, err := hm.dbManager.GetThread(mux.Vars(r)["msgId"], query)
+	if err != nil {
+		sendJSONResponse(w, messageErrorStatus(err), nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, thread, nil)
+}
+
+// 编辑、撤回消息错误对应的 HTTP 状态码
+func messageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrEmptyMessage), errors.Is(err, database.ErrInvalidEmoji),
+		errors.Is(err, database.ErrInvalidReply), errors.Is(err, database.ErrInvalidMention),
+		errors.Is(err, database.ErrInvalidMentionScope):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrNotMessageSender), errors.Is(err, database.ErrEditWindowExpired),
+		errors.Is(err, database.ErrRecallWindowExpired):
+		return http.StatusForbidden
+	case errors.Is(err, database.ErrMessageRecalled):
+		return http.StatusConflict
+	default:
+		return historyErrorStatus(err)
+	}
+}
+
+// PUT 编辑消息，DELETE 撤回消息。会话参与者的所有设备会收到 messageEdited 或 messageRecalled 事件
+func (hm *HTTPManager) handleMessageByID(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	msgID := mux.Vars(r)["msgId"]
+	cfg := hm.baseInstance.Cfg
+
+	switch r.Method {
+	case http.MethodPut:
+		var request struct {
+			Text          map[string]interface{} `json:"text"`
+			MentionIDList []uint                 `json:"mentionIdList"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+			return
+		}
+		message, err := hm.dbManager.EditMessage(userID, msgID, request.Text, request.MentionIDList, cfg.MessageEditWindow)
+		if err != nil {
+			sendJSONResponse(w, messageErrorStatus(err), nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, message, nil)
+	case http.MethodDelete:
+		tombstone, err := hm.dbManager.RecallMessage(userID, msgID, cfg.MessageRecallWindow)
+		if err != nil {
+			sendJSONResponse(w, messageErrorStatus(err), nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, tombstone, nil)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, errors.New("方法不允许"))
+	}
+}
+
+// GET 消息的编辑历史
+func (hm *HTTPManager) handleMessageEdits(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	edits, err := hm.dbManager.GetMessageEdits(userID, mux.Vars(r)["msgId"])
+	if err != nil {
+		sendJSONResponse(w, messageErrorStatus(err), nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, edits, nil)
+}
+
+// POST 添加表情回应，DELETE 取消表情回应，请求体为 {"emoji": 表情}。
+// 回应人数有变化时会话参与者会收到 reactionAdded 或 reactionRemoved 事件
+func (hm *HTTPManager) handleMessageReactions(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var request struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+		return
+	}
+
+	msgID := mux.Vars(r)["msgId"]
+	var delta *database.ReactionDelta
+	switch r.Method {
+	case http.MethodPost:
+		delta, err = hm.dbManager.AddReaction(userID, msgID, request.Emoji)
+	case http.MethodDelete:
+		delta, err = hm.dbManager.RemoveReaction(userID, msgID, request.Emoji)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, errors.New("方法不允许"))
+		return
+	}
+	if err != nil {
+		sendJSONResponse(w, messageErrorStatus(err), nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, delta, nil)
+}
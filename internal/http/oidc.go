@@ -0,0 +1,258 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/internal/oidc"
+	"github.com/Ireoo/sixin-server/models"
+)
+
+// 授权请求的有效期，超时后回调中的 state 失效
+const oidcStateTTL = 10 * time.Minute
+
+// 发起授权请求时保存的状态，回调时按 state 取出并删除
+type oidcState struct {
+	Nonce        string
+	CodeVerifier string
+	Device       models.Session
+}
+
+func (hm *HTTPManager) newOIDCProvider() *oidc.Provider {
+	cfg := hm.baseInstance.Cfg
+	if cfg == nil || cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       cfg.OIDCIssuer,
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: cfg.OIDCClientSecret,
+		RedirectURL:  cfg.OIDCRedirectURL,
+		Scopes:       cfg.OIDCScopes,
+	})
+}
+
+// 跳转到 OIDC 提供方登录；请求头 Accept 为 JSON 时返回授权地址，由前端自行跳转
+func (hm *HTTPManager) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if hm.oidcProvider == nil {
+		sendJSONResponse(w, http.StatusNotFound, nil, fmt.Errorf("未启用 OIDC 登录"))
+		return
+	}
+
+	state, err := oidc.GenerateRandom()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	nonce, err := oidc.GenerateRandom()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	verifier, err := oidc.GenerateRandom()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	authURL, err := hm.oidcProvider.AuthCodeURL(r.Context(), state, nonce, oidc.S256Challenge(verifier))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadGateway, nil, err)
+		return
+	}
+
+	hm.oidcStates.Set(state, &oidcState{
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		Device:       sessionDevice(r),
+	}, oidcStateTTL)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		sendJSONResponse(w, http.StatusOK, map[string]string{"authorization_url": authURL}, nil)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// 提供方回调：校验 state，用授权码换取 ID Token 并校验，然后登录或创建本地用户
+func (hm *HTTPManager) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if hm.oidcProvider == nil {
+		sendJSONResponse(w, http.StatusNotFound, nil, fmt.Errorf("未启用 OIDC 登录"))
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, fmt.Errorf("OIDC 登录失败: %s %s", errCode, query.Get("error_description")))
+		return
+	}
+
+	stateKey := query.Get("state")
+	cached, found := hm.oidcStates.Get(stateKey)
+	if stateKey == "" || !found {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("登录请求无效或已过期，请重新登录"))
+		return
+	}
+	// state 只能使用一次
+	hm.oidcStates.Delete(stateKey)
+	state := cached.(*oidcState)
+
+	code := query.Get("code")
+	if code == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("缺少授权码"))
+		return
+	}
+
+	token, err := hm.oidcProvider.Exchange(r.Context(), code, state.CodeVerifier)
+	if err != nil {
+		log.Printf("OIDC 授权码换取令牌失败: %v", err)
+		sendJSONResponse(w, http.StatusUnauthorized, nil, fmt.Errorf("OIDC 登录失败"))
+		return
+	}
+	claims, err := hm.oidcProvider.VerifyIDToken(r.Context(), token.IDToken, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC ID Token 校验失败: %v", err)
+		sendJSONResponse(w, http.StatusUnauthorized, nil, fmt.Errorf("OIDC 登录失败"))
+		return
+	}
+
+	user, err := hm.resolveOIDCUser(r, claims)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	if user.TOTPEnabled {
+		challenge, err := middleware.GenerateMFAChallenge(user.ID)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("生成挑战令牌失败"))
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"mfa_required":    true,
+			"challenge_token": challenge,
+		}, nil)
+		return
+	}
+
+	tokens, err := hm.createSessionForDevice(user.ID, state.Device)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	hm.auditLogin(r, user.ID, tokens, "oidc")
+
+	sendJSONResponse(w, http.StatusOK, tokens, nil)
+}
+
+// 查找外部身份绑定的用户；未绑定时按已验证邮箱关联已激活的账号，否则自动创建新用户
+func (hm *HTTPManager) resolveOIDCUser(r *http.Request, claims *oidc.IDTokenClaims) (*models.User, error) {
+	provider := hm.oidcProvider.Issuer()
+
+	user, err := hm.dbManager.GetUserByIdentity(provider, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		return user, nil
+	}
+
+	identity := &models.UserIdentity{
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+
+	// 只信任提供方已验证的邮箱，并且只关联已激活且本地也验证过该邮箱的账号。
+	// 未验证的账号可能是他人抢先用该邮箱注册的，关联后注册者仍可用自己的密码登录
+	emailVerified := claims.Email != "" && claims.EmailVerified
+	emailTaken := false
+	if emailVerified {
+		existing, err := hm.dbManager.GetUserByEmail(claims.Email)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil && existing.Status == models.UserStatusActive && existing.EmailVerifiedAt != nil {
+			if err := hm.dbManager.LinkIdentity(existing, identity); err != nil {
+				return nil, err
+			}
+			return existing, nil
+		}
+		emailTaken = existing != nil
+	}
+
+	username, err := hm.availableUsername(claims)
+	if err != nil {
+		return nil, err
+	}
+	wechatID, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	// 外部账号没有本地密码，需要时可通过找回密码设置
+	user = &models.User{
+		Username: username,
+		WechatID: "oidc_" + wechatID,
+		Name:     claims.Name,
+		Avatar:   claims.Picture,
+		Status:   models.UserStatusActive,
+	}
+	// 邮箱已被未验证的账号占用时，新用户不设置邮箱，避免同一邮箱对应多个账号
+	if emailVerified && !emailTaken {
+		now := time.Now()
+		user.Email = claims.Email
+		user.EmailVerifiedAt = &now
+	}
+
+	if err := hm.dbManager.CreateUserWithIdentity(user, identity); err != nil {
+		return nil, err
+	}
+	ac := auditContext(r)
+	ac.ActorID = user.ID
+	hm.dbManager.Audit(ac, models.AuditLog{Action: models.AuditRegister, TargetType: models.AuditTargetUser, TargetID: user.ID},
+		nil, map[string]string{"username": user.Username, "provider": identity.Provider})
+	return user, nil
+}
+
+// 依次尝试 preferred_username 和邮箱前缀，重名时追加随机后缀
+func (hm *HTTPManager) availableUsername(claims *oidc.IDTokenClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		existing, err := hm.dbManager.GetUserByUsername(candidate)
+		if err != nil {
+			return "", err
+		}
+		if existing == nil {
+			return candidate, nil
+		}
+		suffix, err := randomHex(2)
+		if err != nil {
+			return "", err
+		}
+		candidate = base + "_" + suffix
+	}
+	return "", fmt.Errorf("无法生成可用的用户名")
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/oidc"
+	"github.com/Ireoo/sixin-server/models"
+)
+
+func newOIDCTestManager(t *testing.T) *HTTPManager {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	dm, err := database.NewDatabaseManager(database.SQLite, fmt.Sprintf("file:%s?mode=memory&cache=shared", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := dm.DB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return &HTTPManager{
+		dbManager:    dm,
+		oidcProvider: oidc.NewProvider(oidc.Config{Issuer: "https://idp.example", ClientID: "sixin"}),
+	}
+}
+
+// 外部身份按已验证邮箱关联本地账号的规则：只关联已激活且本地验证过邮箱的账号，
+// 其他情况创建新用户，并且不改变原账号的状态
+func TestResolveOIDCUserEmailLinking(t *testing.T) {
+	verifiedAt := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name          string
+		local         *models.User
+		emailVerified bool
+		wantLinked    bool
+		wantEmail     string // 新建用户的邮箱
+	}{
+		{"no local account", nil, true, false, "alice@example.com"},
+		{"active verified account", &models.User{Status: models.UserStatusActive, EmailVerifiedAt: &verifiedAt}, true, true, ""},
+		{"pending account", &models.User{Status: models.UserStatusPending, Password: "attacker"}, true, false, ""},
+		{"active unverified account", &models.User{Status: models.UserStatusActive}, true, false, ""},
+		{"email not verified by provider", &models.User{Status: models.UserStatusActive, EmailVerifiedAt: &verifiedAt}, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hm := newOIDCTestManager(t)
+			if tt.local != nil {
+				tt.local.Username, tt.local.WechatID, tt.local.Email = "local", "local", "alice@example.com"
+				if err := hm.dbManager.DB.Create(tt.local).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			claims := &oidc.IDTokenClaims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: tt.emailVerified, PreferredUsername: "alice"}
+			r := httptest.NewRequest("GET", "/api/oidc/callback", nil)
+			user, err := hm.resolveOIDCUser(r, claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			linked := tt.local != nil && user.ID == tt.local.ID
+			if linked != tt.wantLinked {
+				t.Fatalf("linked = %v, want %v", linked, tt.wantLinked)
+			}
+			if !tt.wantLinked && user.Email != tt.wantEmail {
+				t.Errorf("new user email = %q, want %q", user.Email, tt.wantEmail)
+			}
+
+			if tt.local != nil {
+				stored, err := hm.dbManager.GetUserInfo(tt.local.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Status != tt.local.Status || (stored.EmailVerifiedAt == nil) != (tt.local.EmailVerifiedAt == nil) {
+					t.Errorf("local account changed: status %q, verified %v", stored.Status, stored.EmailVerifiedAt)
+				}
+			}
+
+			// 再次登录返回绑定的同一个用户
+			again, err := hm.resolveOIDCUser(r, claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.ID != user.ID {
+				t.Errorf("second login resolved user %d, want %d", again.ID, user.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/gorilla/mux"
+)
+
+// 限流键：已认证的请求按用户计数，否则按客户端 IP 计数
+func rateLimitKey(r *http.Request) string {
+	if userID, err := middleware.GetUserIDFromContext(r.Context()); err == nil {
+		return fmt.Sprintf("user:%d", userID)
+	}
+	return "ip:" + middleware.ClientIP(r)
+}
+
+// 按路由策略检查请求，被限流时返回 429 和 Retry-After，并返回 false
+func (hm *HTTPManager) allowRequest(w http.ResponseWriter, r *http.Request, route string) bool {
+	allowed, wait := hm.baseInstance.RateLimiter.Allow(rateLimitKey(r), route, "http")
+	if !allowed {
+		sendRetryAfter(w, wait)
+	}
+	return allowed
+}
+
+// 限流中间件，策略名称为路由模板，受保护路由需挂在认证中间件之后才能按用户计数
+func (hm *HTTPManager) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		if hm.allowRequest(w, r, route) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
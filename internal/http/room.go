@@ -0,0 +1,162 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/models"
+	"github.com/gorilla/mux"
+)
+
+// 房间操作错误对应的 HTTP 状态码：权限不足 403，房间或成员不存在 404
+func roomErrorStatus(err error) int {
+	switch {
+	case database.IsPermissionError(err), errors.Is(err, database.ErrOwnerCannotLeave):
+		return http.StatusForbidden
+	case errors.Is(err, database.ErrRoomNotFound), errors.Is(err, database.ErrNotRoomMember):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrAlreadyRoomMember):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// 创建房间，创建者成为房主
+func (hm *HTTPManager) handleCreateRoom(w http.ResponseWriter, r *http.Request, userID uint) {
+	var roomData struct {
+		Name   string `json:"name"`
+		Avatar string `json:"avatar"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&roomData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+		return
+	}
+	if roomData.Name == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("房间名称不能为空"))
+		return
+	}
+
+	room := &models.Room{Name: roomData.Name, Avatar: roomData.Avatar, OwnerID: userID}
+	if err := hm.dbManager.CreateRoom(room); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "创建房间失败"}, err)
+		return
+	}
+	hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditRoomCreate, TargetType: models.AuditTargetRoom, TargetID: room.ID, RoomID: room.ID},
+		nil, map[string]string{"name": room.Name, "avatar": room.Avatar})
+	sendJSONResponse(w, http.StatusOK, room, nil)
+}
+
+// POST 设置管理员，DELETE 取消管理员，只有房主可以操作
+func (hm *HTTPManager) handleRoomAdmins(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	roomID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	var adminData struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&adminData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+		return
+	}
+
+	if _, err := hm.dbManager.CheckRoomPermission(userID, uint(roomID), database.ActionManageAdmins); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+	if adminData.UserID == userID {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("不能修改房主自己的角色"))
+		return
+	}
+
+	isAdmin := r.Method == http.MethodPost
+	if err := hm.dbManager.SetRoomAdmin(uint(roomID), adminData.UserID, isAdmin); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+	action := models.AuditRoomAdminRemove
+	if isAdmin {
+		action = models.AuditRoomAdminAdd
+	}
+	hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: action, TargetType: models.AuditTargetUser, TargetID: adminData.UserID, RoomID: uint(roomID)}, nil, nil)
+
+	message := "已取消管理员"
+	if isAdmin {
+		message = "已设置为管理员"
+	}
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": message}, nil)
+}
+
+// GET 置顶消息列表（成员可见），POST 置顶、DELETE 取消置顶需要置顶权限
+func (hm *HTTPManager) handleRoomPins(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	roomID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if err := hm.dbManager.CheckUserRoom(userID, uint(roomID)); err != nil {
+			sendJSONResponse(w, roomErrorStatus(err), nil, err)
+			return
+		}
+		pinned, err := hm.dbManager.GetPinnedMessages(uint(roomID))
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, pinned, nil)
+		return
+	}
+
+	var pinData struct {
+		MsgID string `json:"msg_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&pinData); err != nil || pinData.MsgID == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("缺少消息ID"))
+		return
+	}
+
+	if _, err := hm.dbManager.CheckRoomPermission(userID, uint(roomID), database.ActionPin); err != nil {
+		sendJSONResponse(w, roomErrorStatus(err), nil, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		pinned, err := hm.dbManager.PinMessage(uint(roomID), pinData.MsgID, userID)
+		if err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, pinned, nil)
+	case http.MethodDelete:
+		if err := hm.dbManager.UnpinMessage(uint(roomID), pinData.MsgID); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, map[string]string{"message": "已取消置顶"}, nil)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("方法不允许"))
+	}
+}
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/models"
+	"github.com/gorilla/mux"
+)
+
+// 定时消息错误对应的 HTTP 状态码
+func scheduledErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidSendTime):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrScheduledNotFound), errors.Is(err, database.ErrPeerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrScheduledNotPending), errors.Is(err, database.ErrTooManyScheduled),
+		errors.Is(err, database.ErrDuplicateMsgID):
+		return http.StatusConflict
+	default:
+		return messageErrorStatus(err)
+	}
+}
+
+// GET 列出尚未发送成功的定时消息，POST 创建定时消息，请求体与发送消息相同，另加 sendAt（RFC 3339 时间）。
+// 作者的所有设备会收到 scheduledMessageUpdated 事件
+func (hm *HTTPManager) handleScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		scheduled, err := hm.dbManager.ListScheduledMessages(userID)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, scheduled, nil)
+	case http.MethodPost:
+		var scheduled models.ScheduledMessage
+		if err := json.NewDecoder(r.Body).Decode(&scheduled); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+			return
+		}
+		scheduled.UserID = userID
+		cfg := hm.baseInstance.Cfg
+		if err := hm.dbManager.CreateScheduledMessage(&scheduled, cfg.ScheduledMessageMaxDelay, cfg.ScheduledMessageMaxPending); err != nil {
+			sendJSONResponse(w, scheduledErrorStatus(err), nil, err)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, scheduled, nil)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("方法不允许"))
+	}
+}
+
+// PUT 修改待发送的定时消息，可修改 text、mentionIdList 和 sendAt；DELETE 取消定时消息
+func (hm *HTTPManager) handleScheduledMessageByID(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	var scheduled *models.ScheduledMessage
+	switch r.Method {
+	case http.MethodPut:
+		var update database.ScheduledMessageUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, map[string]string{"message": "无效的请求数据"}, err)
+			return
+		}
+		scheduled, err = hm.dbManager.UpdateScheduledMessage(userID, uint(id), update, hm.baseInstance.Cfg.ScheduledMessageMaxDelay)
+	case http.MethodDelete:
+		scheduled, err = hm.dbManager.CancelScheduledMessage(userID, uint(id))
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("方法不允许"))
+		return
+	}
+	if err != nil {
+		sendJSONResponse(w, scheduledErrorStatus(err), nil, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, scheduled, nil)
+}
@@ -0,0 +1,48 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Ireoo/sixin-server/internal/middleware"
+)
+
+// GET 增量同步：返回序号 since 之后的好友、房间和成员设置变化，
+// 客户端落后太多时返回 resync 和全量快照
+func (hm *HTTPManager) handleSync(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	if r.Method != http.MethodGet {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("方法不允许"))
+		return
+	}
+
+	params := r.URL.Query()
+	var since uint64
+	if value := params.Get("since"); value != "" {
+		if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的参数 since: %s", value))
+			return
+		}
+	}
+	var limit int
+	if value := params.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的参数 limit: %s", value))
+			return
+		}
+	}
+
+	// 会话 ID 用于记录该设备的确认进度，获取失败时只返回数据不确认
+	sessionID, _ := middleware.GetSessionIDFromContext(r.Context())
+	result, err := hm.dbManager.Sync(userID, sessionID, since, limit)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, map[string]string{"message": "同步失败"}, err)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, result, nil)
+}
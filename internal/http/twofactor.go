@@ -0,0 +1,297 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
+	"github.com/Ireoo/sixin-server/internal/totp"
+	"github.com/Ireoo/sixin-server/models"
+)
+
+const (
+	recoveryCodeCount = 10
+	// 每个挑战令牌允许提交第二因素的最大次数
+	maxMFAAttempts = 5
+)
+
+var errSecondFactorInvalid = errors.New("验证码不正确")
+
+// 校验 TOTP 验证码或恢复码，两者传一个即可
+func (hm *HTTPManager) verifySecondFactor(user *models.User, code, recoveryCode string) error {
+	switch {
+	case code != "":
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return errSecondFactorInvalid
+		}
+		if err := hm.dbManager.UseTOTPStep(user.ID, step); err != nil {
+			if errors.Is(err, database.ErrTOTPCodeReused) {
+				return err
+			}
+			return fmt.Errorf("保存验证状态失败: %v", err)
+		}
+		return nil
+	case recoveryCode != "":
+		if _, err := hm.dbManager.ConsumeRecoveryCode(user.ID, recoveryCode); err != nil {
+			if errors.Is(err, database.ErrVerificationInvalid) {
+				return errSecondFactorInvalid
+			}
+			return err
+		}
+		return nil
+	default:
+		return errSecondFactorInvalid
+	}
+}
+
+// 占用挑战令牌的一次提交机会，先计数再校验，并发提交时也不会超过 maxMFAAttempts
+func (hm *HTTPManager) takeMFAAttempt(challengeID string, ttl time.Duration) bool {
+	if err := hm.mfaAttempts.Add(challengeID, 1, ttl); err == nil {
+		return true
+	}
+	count, err := hm.mfaAttempts.IncrementInt(challengeID, 1)
+	return err == nil && count <= maxMFAAttempts
+}
+
+// 两步验证登录的第二步：提交挑战令牌和验证码，通过后才创建会话
+func (hm *HTTPManager) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var mfaData struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&mfaData); err != nil || mfaData.ChallengeToken == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+
+	claims, err := middleware.ValidateMFAChallenge(mfaData.ChallengeToken)
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, fmt.Errorf("挑战令牌无效或已过期，请重新登录"))
+		return
+	}
+
+	user, err := hm.dbManager.GetUserInfo(claims.UserID)
+	if err != nil || user.ID == 0 || !user.TOTPEnabled {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, fmt.Errorf("挑战令牌无效或已过期，请重新登录"))
+		return
+	}
+
+	// 与密码登录共用失败计数：换新的挑战令牌继续猜测同样会被递增等待和锁定
+	ip := middleware.ClientIP(r)
+	wait, err := hm.loginGuard.Check(user.Username, ip)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	if wait > 0 {
+		sendRetryAfter(w, wait)
+		return
+	}
+
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+	if !hm.takeMFAAttempt(claims.Id, ttl) {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, fmt.Errorf("挑战令牌无效或已过期，请重新登录"))
+		return
+	}
+
+	if err := hm.verifySecondFactor(&user, mfaData.Code, mfaData.RecoveryCode); err != nil {
+		if errors.Is(err, errSecondFactorInvalid) || errors.Is(err, database.ErrTOTPCodeReused) {
+			hm.loginGuard.Fail(user.Username, ip)
+		}
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	hm.loginGuard.Succeed(user.Username)
+
+	// 挑战令牌只能成功使用一次
+	hm.mfaAttempts.Set(claims.Id, maxMFAAttempts, ttl)
+
+	tokens, err := hm.createSession(r, user.ID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	hm.auditLogin(r, user.ID, tokens, "password+2fa")
+
+	sendJSONResponse(w, http.StatusOK, tokens, nil)
+}
+
+func (hm *HTTPManager) currentUser(r *http.Request) (*models.User, error) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	user, err := hm.dbManager.GetUserInfo(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GET 查询两步验证状态
+func (hm *HTTPManager) handleTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := hm.currentUser(r)
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"enabled":                  user.TOTPEnabled,
+		"recovery_codes_remaining": len(user.RecoveryCodes),
+	}, nil)
+}
+
+// 生成新的 TOTP 密钥，返回密钥和 otpauth 地址，需调用 enable 确认后才生效
+func (hm *HTTPManager) handleTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	user, err := hm.currentUser(r)
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+	if user.TOTPEnabled {
+		sendJSONResponse(w, http.StatusConflict, nil, fmt.Errorf("两步验证已启用"))
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("生成密钥失败"))
+		return
+	}
+	if err := hm.dbManager.SetTOTPSecret(user.ID, secret); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.ProvisioningURI(hm.baseInstance.Cfg.TOTPIssuer, user.Username, secret),
+	}, nil)
+}
+
+// 提交验证器中的验证码确认启用，返回一次性恢复码（只显示这一次）
+func (hm *HTTPManager) handleTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	user, err := hm.currentUser(r)
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var enableData struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&enableData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+	if user.TOTPEnabled {
+		sendJSONResponse(w, http.StatusConflict, nil, fmt.Errorf("两步验证已启用"))
+		return
+	}
+	if user.TOTPSecret == "" {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("请先获取两步验证密钥"))
+		return
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, enableData.Code, time.Now())
+	if !ok {
+		sendJSONResponse(w, http.StatusBadRequest, nil, errSecondFactorInvalid)
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("生成恢复码失败"))
+		return
+	}
+	if err := hm.dbManager.EnableTOTP(user.ID, step, codes); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditTwoFactorEnable, TargetType: models.AuditTargetUser, TargetID: user.ID}, nil, nil)
+
+	sendJSONResponse(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes}, nil)
+}
+
+// 关闭两步验证，需要同时提供密码和第二因素
+func (hm *HTTPManager) handleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	user, err := hm.currentUser(r)
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var disableData struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&disableData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+	if !user.TOTPEnabled {
+		sendJSONResponse(w, http.StatusConflict, nil, fmt.Errorf("两步验证未启用"))
+		return
+	}
+	if _, err := hm.dbManager.AuthenticateUser(user.Username, disableData.Password); err != nil {
+		sendJSONResponse(w, http.StatusForbidden, nil, fmt.Errorf("密码不正确"))
+		return
+	}
+	if err := hm.verifySecondFactor(user, disableData.Code, disableData.RecoveryCode); err != nil {
+		sendJSONResponse(w, http.StatusForbidden, nil, err)
+		return
+	}
+
+	if err := hm.dbManager.DisableTOTP(user.ID); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	hm.dbManager.Audit(auditContext(r), models.AuditLog{Action: models.AuditTwoFactorDisable, TargetType: models.AuditTargetUser, TargetID: user.ID}, nil, nil)
+
+	sendJSONResponse(w, http.StatusOK, map[string]string{"message": "两步验证已关闭"}, nil)
+}
+
+// 重新生成恢复码，旧恢复码全部作废
+func (hm *HTTPManager) handleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, err := hm.currentUser(r)
+	if err != nil {
+		sendJSONResponse(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var regenData struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&regenData); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, nil, fmt.Errorf("无效的请求数据"))
+		return
+	}
+	if !user.TOTPEnabled {
+		sendJSONResponse(w, http.StatusConflict, nil, fmt.Errorf("两步验证未启用"))
+		return
+	}
+	if err := hm.verifySecondFactor(user, regenData.Code, ""); err != nil {
+		sendJSONResponse(w, http.StatusForbidden, nil, err)
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, fmt.Errorf("生成恢复码失败"))
+		return
+	}
+	if err := hm.dbManager.ReplaceRecoveryCodes(user.ID, codes); err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes}, nil)
+}
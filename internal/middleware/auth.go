@@ -2,41 +2,128 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/Ireoo/sixin-server/config"
 	"github.com/dgrijalva/jwt-go"
 )
 
-var jwtSecret = []byte("your_secret_key")
-
 type Claims struct {
-	UserID uint `json:"user_id"`
+	UserID    uint   `json:"user_id"`
+	SessionID uint   `json:"sid"`
+	Purpose   string `json:"pur,omitempty"` // 非空表示专用令牌（如两步验证挑战），不能作为访问令牌使用
 	jwt.StandardClaims
 }
 
-// 生成 JWT
-func GenerateJWT(userID uint) (string, error) {
-	expirationTime := time.Now().Add(7 * 24 * time.Hour)
+const (
+	PurposeMFAChallenge = "mfa"
+	// 两步验证挑战令牌有效期
+	mfaChallengeTTL = 5 * time.Minute
+)
+
+// SessionStore 用于检查访问令牌所属会话是否仍然有效
+type SessionStore interface {
+	IsSessionActive(sessionID uint) (bool, error)
+}
+
+var (
+	sessionStore   SessionStore
+	accessTokenTTL = 15 * time.Minute
+)
+
+// InitAuth 初始化密钥环、访问令牌有效期和会话存储
+func InitAuth(cfg *config.Config, store SessionStore) error {
+	if err := InitKeyRing(cfg); err != nil {
+		return err
+	}
+	if cfg.AccessTokenTTL > 0 {
+		accessTokenTTL = cfg.AccessTokenTTL
+	}
+	sessionStore = store
+	return nil
+}
+
+// AccessTokenTTL 返回访问令牌有效期
+func AccessTokenTTL() time.Duration {
+	return accessTokenTTL
+}
+
+// 生成 JWT，使用密钥环中的当前签名密钥，并绑定到会话
+func GenerateJWT(userID, sessionID uint) (string, error) {
+	if keyRing == nil {
+		return "", errors.New("JWT 密钥环未初始化")
+	}
+
+	now := time.Now()
 	claims := &Claims{
-		UserID: userID,
+		UserID:    userID,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			ExpiresAt: now.Add(accessTokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return keyRing.Sign(claims)
 }
 
-// 验证 JWT
-func ValidateJWT(tokenString string) (*Claims, error) {
+// 生成不透明的刷新令牌，服务端只保存其哈希
+func GenerateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// 生成两步验证挑战令牌，密码验证通过后下发，只能用于提交第二因素
+func GenerateMFAChallenge(userID uint) (string, error) {
+	if keyRing == nil {
+		return "", errors.New("JWT 密钥环未初始化")
+	}
+
+	jti, err := GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &Claims{
+		UserID:  userID,
+		Purpose: PurposeMFAChallenge,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			ExpiresAt: now.Add(mfaChallengeTTL).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+	}
+
+	return keyRing.Sign(claims)
+}
+
+// 验证两步验证挑战令牌
+func ValidateMFAChallenge(tokenString string) (*Claims, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != PurposeMFAChallenge {
+		return nil, errors.New("invalid challenge token")
+	}
+	return claims, nil
+}
+
+func parseJWT(tokenString string) (*Claims, error) {
+	if keyRing == nil {
+		return nil, errors.New("JWT 密钥环未初始化")
+	}
+
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyRing.Keyfunc)
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
 			return nil, errors.New("invalid token signature")
@@ -49,6 +136,31 @@ func ValidateJWT(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
+// 验证 JWT，按 kid 在密钥环中查找验证密钥，并拒绝已撤销会话的令牌
+func ValidateJWT(tokenString string) (*Claims, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Purpose != "" {
+		return nil, errors.New("token cannot be used for access")
+	}
+	if claims.SessionID == 0 {
+		return nil, errors.New("token is not bound to a session")
+	}
+	if sessionStore != nil {
+		active, err := sessionStore.IsSessionActive(claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			return nil, errors.New("session revoked")
+		}
+	}
+	return claims, nil
+}
+
 // 提取并验证 Authorization 头中的 JWT
 func ExtractJWTFromHeader(r *http.Request) (*Claims, error) {
 	authHeader := r.Header.Get("Authorization")
@@ -68,9 +180,10 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		// 添加用户 ID 到上下文中
+		// 添加用户 ID 和会话 ID 到上下文中
 		ctx := r.Context()
-		ctx = context.WithValue(ctx, contextKey("user_id"), claims.UserID)
+		ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, SessionIDKey, claims.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -87,7 +200,10 @@ func ValidateToken(token string) (uint, error) {
 // 用于从上下文中获取用户 ID 的键
 type contextKey string
 
-const UserIDKey contextKey = "user_id"
+const (
+	UserIDKey    contextKey = "user_id"
+	SessionIDKey contextKey = "session_id"
+)
 
 // 从上下文中获取用户 ID
 func GetUserIDFromContext(ctx context.Context) (uint, error) {
@@ -97,3 +213,12 @@ func GetUserIDFromContext(ctx context.Context) (uint, error) {
 	}
 	return userID, nil
 }
+
+// 从上下文中获取会话 ID
+func GetSessionIDFromContext(ctx context.Context) (uint, error) {
+	sessionID, ok := ctx.Value(SessionIDKey).(uint)
+	if !ok {
+		return 0, errors.New("session ID not found in context")
+	}
+	return sessionID, nil
+}
@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Ireoo/sixin-server/config"
+	"github.com/Ireoo/sixin-server/logger"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWTKey 密钥环中的一个密钥
+type JWTKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{} // 为 nil 时该密钥只能用于验证
+	VerifyKey interface{}
+}
+
+// KeyRing 保存签名密钥和所有仍然有效的验证密钥，支持密钥轮换
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[string]*JWTKey
+	signing *JWTKey
+}
+
+// 全局密钥环，HTTP 和 socket.io 共用
+var keyRing *KeyRing
+
+// InitKeyRing 根据配置初始化全局密钥环
+func InitKeyRing(cfg *config.Config) error {
+	specs := cfg.JWTKeys
+	signingKeyID := cfg.JWTSigningKeyID
+	if len(specs) == 0 {
+		// 未配置密钥时生成临时密钥，重启后已签发的 token 全部失效
+		logger.Error("警告: 未配置 JWT 密钥 (jwt-keys)，使用随机生成的临时密钥")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("生成临时密钥失败: %w", err)
+		}
+		signingKeyID = "ephemeral"
+		specs = []string{fmt.Sprintf("%s:HS256:%s", signingKeyID, base64.RawURLEncoding.EncodeToString(secret))}
+	}
+
+	ring, err := NewKeyRing(signingKeyID, specs)
+	if err != nil {
+		return err
+	}
+	keyRing = ring
+	return nil
+}
+
+// NewKeyRing 根据 "kid:算法:密钥材料" 格式的密钥描述创建密钥环
+func NewKeyRing(signingKeyID string, specs []string) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[string]*JWTKey)}
+	for _, spec := range specs {
+		key, err := parseKeySpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := kr.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := kr.SetSigningKey(signingKeyID); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// AddKey 添加一个密钥，已存在的 kid 会被覆盖
+func (kr *KeyRing) AddKey(key *JWTKey) error {
+	if key.ID == "" {
+		return errors.New("密钥 ID 不能为空")
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[key.ID] = key
+	return nil
+}
+
+// RemoveKey 移除一个验证密钥，当前签名密钥不能移除
+func (kr *KeyRing) RemoveKey(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.signing != nil && kr.signing.ID == kid {
+		return fmt.Errorf("不能移除当前签名密钥: %s", kid)
+	}
+	delete(kr.keys, kid)
+	return nil
+}
+
+// SetSigningKey 切换用于签发 token 的密钥
+func (kr *KeyRing) SetSigningKey(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	key, ok := kr.keys[kid]
+	if !ok {
+		return fmt.Errorf("未找到签名密钥: %s", kid)
+	}
+	if key.SignKey == nil {
+		return fmt.Errorf("密钥 %s 只能用于验证，不能用于签名", kid)
+	}
+	kr.signing = key
+	return nil
+}
+
+// Sign 使用当前签名密钥签发 token，并在头部写入 kid
+func (kr *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	kr.mu.RLock()
+	key := kr.signing
+	kr.mu.RUnlock()
+	if key == nil {
+		return "", errors.New("未配置签名密钥")
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.SignKey)
+}
+
+// Keyfunc 根据 token 头部的 kid 查找验证密钥，并要求算法与密钥一致
+func (kr *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token 缺少 kid")
+	}
+
+	kr.mu.RLock()
+	key, ok := kr.keys[kid]
+	kr.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("未知的密钥 ID: %s", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("签名算法不匹配: %s", token.Method.Alg())
+	}
+	return key.VerifyKey, nil
+}
+
+// JWKS 返回非对称密钥的公钥集合 (RFC 7517)，供其他服务验证 token
+func (kr *KeyRing) JWKS() map[string]interface{} {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	keys := make([]map[string]string, 0, len(kr.keys))
+	for _, key := range kr.keys {
+		jwk := map[string]string{
+			"kid": key.ID,
+			"alg": key.Method.Alg(),
+			"use": "sig",
+		}
+		switch pub := key.VerifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			// 对称密钥不能公开
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// GetKeyRing 返回全局密钥环
+func GetKeyRing() *KeyRing {
+	return keyRing
+}
+
+func parseKeySpec(spec string) (*JWTKey, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("无效的密钥配置，格式应为 kid:算法:密钥材料")
+	}
+	kid, alg, material := parts[0], strings.ToUpper(parts[1]), parts[2]
+
+	switch alg {
+	case "HS256", "HS384", "HS512":
+		secret := []byte(material)
+		return &JWTKey{ID: kid, Method: jwt.GetSigningMethod(alg), SignKey: secret, VerifyKey: secret}, nil
+	case "RS256", "RS384", "RS512":
+		data, err := os.ReadFile(material)
+		if err != nil {
+			return nil, fmt.Errorf("读取密钥 %s 失败: %w", kid, err)
+		}
+		key := &JWTKey{ID: kid, Method: jwt.GetSigningMethod(alg)}
+		if private, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+			key.SignKey = private
+			key.VerifyKey = &private.PublicKey
+			return key, nil
+		}
+		public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("解析 RSA 密钥 %s 失败: %w", kid, err)
+		}
+		key.VerifyKey = public
+		return key, nil
+	case "EDDSA":
+		data, err := os.ReadFile(material)
+		if err != nil {
+			return nil, fmt.Errorf("读取密钥 %s 失败: %w", kid, err)
+		}
+		return parseEd25519Key(kid, data)
+	default:
+		return nil, fmt.Errorf("不支持的签名算法: %s", parts[1])
+	}
+}
+
+func parseEd25519Key(kid string, data []byte) (*JWTKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("密钥 %s 不是有效的 PEM", kid)
+	}
+
+	key := &JWTKey{ID: kid, Method: SigningMethodEdDSA}
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("密钥 %s 不是 Ed25519 私钥", kid)
+		}
+		key.SignKey = private
+		key.VerifyKey = private.Public()
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析 Ed25519 密钥 %s 失败: %w", kid, err)
+	}
+	public, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("密钥 %s 不是 Ed25519 公钥", kid)
+	}
+	key.VerifyKey = public
+	return key, nil
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -32,13 +33,13 @@ func LoggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		method := r.Method
 		statusCode := sw.statusCode
 
-		logger.Info("| %3d | %13v | %15s | %s  %s\n%s",
+		logger.Info(fmt.Sprintf("| %3d | %13v | %15s | %s  %s\n%s",
 			statusCode,
 			latency,
 			clientIP,
 			method,
 			path,
 			raw,
-		)
+		))
 	}
 }
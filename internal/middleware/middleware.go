@@ -1,8 +1,11 @@
 package middleware
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -36,3 +39,91 @@ func Logger(next http.HandlerFunc) http.HandlerFunc {
 		log.Printf("[%s] %s %s %v", r.Method, r.URL.Path, r.RemoteAddr, latency)
 	}
 }
+
+// 受信任的反向代理地址，只有来自这些地址的请求才使用转发请求头中的客户端 IP
+var trustedProxies []*net.IPNet
+
+// ParseTrustedProxies 解析受信任的代理列表，每项为 CIDR 或单个 IP
+func ParseTrustedProxies(specs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的代理地址: %s", spec)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("无效的代理地址: %s", spec)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// InitTrustedProxies 设置受信任的反向代理，未设置时只使用连接的对端地址
+func InitTrustedProxies(specs []string) error {
+	networks, err := ParseTrustedProxies(specs)
+	if err != nil {
+		return err
+	}
+	trustedProxies = networks
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 获取 HTTP 请求的客户端 IP，只采信受信任代理添加的转发请求头，客户端无法伪造
+func ClientIP(r *http.Request) string {
+	return RemoteIP(r.RemoteAddr, r.Header)
+}
+
+// RemoteIP 根据连接的对端地址和请求头获取客户端 IP。默认使用对端地址；对端是受信任的代理时，
+// 从 X-Forwarded-For 的最右侧开始跳过受信任的代理，取第一个不受信任的地址，没有该请求头时使用 X-Real-IP
+func RemoteIP(remoteAddr string, header http.Header) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP := net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP"))); realIP != nil {
+			return realIP.String()
+		}
+		return host
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// 无法解析的地址之后的内容不可信，使用最后一个受信任的代理
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
@@ -0,0 +1,394 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testClientID = "sixin"
+
+// mockIdP 本地模拟的 OIDC 提供方：提供元数据、JWKS 和带 PKCE 校验的令牌端点
+type mockIdP struct {
+	server *httptest.Server
+	keys   map[string]*rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu            sync.Mutex
+	jwksRequests  int
+	codes         map[string]string // 授权码 -> code_challenge
+	idTokens      map[string]string // 授权码 -> 返回的 id_token
+	discoveryBody map[string]string // 不为 nil 时替代默认元数据
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	idp := &mockIdP{
+		keys:     map[string]*rsa.PrivateKey{"rsa-1": newRSAKey(t), "rsa-2": newRSAKey(t)},
+		codes:    make(map[string]string),
+		idTokens: make(map[string]string),
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.ecKey = ecKey
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.handleDiscovery)
+	mux.HandleFunc("/jwks", idp.handleJWKS)
+	mux.HandleFunc("/token", idp.handleToken)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func (idp *mockIdP) issuer() string { return idp.server.URL }
+
+func (idp *mockIdP) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:      idp.issuer(),
+		ClientID:    testClientID,
+		RedirectURL: "https://sixin.example/api/oidc/callback",
+	})
+}
+
+func (idp *mockIdP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	body := idp.discoveryBody
+	idp.mu.Unlock()
+	if body == nil {
+		body = map[string]string{
+			"issuer":                 idp.issuer(),
+			"authorization_endpoint": idp.issuer() + "/authorize",
+			"token_endpoint":         idp.issuer() + "/token",
+			"jwks_uri":               idp.issuer() + "/jwks",
+		}
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func (idp *mockIdP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	idp.jwksRequests++
+	idp.mu.Unlock()
+
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	keys := []map[string]string{
+		// 用途不是签名的密钥应被忽略
+		{"kty": "RSA", "kid": "enc-1", "use": "enc", "n": encode(idp.keys["rsa-1"].N), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(idp.ecKey.X), "y": encode(idp.ecKey.Y)},
+	}
+	for kid, key := range idp.keys {
+		keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": encode(key.N), "e": "AQAB"})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// 令牌端点校验授权码、redirect_uri 和 PKCE verifier
+func (idp *mockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code := r.PostForm.Get("code")
+	idp.mu.Lock()
+	challenge, ok := idp.codes[code]
+	idToken := idp.idTokens[code]
+	delete(idp.codes, code)
+	idp.mu.Unlock()
+
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code" || !ok:
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	case r.PostForm.Get("client_id") != testClientID || r.PostForm.Get("redirect_uri") == "":
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusBadRequest)
+	case S256Challenge(r.PostForm.Get("code_verifier")) != challenge:
+		http.Error(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`, http.StatusBadRequest)
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+			"expires_in":   3600,
+		})
+	}
+}
+
+// 登记授权码，模拟用户在提供方完成登录
+func (idp *mockIdP) authorize(code, challenge, idToken string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.codes[code] = challenge
+	idp.idTokens[code] = idToken
+}
+
+func (idp *mockIdP) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            idp.issuer(),
+		"sub":            "subject-1",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func (idp *mockIdP) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	var token *jwt.Token
+	var key interface{}
+	if kid == "ec-1" {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodES256, claims), idp.ecKey
+	} else {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodRS256, claims), idp.keys[kid]
+	}
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestDiscover(t *testing.T) {
+	idp := newMockIdP(t)
+	discovery, err := idp.provider().Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discovery.JWKSURI != idp.issuer()+"/jwks" || discovery.TokenEndpoint != idp.issuer()+"/token" {
+		t.Errorf("unexpected discovery document: %+v", discovery)
+	}
+
+	tests := []struct {
+		name string
+		body map[string]string
+	}{
+		{"issuer mismatch", map[string]string{
+			"issuer": "https://evil.example", "authorization_endpoint": "a", "token_endpoint": "t", "jwks_uri": "j",
+		}},
+		{"missing jwks_uri", map[string]string{
+			"issuer": idp.issuer(), "authorization_endpoint": "a", "token_endpoint": "t",
+		}},
+	}
+	for _, tt := range tests {
+		idp.mu.Lock()
+		idp.discoveryBody = tt.body
+		idp.mu.Unlock()
+		if _, err := idp.provider().Discover(context.Background()); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestAuthCodeFlowWithPKCE(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := idp.provider()
+	ctx := context.Background()
+
+	verifier, err := GenerateRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", S256Challenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := parsed.Query()
+	if parsed.Path != "/authorize" || params.Get("code_challenge_method") != "S256" || params.Get("state") != "state-1" ||
+		params.Get("nonce") != "nonce-1" || params.Get("client_id") != testClientID {
+		t.Fatalf("unexpected authorization URL: %s", authURL)
+	}
+
+	idToken := idp.sign(t, "rsa-1", idp.claims("nonce-1"))
+	idp.authorize("code-1", params.Get("code_challenge"), idToken)
+	if _, err := provider.Exchange(ctx, "code-1", "wrong-verifier"); err == nil {
+		t.Fatal("exchange with wrong PKCE verifier should fail")
+	}
+
+	idp.authorize("code-2", params.Get("code_challenge"), idToken)
+	token, err := provider.Exchange(ctx, "code-2", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := provider.VerifyIDToken(ctx, token.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	// 授权码只能使用一次
+	if _, err := provider.Exchange(ctx, "code-2", verifier); err == nil {
+		t.Error("reused authorization code should fail")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := idp.provider()
+	otherKey := newRSAKey(t)
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr bool
+	}{
+		{"valid rsa", func() string { return idp.sign(t, "rsa-2", idp.claims("n")) }, false},
+		{"valid ec", func() string { return idp.sign(t, "ec-1", idp.claims("n")) }, false},
+		{"audience array with azp", func() string {
+			claims := idp.claims("n")
+			claims["aud"], claims["azp"] = []string{"other", testClientID}, testClientID
+			return idp.sign(t, "rsa-1", claims)
+		}, false},
+		{"audience array without azp", func() string {
+			claims := idp.claims("n")
+			claims["aud"] = []string{"other", testClientID}
+			return idp.sign(t, "rsa-1", claims)
+		}, true},
+		{"bad signature", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims("n"))
+			token.Header["kid"] = "rsa-1"
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}, true},
+		{"unknown kid", func() string { return signWithKid(t, otherKey, "rsa-3", idp.claims("n")) }, true},
+		{"key not for signing", func() string { return signWithKid(t, idp.keys["rsa-1"], "enc-1", idp.claims("n")) }, true},
+		{"hmac algorithm", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.claims("n"))
+			signed, _ := token.SignedString([]byte("secret"))
+			return signed
+		}, true},
+		{"wrong issuer", func() string {
+			claims := idp.claims("n")
+			claims["iss"] = "https://evil.example"
+			return idp.sign(t, "rsa-1", claims)
+		}, true},
+		{"wrong audience", func() string {
+			claims := idp.claims("n")
+			claims["aud"] = "other"
+			return idp.sign(t, "rsa-1", claims)
+		}, true},
+		{"expired", func() string {
+			claims := idp.claims("n")
+			claims["exp"] = time.Now().Add(-2 * clockSkew).Unix()
+			return idp.sign(t, "rsa-1", claims)
+		}, true},
+		{"issued in the future", func() string {
+			claims := idp.claims("n")
+			claims["iat"] = time.Now().Add(2 * clockSkew).Unix()
+			return idp.sign(t, "rsa-1", claims)
+		}, true},
+		{"wrong nonce", func() string { return idp.sign(t, "rsa-1", idp.claims("other")) }, true},
+		{"missing sub", func() string {
+			claims := idp.claims("n")
+			delete(claims, "sub")
+			return idp.sign(t, "rsa-1", claims)
+		}, true},
+	}
+	for _, tt := range tests {
+		_, err := provider.VerifyIDToken(context.Background(), tt.token(), "n")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func signWithKid(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// 未知的 kid 触发一次 JWKS 刷新，但最短刷新间隔内不会重复请求
+func TestVerificationKeyRefresh(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := idp.provider()
+	ctx := context.Background()
+
+	if _, err := provider.VerifyIDToken(ctx, idp.sign(t, "rsa-1", idp.claims("n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.VerifyIDToken(ctx, idp.sign(t, "rsa-2", idp.claims("n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := provider.VerifyIDToken(ctx, signWithKid(t, newRSAKey(t), "forged", idp.claims("n")), "n"); err == nil {
+			t.Fatal("unknown kid should be rejected")
+		}
+	}
+	idp.mu.Lock()
+	requests := idp.jwksRequests
+	idp.mu.Unlock()
+	if requests != 1 {
+		t.Errorf("JWKS requested %d times, want 1", requests)
+	}
+
+	// 提供方轮换密钥后，刷新间隔过去即可取到新密钥
+	rotated := newRSAKey(t)
+	idp.mu.Lock()
+	idp.keys["rsa-3"] = rotated
+	idp.mu.Unlock()
+	provider.mu.Lock()
+	provider.keysAt = time.Now().Add(-jwksMinRefreshInterval)
+	provider.mu.Unlock()
+	if _, err := provider.VerifyIDToken(ctx, signWithKid(t, rotated, "rsa-3", idp.claims("n")), "n"); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+}
+
+// 只有一个签名密钥时，未指定 kid 的令牌使用该密钥
+func TestLookupKeyWithoutKid(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := idp.provider()
+	provider.keys = map[string]interface{}{"only": &idp.keys["rsa-1"].PublicKey}
+	provider.keysAt = time.Now()
+
+	if _, err := provider.VerifyIDToken(context.Background(), signWithKid(t, idp.keys["rsa-1"], "", idp.claims("n")), "n"); err != nil {
+		t.Errorf("single key without kid: %v", err)
+	}
+	provider.keys["second"] = &idp.keys["rsa-2"].PublicKey
+	if _, err := provider.VerifyIDToken(context.Background(), signWithKid(t, idp.keys["rsa-1"], "", idp.claims("n")), "n"); err == nil ||
+		!strings.Contains(err.Error(), "未知的签名密钥") {
+		t.Errorf("multiple keys without kid: got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+// Package ratelimit 实现令牌桶限流，按策略名称和调用方（用户 ID 或 IP）分别计数
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy 令牌桶策略：每个 Period 补充 Limit 个令牌，桶容量为 Limit，允许短时突发
+type Policy struct {
+	Limit  int
+	Period time.Duration
+}
+
+// 每秒补充的令牌数
+func (p Policy) rate() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+// ParsePolicies 解析 "名称=次数/周期" 格式的策略列表，例如 "/api/message=60/1m"、"socket:message=20/10s"
+func ParsePolicies(items []string) (map[string]Policy, error) {
+	policies := make(map[string]Policy, len(items))
+	for _, item := range items {
+		name, spec, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("无效的限流策略: %s", item)
+		}
+
+		limitStr, periodStr, ok := strings.Cut(strings.TrimSpace(spec), "/")
+		if !ok {
+			return nil, fmt.Errorf("无效的限流策略: %s", item)
+		}
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("无效的限流次数: %s", item)
+		}
+		period, err := time.ParseDuration(periodStr)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("无效的限流周期: %s", item)
+		}
+
+		policies[name] = Policy{Limit: limit, Period: period}
+	}
+	return policies, nil
+}
+
+// Limiter 按名称查找策略并在存储中扣减令牌
+type Limiter struct {
+	store    Store
+	policies map[string]Policy
+}
+
+func NewLimiter(store Store, policies map[string]Policy) *Limiter {
+	return &Limiter{store: store, policies: policies}
+}
+
+// Allow 使用 names 中第一个已配置的策略检查 key 是否还有令牌，
+// 没有匹配的策略时不限流。被限流时返回需要等待的时间。
+func (l *Limiter) Allow(key string, names ...string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	for _, name := range names {
+		policy, ok := l.policies[name]
+		if !ok {
+			continue
+		}
+
+		allowed, wait, err := l.store.Take(name+"|"+key, policy, time.Now())
+		if err != nil {
+			// 存储不可用时放行，避免限流故障导致服务不可用
+			log.Printf("限流存储出错 %s: %v", name, err)
+			return true, 0
+		}
+		return allowed, wait
+	}
+	return true, 0
+}
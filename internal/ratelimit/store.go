@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Store 保存令牌桶状态。默认使用进程内存储，多实例部署时可实现共享存储（如 Redis）
+type Store interface {
+	// Take 尝试从 key 对应的桶中取出一个令牌，失败时返回需要等待的时间
+	Take(key string, policy Policy, now time.Time) (bool, time.Duration, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryStore 进程内令牌桶存储，桶补满后自动过期
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets *cache.Cache
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: cache.New(10*time.Minute, 10*time.Minute)}
+}
+
+func (s *MemoryStore) Take(key string, policy Policy, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &bucket{tokens: float64(policy.Limit), last: now}
+	if cached, found := s.buckets.Get(key); found {
+		b = cached.(*bucket)
+		elapsed := now.Sub(b.last).Seconds()
+		if elapsed > 0 {
+			b.tokens = math.Min(float64(policy.Limit), b.tokens+elapsed*policy.rate())
+			b.last = now
+		}
+	}
+
+	// 桶补满所需时间之后，状态与新建的桶相同，可以丢弃
+	s.buckets.Set(key, b, policy.Period)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / policy.rate() * float64(time.Second))
+	return false, wait, nil
+}
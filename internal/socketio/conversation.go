@@ -0,0 +1,101 @@
+package socketio
+
+import (
+	"encoding/json"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/models"
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+func (sim *SocketIOManager) handleGetConversations(client *socket.Socket, args ...any) {
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		conversations, err := sim.baseInstance.DbManager.GetConversations(userID)
+		if err != nil {
+			emitErrorAndLog(client, "获取会话列表失败", err)
+			return
+		}
+		client.Emit("getConversations", conversations)
+	}()
+}
+
+// 标记会话已读，参数为 JSON 字符串：{"peerId": 单聊对方, "roomId": 房间, "msgId": 已读到的消息，为空表示最新}
+func (sim *SocketIOManager) handleMarkRead(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少会话参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		PeerID uint   `json:"peerId"`
+		RoomID uint   `json:"roomId"`
+		MsgID  string `json:"msgId"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的会话参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		state, err := sim.baseInstance.DbManager.MarkConversationRead(userID, request.PeerID, request.RoomID, request.MsgID)
+		if err != nil {
+			emitError(client, "标记已读失败", err)
+			return
+		}
+		sim.emitConversationStatus(client, state)
+	}()
+}
+
+// 修改会话设置，参数为 JSON 字符串：{"peerId", "roomId", "muted", "pinned", "archived"}，未提供的设置不修改
+func (sim *SocketIOManager) handleUpdateConversation(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少会话参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		PeerID uint `json:"peerId"`
+		RoomID uint `json:"roomId"`
+		database.ConversationSettings
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的会话参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		state, err := sim.baseInstance.DbManager.UpdateConversationSettings(userID, request.PeerID, request.RoomID, request.ConversationSettings)
+		if err != nil {
+			emitError(client, "更新会话设置失败", err)
+			return
+		}
+		sim.emitConversationStatus(client, state)
+	}()
+}
+
+// 会话状态推送给用户的所有设备（包括当前连接），保证多端已读数一致
+func (sim *SocketIOManager) emitConversationStatus(client *socket.Socket, state *models.ConversationState) {
+	status, err := sim.baseInstance.DbManager.ConversationStatusOf(state)
+	if err != nil {
+		emitErrorAndLog(client, "获取会话状态失败", err)
+		return
+	}
+	sim.baseInstance.EmitToUsers("conversationUpdated", status, state.UserID)
+}
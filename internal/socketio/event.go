@@ -0,0 +1,77 @@
+package socketio
+
+import (
+	"fmt"
+
+	"github.com/Ireoo/sixin-server/base"
+	"github.com/Ireoo/sixin-server/logger"
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+// 补发该连接所属设备（登录会话）未确认的事件，事件的第二个参数为 {"seq": 序号}
+func (sim *SocketIOManager) replayMissedEvents(client *socket.Socket, userID uint) {
+	sessionID, err := sim.getSessionIDFromSocket(client)
+	if err != nil {
+		return
+	}
+	err = sim.baseInstance.ReplayMissedEvents(userID, sessionID, func(event string, data interface{}, meta base.EventMeta) {
+		client.Emit(event, data, meta)
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("补发用户 %d 的离线事件失败:", userID), err)
+	}
+}
+
+// 确认已收到指定序号及之前的全部事件，参数为事件序号
+func (sim *SocketIOManager) handleAck(client *socket.Socket, args ...any) {
+	seq, err := checkArgsAndType[uint](args, 0)
+	if err != nil {
+		emitError(client, "缺少事件序号或序号类型错误", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+	sessionID, err := sim.getSessionIDFromSocket(client)
+	if err != nil {
+		emitError(client, "获取会话失败", err)
+		return
+	}
+
+	if _, err := sim.baseInstance.DbManager.AckEvents(sessionID, userID, uint64(seq)); err != nil {
+		emitErrorAndLog(client, "确认事件失败", err)
+	}
+}
+
+// 增量同步，参数为上次同步到的序号和可选的数量上限，结果通过 "sync" 事件返回
+func (sim *SocketIOManager) handleSync(client *socket.Socket, args ...any) {
+	since, err := checkArgsAndType[uint](args, 0)
+	if err != nil {
+		emitError(client, "缺少同步序号或序号类型错误", err)
+		return
+	}
+	limit := 0
+	if len(args) > 1 {
+		value, err := checkArgsAndType[uint](args, 1)
+		if err != nil {
+			emitError(client, "数量参数类型错误", err)
+			return
+		}
+		limit = int(value)
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+	sessionID, _ := sim.getSessionIDFromSocket(client)
+
+	result, err := sim.baseInstance.DbManager.Sync(userID, sessionID, uint64(since), limit)
+	if err != nil {
+		emitErrorAndLog(client, "同步失败", err)
+		return
+	}
+	client.Emit("sync", result)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/Ireoo/sixin-server/base"
+	"github.com/Ireoo/sixin-server/database"
 	"github.com/Ireoo/sixin-server/internal/middleware"
 	"github.com/Ireoo/sixin-server/logger"
 	"github.com/pion/webrtc/v3"
@@ -22,12 +23,39 @@ func newSocketData() *socketData {
 	return &socketData{}
 }
 
+// userSocketMap 记录每个用户当前在线的全部连接，同一用户可以在多个设备上同时登录，用于在线状态
 type userSocketMap struct {
-	data sync.Map // 使用 sync.Map 来降低锁的开销并提升并发性能
+	mu   sync.RWMutex
+	data map[uint]map[socket.SocketId]*socket.Socket
 }
 
 func newUserSocketMap() *userSocketMap {
-	return &userSocketMap{}
+	return &userSocketMap{data: make(map[uint]map[socket.SocketId]*socket.Socket)}
+}
+
+func (m *userSocketMap) add(userID uint, s *socket.Socket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data[userID] == nil {
+		m.data[userID] = make(map[socket.SocketId]*socket.Socket)
+	}
+	m.data[userID][s.Id()] = s
+}
+
+func (m *userSocketMap) remove(userID uint, s *socket.Socket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data[userID], s.Id())
+	if len(m.data[userID]) == 0 {
+		delete(m.data, userID)
+	}
+}
+
+// connected 判断用户是否还有在线的连接，用于在线状态。推送统一通过 base.EmitToUsers 发送到用户的 socket.io 房间
+func (m *userSocketMap) connected(userID uint) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data[userID]) > 0
 }
 
 type SocketIOManager struct {
@@ -39,6 +67,7 @@ type SocketIOManager struct {
 	userSocketMap *userSocketMap
 	socketData    *socketData
 	cache         *cache.Cache
+	presence      *presenceTracker
 }
 
 func NewSocketIOManager(baseInst *base.Base) *SocketIOManager {
@@ -48,28 +77,28 @@ func NewSocketIOManager(baseInst *base.Base) *SocketIOManager {
 		peerConnections: make(map[string]*webrtc.PeerConnection),
 		userSocketMap:   newUserSocketMap(),
 		socketData:      newSocketData(),
+		presence:        newPresenceTracker(),
 		cache:           cache.New(5*time.Minute, 10*time.Minute), // 初始化缓存，设置默认过期时间为 5 分钟
 	}
 }
 
-func (sim *SocketIOManager) authMiddleware(next func(*socket.Socket, ...any)) func(*socket.Socket, ...any) {
+func (sim *SocketIOManager) authMiddleware(next func(*socket.Socket, ...any), reject func(string)) func(*socket.Socket, ...any) {
 	return func(s *socket.Socket, args ...any) {
 		token, _ := s.Request().Query().Get("token")
 		if token == "" {
-			emitError(s, "未提供身份验证令牌", nil)
-			s.Disconnect(true)
+			reject("未提供身份验证令牌")
 			return
 		}
 
-		userID, err := middleware.ValidateToken(token)
+		// 与 HTTP 共用同一个 JWT 密钥环，已撤销会话的令牌会被拒绝
+		claims, err := middleware.ValidateJWT(token)
 		if err != nil {
-			emitError(s, "无效的身份验证令牌", err)
-			s.Disconnect(true)
+			reject(fmt.Sprintf("无效的身份验证令牌: %v", err))
 			return
 		}
 
-		sim.socketData.data.Store(s, map[string]interface{}{"userID": userID})
-		sim.userSocketMap.data.Store(userID, s)
+		sim.socketData.data.Store(s, map[string]interface{}{"userID": claims.UserID, "sessionID": claims.SessionID})
+		sim.userSocketMap.add(claims.UserID, s)
 
 		next(s, args...)
 	}
@@ -79,6 +108,8 @@ func (sim *SocketIOManager) SetupSocketHandlers() *socket.Server {
 	sim.Io.Use(func(s *socket.Socket, next func(*socket.ExtendedError)) {
 		sim.authMiddleware(func(s *socket.Socket, _ ...any) {
 			next(nil)
+		}, func(message string) {
+			next(socket.NewExtendedError(message, nil))
 		})(s)
 	})
 	sim.Io.On("connection", func(clients ...any) {
@@ -90,6 +121,8 @@ func (sim *SocketIOManager) SetupSocketHandlers() *socket.Server {
 		log.Printf("连接超时: %s", client.Id())
 		client.Disconnect(false)
 	})
+	sim.baseInstance.DbManager.IsOnline = sim.isOnline
+	go sim.runPresenceSweeper()
 	return sim.Io
 }
 
@@ -98,12 +131,33 @@ func (sim *SocketIOManager) handleConnection(clients ...any) {
 	go func(client *socket.Socket) { // 使用 goroutine 处理新连接，避免单线程性能瓶颈
 		logger.Info(fmt.Sprintf("新连接：%s", client.Id()))
 
+		// 加入会话房间，会话被撤销时据此断开连接
+		if sessionID, err := sim.getSessionIDFromSocket(client); err == nil {
+			client.Join(base.SessionRoom(sessionID))
+			sim.touchSession(client, sessionID)
+		}
+		// 加入用户房间，用于向用户的所有设备推送；加入所在的聊天房间，用于接收房间内通知
+		if userID, err := sim.getUserIDFromSocket(client); err == nil {
+			client.Join(base.UserSocketRoom(userID))
+			sim.joinChatRooms(client, userID)
+			sim.replayMissedEvents(client, userID)
+			sim.presenceHeartbeat(userID)
+		}
+
 		sim.emitInitialState(client)
 		sim.registerClientHandlers(client)
 
 		client.On("disconnecting", func(reason ...any) {
 			logger.Info(fmt.Sprintf("连接断开: %s, 原因: %v", client.Id(), reason))
 			sim.cleanupPeerConnection(client.Id())
+			if sessionID, err := sim.getSessionIDFromSocket(client); err == nil {
+				sim.touchSession(client, sessionID)
+			}
+			if userID, err := sim.getUserIDFromSocket(client); err == nil {
+				sim.userSocketMap.remove(userID, client)
+				sim.presenceDisconnected(userID)
+			}
+			sim.socketData.data.Delete(client)
 		})
 
 		// 添加连接超时检测
@@ -116,6 +170,20 @@ func (sim *SocketIOManager) handleConnection(clients ...any) {
 	}(client)
 }
 
+// 加入用户所在的全部聊天房间，之后的成员变化由 base 同步
+func (sim *SocketIOManager) joinChatRooms(client *socket.Socket, userID uint) {
+	roomIDs, err := sim.baseInstance.DbManager.GetUserRoomIDs(userID)
+	if err != nil {
+		logger.Error(fmt.Sprintf("获取用户 %d 的房间失败:", userID), err)
+		return
+	}
+	rooms := make([]socket.Room, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		rooms = append(rooms, base.RoomSocketRoom(roomID))
+	}
+	client.Join(rooms...)
+}
+
 func (sim *SocketIOManager) emitInitialState(client *socket.Socket) {
 	client.Emit("receive", sim.baseInstance.ReceiveDevice)
 	client.Emit("email", sim.baseInstance.EmailNote)
@@ -130,6 +198,21 @@ func (sim *SocketIOManager) registerClientHandlers(client *socket.Socket) {
 		"message":            sim.handleMessage,
 		"email":              sim.handleEmail,
 		"getChats":           sim.handleGetChats,
+		"getHistory":         sim.handleGetHistory,
+		"getThread":          sim.handleGetThread,
+		"editMessage":        sim.handleEditMessage,
+		"recallMessage":      sim.handleRecallMessage,
+		"getMessageEdits":    sim.handleGetMessageEdits,
+		"addReaction":        sim.handleAddReaction,
+		"removeReaction":     sim.handleRemoveReaction,
+		"getConversations":   sim.handleGetConversations,
+		"markRead":           sim.handleMarkRead,
+		"markDelivered":      sim.handleMarkDelivered,
+		"getReceipts":        sim.handleGetReceipts,
+		"getReadCursors":     sim.handleGetReadCursors,
+		"getMentions":        sim.handleGetMentions,
+		"readMentions":       sim.handleReadMentions,
+		"updateConversation": sim.handleUpdateConversation,
 		"getRooms":           sim.handleGetRooms,
 		"getUsers":           sim.handleGetUsers,
 		"getRoomByUsers":     sim.handleGetRoomByUsers,
@@ -149,11 +232,29 @@ func (sim *SocketIOManager) registerClientHandlers(client *socket.Socket) {
 		"removeUserFromRoom": sim.handleRemoveUserFromRoom,
 		"updateRoomAlias":    sim.handleUpdateRoomAlias,
 		"setRoomPrivacy":     sim.handleSetRoomPrivacy,
+		"pinMessage":         sim.handlePinMessage,
+		"unpinMessage":       sim.handleUnpinMessage,
+		"getSessions":        sim.handleGetSessions,
+		"ack":                sim.handleAck,
+		"sync":               sim.handleSync,
+		"heartbeat":          sim.handleHeartbeat,
+		"setPresence":        sim.handleSetPresence,
+		"getPresence":        sim.handleGetPresence,
+		"typing":             sim.handleTyping,
+		"terminateSession":   sim.handleTerminateSession,
+
+		"getScheduledMessages":   sim.handleGetScheduledMessages,
+		"scheduleMessage":        sim.handleScheduleMessage,
+		"updateScheduledMessage": sim.handleUpdateScheduledMessage,
+		"cancelScheduledMessage": sim.handleCancelScheduledMessage,
 	}
 
 	for event, handler := range events {
-		h := handler
+		e, h := event, handler
 		client.On(event, func(args ...any) {
+			if !sim.allowEvent(client, e) {
+				return
+			}
 			h(client, args...)
 		})
 	}
@@ -202,42 +303,6 @@ func (sim *SocketIOManager) handleEmail(client *socket.Socket, args ...any) {
 	client.Emit("email", sim.baseInstance.EmailNote)
 }
 
-func (sim *SocketIOManager) SendMessageToUsers(message interface{}, userIDs ...uint) {
-	var wg sync.WaitGroup
-	messageQueue := make(chan uint, len(userIDs))
-
-	// 将所有用户 ID 添加到消息队列中
-	for _, userID := range userIDs {
-		messageQueue <- userID
-	}
-	close(messageQueue)
-
-	// 使用多个 goroutine 并发处理消息发送
-	workerCount := 10 // 可以根据实际情况调整并发数量
-	for i := 0; i < workerCount; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for userID := range messageQueue {
-				clientInterface, exists := sim.userSocketMap.data.Load(userID)
-				if !exists {
-					log.Printf("用户 %d 未找到对应的客户端", userID)
-					continue
-				}
-
-				client := clientInterface.(*socket.Socket)
-				err := client.Emit("message", message)
-				if err != nil {
-					log.Printf("发送消息给用户 %d 失败: %v", userID, err)
-				}
-			}
-		}()
-	}
-
-	// 等待所有 goroutine 完成
-	wg.Wait()
-}
-
 // 提取通用的从 socketData 获取 userID 的逻辑
 func (sim *SocketIOManager) getUserIDFromSocket(client *socket.Socket) (uint, error) {
 	value, ok := sim.socketData.data.Load(client)
@@ -251,3 +316,30 @@ func (sim *SocketIOManager) getUserIDFromSocket(client *socket.Socket) (uint, er
 	}
 	return userID, nil
 }
+
+// 连接的客户端 IP，经过受信任的代理时取转发请求头中的地址
+func clientIP(client *socket.Socket) string {
+	handshake := client.Handshake()
+	return middleware.RemoteIP(handshake.Address, handshake.Headers)
+}
+
+// 审计所需的操作者、会话和连接 IP
+func (sim *SocketIOManager) auditContext(client *socket.Socket) database.AuditContext {
+	ac := database.AuditContext{IP: clientIP(client), Source: database.AuditSourceSocketIO}
+	ac.ActorID, _ = sim.getUserIDFromSocket(client)
+	ac.SessionID, _ = sim.getSessionIDFromSocket(client)
+	return ac
+}
+
+func (sim *SocketIOManager) getSessionIDFromSocket(client *socket.Socket) (uint, error) {
+	value, ok := sim.socketData.data.Load(client)
+	if !ok {
+		return 0, fmt.Errorf("未找到用户数据")
+	}
+
+	sessionID, ok := value.(map[string]interface{})["sessionID"].(uint)
+	if !ok {
+		return 0, fmt.Errorf("sessionID 类型转换失败")
+	}
+	return sessionID, nil
+}
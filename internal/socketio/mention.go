@@ -0,0 +1,70 @@
+package socketio
+
+import (
+	"encoding/json"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+// 获取未读提及收件箱，参数为 JSON 字符串：{"roomId": 只查该房间, "before": 上一页的 nextBefore, "limit": 条数}，可省略
+func (sim *SocketIOManager) handleGetMentions(client *socket.Socket, args ...any) {
+	var request struct {
+		RoomID uint `json:"roomId"`
+		Before uint `json:"before"`
+		Limit  int  `json:"limit"`
+	}
+	if data, err := checkArgsAndType[string](args, 0); err == nil {
+		if err := json.Unmarshal([]byte(data), &request); err != nil {
+			emitError(client, "无效的查询参数", err)
+			return
+		}
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		inbox, err := sim.baseInstance.DbManager.GetMentions(database.MentionQuery{
+			UserID: userID,
+			RoomID: request.RoomID,
+			Before: request.Before,
+			Limit:  request.Limit,
+		})
+		if err != nil {
+			emitError(client, "获取提及失败", err)
+			return
+		}
+		client.Emit("getMentions", inbox)
+	}()
+}
+
+// 把提及标记为已读，参数为 JSON 字符串：{"ids": [...]}。用户的所有设备会收到 "mentionsRead" 事件
+func (sim *SocketIOManager) handleReadMentions(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少提及参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		IDs []uint `json:"ids"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的提及参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		if _, err := sim.baseInstance.DbManager.MarkMentionsRead(userID, request.IDs); err != nil {
+			emitErrorAndLog(client, "标记提及已读失败", err)
+		}
+	}()
+}
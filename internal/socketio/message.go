@@ -1,13 +1,11 @@
 package socketio
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"sync"
-	"time"
 
+	"github.com/Ireoo/sixin-server/database"
 	"github.com/Ireoo/sixin-server/models"
 	"github.com/go-playground/validator/v10"
 	"github.com/patrickmn/go-cache"
@@ -15,12 +13,8 @@ import (
 )
 
 var validate = validator.New()
-var messagePool = sync.Pool{
-	New: func() interface{} {
-		return &models.Message{}
-	},
-}
 
+// 全量重新加载，仅为兼容旧客户端保留；新客户端应使用 "sync" 增量同步
 func (sim *SocketIOManager) handleGetChats(client *socket.Socket, args ...any) {
 	userID, err := sim.getUserIDOrEmitError(client)
 	if err != nil {
@@ -43,18 +37,74 @@ func (sim *SocketIOManager) handleGetChats(client *socket.Socket, args ...any) {
 	client.Emit("getChats", messages)
 }
 
-func (sim *SocketIOManager) handleMessage(client *socket.Socket, args ...any) {
-	msgBytes, err := checkArgsAndType[[]byte](args, 0)
+// 获取单个会话的历史消息，参数为 JSON 字符串：
+// {"peerId": 单聊对方, "roomId": 房间, "before"/"after": 游标, "around": 消息 msgId, "limit": 条数}
+func (sim *SocketIOManager) handleGetHistory(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
 	if err != nil {
-		emitErrorAndLog(client, "缺少消息内容或消息格式错误", err)
+		emitError(client, "缺少查询参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		PeerID uint   `json:"peerId"`
+		RoomID uint   `json:"roomId"`
+		Before string `json:"before"`
+		After  string `json:"after"`
+		Around string `json:"around"`
+		Limit  int    `json:"limit"`
+
+		HideThreadReplies bool `json:"hideThreadReplies"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的查询参数", err)
 		return
 	}
 
-	fmt.Println("收到消息：", string(msgBytes))
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
 
-	message := messagePool.Get().(*models.Message)
-	defer messagePool.Put(message)
+	go func() {
+		history, err := sim.baseInstance.DbManager.GetMessageHistory(database.HistoryQuery{
+			UserID:            userID,
+			PeerID:            request.PeerID,
+			RoomID:            request.RoomID,
+			Before:            request.Before,
+			After:             request.After,
+			Around:            request.Around,
+			Limit:             request.Limit,
+			HideThreadReplies: request.HideThreadReplies,
+		})
+		if err != nil {
+			emitError(client, "获取历史消息失败", err)
+			return
+		}
 
+		// 带上会话标识，便于客户端把结果对应到会话
+		client.Emit("getHistory", struct {
+			PeerID uint `json:"peerId,omitempty"`
+			RoomID uint `json:"roomId,omitempty"`
+			*database.MessageHistory
+		}{request.PeerID, request.RoomID, history})
+	}()
+}
+
+func (sim *SocketIOManager) handleMessage(client *socket.Socket, args ...any) {
+	// 消息可以是二进制或 JSON 字符串
+	msgBytes, err := checkArgsAndType[[]byte](args, 0)
+	if err != nil {
+		text, textErr := checkArgsAndType[string](args, 0)
+		if textErr != nil {
+			emitErrorAndLog(client, "缺少消息内容或消息格式错误", err)
+			return
+		}
+		msgBytes = []byte(text)
+	}
+
+	// 消息在 goroutine 中保存和推送，不能复用对象
+	message := &models.Message{}
 	if err := json.Unmarshal(msgBytes, message); err != nil {
 		emitErrorAndLog(client, "解析消息失败", err)
 		return
@@ -71,34 +121,11 @@ func (sim *SocketIOManager) handleMessage(client *socket.Socket, args ...any) {
 	}
 	message.TalkerID = userID
 
-	// 创建一个带有超时的 context，用于控制 goroutine 执行时间
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	go func(ctx context.Context) {
-		select {
-		case <-ctx.Done():
-			if ctx.Err() == context.DeadlineExceeded {
-				fmt.Println("消息保存操作超时")
-				emitError(client, "保存消息超时", ctx.Err())
-			}
-			return
-		default:
-			if err := sim.baseInstance.DbManager.CreateMessage(message); err != nil {
-				emitErrorAndLog(client, "保存消息失败", err)
-				return
-			}
-
-			fullMessage := *message
-
-			recipientID := message.ListenerID
-			if recipientID == 0 {
-				recipientID = message.RoomID
-			}
-
-			sim.SendMessageToUsers(fullMessage, message.TalkerID, recipientID)
+	go func() {
+		if _, err := sim.baseInstance.PostMessage(message); err != nil {
+			emitErrorAndLog(client, "发送消息失败", err)
 		}
-	}(ctx)
+	}()
 }
 
 func (sim *SocketIOManager) getUserIDOrEmitError(client *socket.Socket) (uint, error) {
@@ -116,3 +143,165 @@ func emitErrorAndLog(client *socket.Socket, message string, err error) {
 	}
 	emitError(client, message, err)
 }
+
+// 编辑消息，参数为 JSON 字符串：{"msgId", "text", "mentionIdList"}。
+// 会话参与者的所有设备会收到 "messageEdited" 事件，包括当前连接
+func (sim *SocketIOManager) handleEditMessage(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少消息参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		MsgID         string                 `json:"msgId"`
+		Text          map[string]interface{} `json:"text"`
+		MentionIDList []uint                 `json:"mentionIdList"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的消息参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		window := sim.baseInstance.Cfg.MessageEditWindow
+		if _, err := sim.baseInstance.DbManager.EditMessage(userID, request.MsgID, request.Text, request.MentionIDList, window); err != nil {
+			emitError(client, "编辑消息失败", err)
+		}
+	}()
+}
+
+// 撤回消息，参数为消息 ID。会话参与者的所有设备会收到 "messageRecalled" 事件
+func (sim *SocketIOManager) handleRecallMessage(client *socket.Socket, args ...any) {
+	msgID, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少消息 ID 或类型错误", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		window := sim.baseInstance.Cfg.MessageRecallWindow
+		if _, err := sim.baseInstance.DbManager.RecallMessage(userID, msgID, window); err != nil {
+			emitError(client, "撤回消息失败", err)
+		}
+	}()
+}
+
+// 获取消息的编辑历史，参数为消息 ID
+func (sim *SocketIOManager) handleGetMessageEdits(client *socket.Socket, args ...any) {
+	msgID, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少消息 ID 或类型错误", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		edits, err := sim.baseInstance.DbManager.GetMessageEdits(userID, msgID)
+		if err != nil {
+			emitError(client, "获取编辑历史失败", err)
+			return
+		}
+		client.Emit("getMessageEdits", map[string]interface{}{"msgId": msgID, "edits": edits})
+	}()
+}
+
+// 添加表情回应，参数为 JSON 字符串：{"msgId", "emoji"}。会话参与者的所有设备会收到 "reactionAdded" 事件
+func (sim *SocketIOManager) handleAddReaction(client *socket.Socket, args ...any) {
+	sim.handleReaction(client, true, args...)
+}
+
+// 取消表情回应，参数同 addReaction。会话参与者的所有设备会收到 "reactionRemoved" 事件
+func (sim *SocketIOManager) handleRemoveReaction(client *socket.Socket, args ...any) {
+	sim.handleReaction(client, false, args...)
+}
+
+func (sim *SocketIOManager) handleReaction(client *socket.Socket, add bool, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少回应参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		MsgID string `json:"msgId"`
+		Emoji string `json:"emoji"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的回应参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		dm := sim.baseInstance.DbManager
+		var err error
+		if add {
+			_, err = dm.AddReaction(userID, request.MsgID, request.Emoji)
+		} else {
+			_, err = dm.RemoveReaction(userID, request.MsgID, request.Emoji)
+		}
+		if err != nil {
+			emitError(client, "更新表情回应失败", err)
+		}
+	}()
+}
+
+// 获取话题的根消息和一页回复，参数为 JSON 字符串：{"msgId": 根消息, "before", "after", "around", "limit"}
+func (sim *SocketIOManager) handleGetThread(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少查询参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		MsgID  string `json:"msgId"`
+		Before string `json:"before"`
+		After  string `json:"after"`
+		Around string `json:"around"`
+		Limit  int    `json:"limit"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的查询参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		thread, err := sim.baseInstance.DbManager.GetThread(request.MsgID, database.HistoryQuery{
+			UserID: userID,
+			Before: request.Before,
+			After:  request.After,
+			Around: request.Around,
+			Limit:  request.Limit,
+		})
+		if err != nil {
+			emitError(client, "获取话题失败", err)
+			return
+		}
+		client.Emit("getThread", thread)
+	}()
+}
@@ -0,0 +1,353 @@
+package socketio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Ireoo/sixin-server/base"
+	"github.com/Ireoo/sixin-server/logger"
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+// 在线状态
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+const (
+	presenceAwayAfter     = 2 * time.Minute  // 超过该时间没有心跳视为离开
+	presenceSweepInterval = 30 * time.Second // 检查心跳超时的间隔
+	typingTimeout         = 6 * time.Second  // 输入状态没有刷新时自动结束
+)
+
+// PresenceInfo 推送和查询返回的在线状态，LastSeenAt 只在离线时返回
+type PresenceInfo struct {
+	UserID     uint       `json:"userId"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+}
+
+type presenceState struct {
+	status        string
+	manual        bool // 用户主动设置为离开，心跳不会恢复为在线
+	lastHeartbeat time.Time
+}
+
+// 正在输入的会话，单聊以 peerID 标识，群聊以 roomID 标识
+type typingKey struct {
+	userID, peerID, roomID uint
+}
+
+type typingEntry struct {
+	timer *time.Timer
+}
+
+// presenceTracker 记录本节点在线用户的状态和正在输入的会话，只保存在内存中。
+// 在线状态只统计 socket.io 连接，只通过 /ws 连接的用户显示为离线，也不计入 @here 提及
+type presenceTracker struct {
+	mu     sync.Mutex
+	users  map[uint]*presenceState
+	typing map[typingKey]*typingEntry
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		users:  make(map[uint]*presenceState),
+		typing: make(map[typingKey]*typingEntry),
+	}
+}
+
+// 连接建立或收到心跳时调用，离线或自动离开的用户恢复为在线
+func (sim *SocketIOManager) presenceHeartbeat(userID uint) {
+	p := sim.presence
+	p.mu.Lock()
+	state := p.users[userID]
+	if state == nil {
+		state = &presenceState{status: PresenceOffline}
+		p.users[userID] = state
+	}
+	state.lastHeartbeat = time.Now()
+	changed := state.status == PresenceOffline || (state.status == PresenceAway && !state.manual)
+	if changed {
+		state.status = PresenceOnline
+	}
+	p.mu.Unlock()
+
+	if changed {
+		sim.broadcastPresence(PresenceInfo{UserID: userID, Status: PresenceOnline})
+	}
+}
+
+// 用户主动设置在线或离开
+func (sim *SocketIOManager) setPresence(userID uint, status string) {
+	p := sim.presence
+	p.mu.Lock()
+	state := p.users[userID]
+	if state == nil {
+		p.mu.Unlock()
+		return
+	}
+	state.manual = status == PresenceAway
+	state.lastHeartbeat = time.Now()
+	changed := state.status != status
+	state.status = status
+	p.mu.Unlock()
+
+	if changed {
+		sim.broadcastPresence(PresenceInfo{UserID: userID, Status: status})
+	}
+}
+
+// 用户最后一个连接断开时调用：结束输入状态，记录最后在线时间并通知好友
+func (sim *SocketIOManager) presenceDisconnected(userID uint) {
+	p := sim.presence
+	p.mu.Lock()
+	if sim.userSocketMap.connected(userID) {
+		// 断开期间又有新连接建立
+		p.mu.Unlock()
+		return
+	}
+	delete(p.users, userID)
+	var stopped []typingKey
+	for key, entry := range p.typing {
+		if key.userID == userID {
+			entry.timer.Stop()
+			delete(p.typing, key)
+			stopped = append(stopped, key)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, key := range stopped {
+		sim.emitTyping(key, false)
+	}
+
+	now := time.Now()
+	if err := sim.baseInstance.DbManager.UpdateLastSeen(userID, now); err != nil {
+		logger.Error(fmt.Sprintf("记录用户 %d 最后在线时间失败:", userID), err)
+	}
+	sim.broadcastPresence(PresenceInfo{UserID: userID, Status: PresenceOffline, LastSeenAt: &now})
+}
+
+// 用户是否在线，离开状态不算在线，用于 @here 提及
+func (sim *SocketIOManager) isOnline(userID uint) bool {
+	sim.presence.mu.Lock()
+	defer sim.presence.mu.Unlock()
+	state := sim.presence.users[userID]
+	return state != nil && state.status == PresenceOnline
+}
+
+// 定期把超过 presenceAwayAfter 没有心跳的在线用户标记为离开
+func (sim *SocketIOManager) runPresenceSweeper() {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		deadline := time.Now().Add(-presenceAwayAfter)
+		var away []uint
+		sim.presence.mu.Lock()
+		for userID, state := range sim.presence.users {
+			if state.status == PresenceOnline && state.lastHeartbeat.Before(deadline) {
+				state.status = PresenceAway
+				away = append(away, userID)
+			}
+		}
+		sim.presence.mu.Unlock()
+
+		for _, userID := range away {
+			sim.broadcastPresence(PresenceInfo{UserID: userID, Status: PresenceAway})
+		}
+	}
+}
+
+// 在线状态只推送给能看到的好友，不写入事件日志
+func (sim *SocketIOManager) broadcastPresence(info PresenceInfo) {
+	friendIDs, err := sim.baseInstance.DbManager.PresenceAudience(info.UserID)
+	if err != nil {
+		logger.Error(fmt.Sprintf("获取用户 %d 的好友失败:", info.UserID), err)
+		return
+	}
+	if len(friendIDs) == 0 {
+		return
+	}
+	rooms := make([]socket.Room, 0, len(friendIDs))
+	for _, friendID := range friendIDs {
+		rooms = append(rooms, base.UserSocketRoom(friendID))
+	}
+	if err := sim.Io.To(rooms...).Emit("presence", info); err != nil {
+		logger.Error("推送在线状态失败:", err)
+	}
+}
+
+// 开始或刷新输入状态，typingTimeout 内没有刷新会自动结束。只在状态变化时推送
+func (sim *SocketIOManager) startTyping(key typingKey) {
+	p := sim.presence
+	entry := &typingEntry{}
+	entry.timer = time.AfterFunc(typingTimeout, func() {
+		sim.stopTyping(key, entry)
+	})
+
+	p.mu.Lock()
+	previous := p.typing[key]
+	p.typing[key] = entry
+	p.mu.Unlock()
+
+	if previous != nil {
+		previous.timer.Stop()
+		return
+	}
+	sim.emitTyping(key, true)
+}
+
+// 结束输入状态。only 不为 nil 时只结束对应的那一次（用于超时，避免结束已刷新的状态）
+func (sim *SocketIOManager) stopTyping(key typingKey, only *typingEntry) {
+	p := sim.presence
+	p.mu.Lock()
+	entry := p.typing[key]
+	if entry == nil || (only != nil && entry != only) {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.typing, key)
+	p.mu.Unlock()
+
+	entry.timer.Stop()
+	sim.emitTyping(key, false)
+}
+
+// 单聊推送给对方的所有设备，群聊推送给房间内除自己外的成员
+func (sim *SocketIOManager) emitTyping(key typingKey, typing bool) {
+	data := map[string]interface{}{"userId": key.userID, "typing": typing}
+	var operator *socket.BroadcastOperator
+	if key.roomID != 0 {
+		data["roomId"] = key.roomID
+		operator = sim.Io.To(base.RoomSocketRoom(key.roomID)).Except(base.UserSocketRoom(key.userID))
+	} else {
+		operator = sim.Io.To(base.UserSocketRoom(key.peerID))
+	}
+	if err := operator.Emit("typing", data); err != nil {
+		logger.Error("推送输入状态失败:", err)
+	}
+}
+
+// 心跳，客户端在用户有操作时定期发送，保持在线状态
+func (sim *SocketIOManager) handleHeartbeat(client *socket.Socket, args ...any) {
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+	sim.presenceHeartbeat(userID)
+}
+
+// 设置在线状态，参数为 "online" 或 "away"
+func (sim *SocketIOManager) handleSetPresence(client *socket.Socket, args ...any) {
+	status, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少在线状态或类型错误", err)
+		return
+	}
+	if status != PresenceOnline && status != PresenceAway {
+		emitError(client, "无效的在线状态", fmt.Errorf("不支持的状态: %s", status))
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+	sim.setPresence(userID, status)
+}
+
+// 查询在线状态，参数为 JSON 字符串：{"userIds": [用户 ID]}，只返回对自己可见的用户
+func (sim *SocketIOManager) handleGetPresence(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少查询参数或参数类型错误", err)
+		return
+	}
+	var request struct {
+		UserIDs []uint `json:"userIds"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的查询参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		result := []PresenceInfo{}
+		if len(request.UserIDs) == 0 {
+			client.Emit("getPresence", result)
+			return
+		}
+		dm := sim.baseInstance.DbManager
+		visible, err := dm.PresenceVisibleTo(userID, request.UserIDs)
+		if err != nil {
+			emitErrorAndLog(client, "获取在线状态失败", err)
+			return
+		}
+		lastSeen, err := dm.GetLastSeen(visible)
+		if err != nil {
+			emitErrorAndLog(client, "获取在线状态失败", err)
+			return
+		}
+
+		sim.presence.mu.Lock()
+		for _, id := range visible {
+			info := PresenceInfo{UserID: id, Status: PresenceOffline}
+			if state := sim.presence.users[id]; state != nil {
+				info.Status = state.status
+			} else if at, ok := lastSeen[id]; ok {
+				info.LastSeenAt = &at
+			}
+			result = append(result, info)
+		}
+		sim.presence.mu.Unlock()
+		client.Emit("getPresence", result)
+	}()
+}
+
+// 输入状态，参数为 JSON 字符串：{"peerId": 单聊对方, "roomId": 房间, "typing": 是否正在输入}
+func (sim *SocketIOManager) handleTyping(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少输入状态参数或参数类型错误", err)
+		return
+	}
+	var request struct {
+		PeerID uint `json:"peerId"`
+		RoomID uint `json:"roomId"`
+		Typing bool `json:"typing"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的输入状态参数", err)
+		return
+	}
+	if (request.PeerID == 0) == (request.RoomID == 0) {
+		emitError(client, "无效的输入状态参数", errors.New("必须且只能指定 peerId 或 roomId 之一"))
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+	key := typingKey{userID: userID, peerID: request.PeerID, roomID: request.RoomID}
+	if !request.Typing {
+		sim.stopTyping(key, nil)
+		return
+	}
+	if err := sim.baseInstance.DbManager.CheckTypingTarget(userID, request.PeerID, request.RoomID); err != nil {
+		emitError(client, "无权在该会话发送输入状态", err)
+		return
+	}
+	sim.startTyping(key)
+}
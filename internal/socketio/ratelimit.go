@@ -0,0 +1,28 @@
+package socketio
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+// 按事件策略检查当前用户，被限流时发送结构化的 error 事件并返回 false
+func (sim *SocketIOManager) allowEvent(client *socket.Socket, event string) bool {
+	key := "ip:" + clientIP(client)
+	if userID, err := sim.getUserIDFromSocket(client); err == nil {
+		key = fmt.Sprintf("user:%d", userID)
+	}
+
+	allowed, wait := sim.baseInstance.RateLimiter.Allow(key, "socket:"+event, "socket")
+	if !allowed {
+		seconds := int(math.Ceil(wait.Seconds()))
+		client.Emit("error", map[string]interface{}{
+			"code":       "rate_limited",
+			"event":      event,
+			"message":    fmt.Sprintf("请求过于频繁，请 %d 秒后再试", seconds),
+			"retryAfter": seconds,
+		})
+	}
+	return allowed
+}
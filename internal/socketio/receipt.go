@@ -0,0 +1,94 @@
+package socketio
+
+import (
+	"encoding/json"
+
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+// 确认消息已送达设备，参数为 JSON 字符串：{"peerId": 单聊对方, "roomId": 房间, "msgId": 收到的最后一条消息，为空表示最新}。
+// 送达位置之前的消息一并视为已送达，发送者会收到 "receipt" 事件
+func (sim *SocketIOManager) handleMarkDelivered(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少会话参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		PeerID uint   `json:"peerId"`
+		RoomID uint   `json:"roomId"`
+		MsgID  string `json:"msgId"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的会话参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		if _, err := sim.baseInstance.DbManager.MarkConversationDelivered(userID, request.PeerID, request.RoomID, request.MsgID); err != nil {
+			emitError(client, "确认送达失败", err)
+		}
+	}()
+}
+
+// 查询消息回执，参数为 JSON 字符串：{"peerId", "roomId", "msgIds": [消息 ID]}，结果通过 "getReceipts" 事件返回
+func (sim *SocketIOManager) handleGetReceipts(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少查询参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		PeerID uint     `json:"peerId"`
+		RoomID uint     `json:"roomId"`
+		MsgIDs []string `json:"msgIds"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的查询参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		receipts, err := sim.baseInstance.DbManager.GetReceipts(userID, request.PeerID, request.RoomID, request.MsgIDs)
+		if err != nil {
+			emitError(client, "获取消息回执失败", err)
+			return
+		}
+		client.Emit("getReceipts", receipts)
+	}()
+}
+
+// 查询房间成员的送达和已读位置，参数为房间 ID，结果通过 "getReadCursors" 事件返回
+func (sim *SocketIOManager) handleGetReadCursors(client *socket.Socket, args ...any) {
+	roomID, err := checkArgsAndType[uint](args, 0)
+	if err != nil {
+		emitError(client, "缺少房间 ID 或类型错误", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		cursors, err := sim.baseInstance.DbManager.GetRoomMemberCursors(userID, roomID)
+		if err != nil {
+			emitError(client, "获取成员已读位置失败", err)
+			return
+		}
+		client.Emit("getReadCursors", map[string]interface{}{"roomId": roomID, "cursors": cursors})
+	}()
+}
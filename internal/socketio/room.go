@@ -4,22 +4,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"sync"
 	"time"
 
+	"github.com/Ireoo/sixin-server/database"
 	"github.com/Ireoo/sixin-server/models"
 	"github.com/patrickmn/go-cache"
 	"github.com/zishang520/socket.io/v2/socket"
 )
 
 var roomCache = cache.New(5*time.Minute, 10*time.Minute)
-var roomUpdateLimiter = make(chan struct{}, 10) // 最多允许 10 个并发更新
-var pool = sync.Pool{
-	New: func() interface{} {
-		return &models.Room{}
-	},
+
+// 成员变化后清除相关用户的房间列表缓存
+func invalidateRoomCache(userIDs ...uint) {
+	for _, userID := range userIDs {
+		roomCache.Delete(fmt.Sprintf("rooms_user_%d", userID))
+	}
+}
+
+// 可选的第二个参数为目标用户 ID，缺省时为当前用户
+func targetUserArg(args []any, index int, userID uint) (uint, error) {
+	if len(args) <= index || args[index] == nil {
+		return userID, nil
+	}
+	return checkArgsAndType[uint](args, index)
 }
 
+// 全量重新加载，仅为兼容旧客户端保留；新客户端应使用 "sync" 增量同步
 func (sim *SocketIOManager) handleGetRooms(client *socket.Socket, args ...any) {
 	userID, err := sim.getUserIDFromSocket(client)
 	if err != nil {
@@ -52,9 +62,7 @@ func (sim *SocketIOManager) handleCreateRoom(client *socket.Socket, args ...any)
 		return
 	}
 
-	room := pool.Get().(*models.Room)
-	defer pool.Put(room)
-
+	room := &models.Room{}
 	if err := json.Unmarshal([]byte(data), room); err != nil {
 		emitError(client, "无效的房间数据", err)
 		return
@@ -73,27 +81,27 @@ func (sim *SocketIOManager) handleCreateRoom(client *socket.Socket, args ...any)
 			emitError(client, "创建房间失败", err)
 			return
 		}
-
-		if err := sim.baseInstance.DbManager.AddUserToRoom(userID, room.ID, "", false); err != nil {
-			emitError(client, "将用户添加到房间失败", err)
-			return
-		}
+		sim.baseInstance.DbManager.Audit(sim.auditContext(client), models.AuditLog{Action: models.AuditRoomCreate, TargetType: models.AuditTargetRoom, TargetID: room.ID, RoomID: room.ID},
+			nil, map[string]string{"name": room.Name, "avatar": room.Avatar})
+		invalidateRoomCache(userID)
 
 		client.Emit("roomCreated", room)
 	}()
 }
 
 func (sim *SocketIOManager) handleUpdateRoom(client *socket.Socket, args ...any) {
-	roomUpdateLimiter <- struct{}{}        // 获取并发槽
-	defer func() { <-roomUpdateLimiter }() // 请求完成后释放槽
-
 	data, err := checkArgsAndType[string](args, 0)
 	if err != nil {
 		emitError(client, "缺少房间更新数据或数据类型错误", err)
 		return
 	}
 
-	var updatedRoom models.Room
+	// 名称和头像使用指针，区分未修改和修改为空
+	var updatedRoom struct {
+		ID     uint
+		Name   *string
+		Avatar *string
+	}
 	if err := json.Unmarshal([]byte(data), &updatedRoom); err != nil {
 		emitError(client, "无效的房间数据", err)
 		return
@@ -110,15 +118,32 @@ func (sim *SocketIOManager) handleUpdateRoom(client *socket.Socket, args ...any)
 		return
 	}
 	go func() {
-		if sim.baseInstance.DbManager.CheckUserRoom(userID, updatedRoom.ID) != nil {
-			emitError(client, "没有权限更新房间", nil)
-			return
+		dm := sim.baseInstance.DbManager
+		updates := make(map[string]interface{})
+		if updatedRoom.Name != nil {
+			if _, err := dm.CheckRoomPermission(userID, updatedRoom.ID, database.ActionRename); err != nil {
+				emitError(client, "更新房间失败", err)
+				return
+			}
+			updates["name"] = *updatedRoom.Name
+		}
+		if updatedRoom.Avatar != nil {
+			if _, err := dm.CheckRoomPermission(userID, updatedRoom.ID, database.ActionChangeAvatar); err != nil {
+				emitError(client, "更新房间失败", err)
+				return
+			}
+			updates["avatar"] = *updatedRoom.Avatar
 		}
 
-		if err := sim.baseInstance.DbManager.UpdateRoomByOwner(userID, updatedRoom.ID, updatedRoom); err != nil {
+		before, _ := dm.GetRoomByID(userID, updatedRoom.ID)
+		if err := dm.UpdateRoomInfo(updatedRoom.ID, updates); err != nil {
 			emitError(client, "更新房间失败", err)
 			return
 		}
+		if len(updates) > 0 {
+			dm.Audit(sim.auditContext(client), models.AuditLog{Action: models.AuditRoomUpdate, TargetType: models.AuditTargetRoom, TargetID: updatedRoom.ID, RoomID: updatedRoom.ID},
+				map[string]string{"name": before.Name, "avatar": before.Avatar}, updates)
+		}
 
 		client.Emit("roomUpdated", updatedRoom)
 	}()
@@ -144,15 +169,21 @@ func (sim *SocketIOManager) handleDeleteRoom(client *socket.Socket, args ...any)
 	}
 
 	go func() {
-		if sim.baseInstance.DbManager.CheckUserRoom(userID, uint(roomIDUint)) != nil {
-			emitError(client, "没有权限更新房间", nil)
+		dm := sim.baseInstance.DbManager
+		if _, err := dm.CheckRoomPermission(userID, uint(roomIDUint), database.ActionDeleteRoom); err != nil {
+			emitError(client, "删除房间失败", err)
 			return
 		}
 
-		if err := sim.baseInstance.DbManager.DeleteRoom(userID, uint(roomIDUint)); err != nil {
+		memberIDs, _ := dm.GetRoomMemberIDs(uint(roomIDUint))
+		before, _ := dm.GetRoomByID(userID, uint(roomIDUint))
+		if err := dm.DeleteRoom(uint(roomIDUint)); err != nil {
 			emitError(client, "删除房间失败", err)
 			return
 		}
+		dm.Audit(sim.auditContext(client), models.AuditLog{Action: models.AuditRoomDelete, TargetType: models.AuditTargetRoom, TargetID: uint(roomIDUint), RoomID: uint(roomIDUint)},
+			map[string]interface{}{"name": before.Name, "ownerId": before.OwnerID}, nil)
+		invalidateRoomCache(memberIDs...)
 
 		client.Emit("roomDeleted", roomIDStr)
 	}()
@@ -171,15 +202,27 @@ func (sim *SocketIOManager) handleAddUserToRoom(client *socket.Socket, args ...a
 		return
 	}
 
+	targetID, err := targetUserArg(args, 1, userID)
+	if err != nil {
+		emitError(client, "用户ID类型错误", err)
+		return
+	}
+
 	// 使用 goroutine 池处理添加用户请求
 	go func() {
-		err = sim.baseInstance.DbManager.AddUserToRoom(userID, roomID, "", false)
-		if err != nil {
+		dm := sim.baseInstance.DbManager
+		if _, err := dm.CheckRoomPermission(userID, roomID, database.ActionInvite); err != nil {
+			emitError(client, "将用户添加到房间失败", err)
+			return
+		}
+		if err := dm.AddUserToRoom(targetID, roomID, "", false, ""); err != nil {
 			emitError(client, "将用户添加到房间失败", err)
 			return
 		}
+		dm.AuditMemberAdd(sim.auditContext(client), targetID, roomID)
+		invalidateRoomCache(targetID)
 
-		client.Emit("userAddedToRoom", map[string]uint{"userID": userID, "roomID": roomID})
+		client.Emit("userAddedToRoom", map[string]uint{"userID": targetID, "roomID": roomID})
 	}()
 }
 
@@ -196,14 +239,27 @@ func (sim *SocketIOManager) handleRemoveUserFromRoom(client *socket.Socket, args
 		return
 	}
 
+	targetID, err := targetUserArg(args, 1, userID)
+	if err != nil {
+		emitError(client, "用户ID类型错误", err)
+		return
+	}
+
 	go func() {
-		err = sim.baseInstance.DbManager.RemoveUserFromRoom(userID, roomID)
-		if err != nil {
+		dm := sim.baseInstance.DbManager
+		if err := dm.CheckRemoveMember(userID, targetID, roomID); err != nil {
+			emitError(client, "将用户从房间移除失败", err)
+			return
+		}
+		before, _ := dm.GetMembership(targetID, roomID)
+		if err := dm.RemoveUserFromRoom(targetID, roomID); err != nil {
 			emitError(client, "将用户从房间移除失败", err)
 			return
 		}
+		dm.AuditMemberRemove(sim.auditContext(client), before)
+		invalidateRoomCache(targetID)
 
-		client.Emit("userRemovedFromRoom", map[string]uint{"userID": userID, "roomID": roomID})
+		client.Emit("userRemovedFromRoom", map[string]uint{"userID": targetID, "roomID": roomID})
 	}()
 }
 
@@ -227,11 +283,14 @@ func (sim *SocketIOManager) handleUpdateRoomAlias(client *socket.Socket, args ..
 	}
 
 	go func() {
-		err = sim.baseInstance.DbManager.UpdateRoomAlias(userID, roomID, alias)
+		dm := sim.baseInstance.DbManager
+		before, _ := dm.GetMembership(userID, roomID)
+		err = dm.UpdateRoomAlias(userID, roomID, alias)
 		if err != nil {
 			emitError(client, "更新房间别名失败", err)
 			return
 		}
+		dm.AuditMemberChange(sim.auditContext(client), before, &alias, nil)
 
 		client.Emit("roomAliasUpdated", map[string]interface{}{"userID": userID, "roomID": roomID, "alias": alias})
 	}()
@@ -257,11 +316,14 @@ func (sim *SocketIOManager) handleSetRoomPrivacy(client *socket.Socket, args ...
 	}
 
 	go func() {
-		err = sim.baseInstance.DbManager.SetRoomPrivacy(roomID, userID, privacy)
+		dm := sim.baseInstance.DbManager
+		before, _ := dm.GetMembership(userID, roomID)
+		err = dm.SetRoomPrivacy(userID, roomID, privacy)
 		if err != nil {
 			emitError(client, "设置房间隐私失败", err)
 			return
 		}
+		dm.AuditMemberChange(sim.auditContext(client), before, nil, &privacy)
 
 		client.Emit("roomPrivacySet", map[string]interface{}{"roomID": roomID, "userID": userID, "privacy": privacy})
 	}()
@@ -291,3 +353,56 @@ func (sim *SocketIOManager) handleGetRoomByUsers(client *socket.Socket, args ...
 		client.Emit("getRoomByUsers", room)
 	}()
 }
+
+// 置顶消息，参数为房间 ID 和消息 msgId
+func (sim *SocketIOManager) handlePinMessage(client *socket.Socket, args ...any) {
+	sim.handlePin(client, true, args...)
+}
+
+func (sim *SocketIOManager) handleUnpinMessage(client *socket.Socket, args ...any) {
+	sim.handlePin(client, false, args...)
+}
+
+func (sim *SocketIOManager) handlePin(client *socket.Socket, pin bool, args ...any) {
+	roomID, err := checkArgsAndType[uint](args, 0)
+	if err != nil {
+		emitError(client, "缺少房间ID或ID类型错误", err)
+		return
+	}
+
+	msgID, err := checkArgsAndType[string](args, 1)
+	if err != nil || msgID == "" {
+		emitError(client, "缺少消息ID或ID类型错误", err)
+		return
+	}
+
+	userID, err := sim.getUserIDFromSocket(client)
+	if err != nil {
+		emitError(client, "获取用户ID失败", err)
+		return
+	}
+
+	go func() {
+		dm := sim.baseInstance.DbManager
+		if _, err := dm.CheckRoomPermission(userID, roomID, database.ActionPin); err != nil {
+			emitError(client, "置顶消息失败", err)
+			return
+		}
+
+		if !pin {
+			if err := dm.UnpinMessage(roomID, msgID); err != nil {
+				emitError(client, "取消置顶失败", err)
+				return
+			}
+			client.Emit("messageUnpinned", map[string]interface{}{"roomID": roomID, "msgId": msgID})
+			return
+		}
+
+		pinned, err := dm.PinMessage(roomID, msgID, userID)
+		if err != nil {
+			emitError(client, "置顶消息失败", err)
+			return
+		}
+		client.Emit("messagePinned", pinned)
+	}()
+}
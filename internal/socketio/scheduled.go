@@ -0,0 +1,104 @@
+package socketio
+
+import (
+	"encoding/json"
+
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/models"
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+func (sim *SocketIOManager) handleGetScheduledMessages(client *socket.Socket, args ...any) {
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		scheduled, err := sim.baseInstance.DbManager.ListScheduledMessages(userID)
+		if err != nil {
+			emitErrorAndLog(client, "获取定时消息失败", err)
+			return
+		}
+		client.Emit("getScheduledMessages", scheduled)
+	}()
+}
+
+// 创建定时消息，参数为 JSON 字符串，与发送消息相同，另加 "sendAt"（RFC 3339 时间）。
+// 作者的所有设备会收到 "scheduledMessageUpdated" 事件，之后的修改、取消和发送结果也一样
+func (sim *SocketIOManager) handleScheduleMessage(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少消息参数或参数类型错误", err)
+		return
+	}
+
+	scheduled := &models.ScheduledMessage{}
+	if err := json.Unmarshal([]byte(data), scheduled); err != nil {
+		emitError(client, "无效的消息参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+	scheduled.UserID = userID
+
+	go func() {
+		cfg := sim.baseInstance.Cfg
+		if err := sim.baseInstance.DbManager.CreateScheduledMessage(scheduled, cfg.ScheduledMessageMaxDelay, cfg.ScheduledMessageMaxPending); err != nil {
+			emitError(client, "创建定时消息失败", err)
+		}
+	}()
+}
+
+// 修改待发送的定时消息，参数为 JSON 字符串：{"id", "text", "mentionIdList", "sendAt"}，未提供的字段不修改
+func (sim *SocketIOManager) handleUpdateScheduledMessage(client *socket.Socket, args ...any) {
+	data, err := checkArgsAndType[string](args, 0)
+	if err != nil {
+		emitError(client, "缺少消息参数或参数类型错误", err)
+		return
+	}
+
+	var request struct {
+		ID uint `json:"id"`
+		database.ScheduledMessageUpdate
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		emitError(client, "无效的消息参数", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		maxDelay := sim.baseInstance.Cfg.ScheduledMessageMaxDelay
+		if _, err := sim.baseInstance.DbManager.UpdateScheduledMessage(userID, request.ID, request.ScheduledMessageUpdate, maxDelay); err != nil {
+			emitError(client, "修改定时消息失败", err)
+		}
+	}()
+}
+
+// 取消待发送的定时消息，参数为定时消息 ID
+func (sim *SocketIOManager) handleCancelScheduledMessage(client *socket.Socket, args ...any) {
+	id, err := checkArgsAndType[uint](args, 0)
+	if err != nil {
+		emitError(client, "缺少定时消息 ID 或类型错误", err)
+		return
+	}
+
+	userID, err := sim.getUserIDOrEmitError(client)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		if _, err := sim.baseInstance.DbManager.CancelScheduledMessage(userID, id); err != nil {
+			emitError(client, "取消定时消息失败", err)
+		}
+	}()
+}
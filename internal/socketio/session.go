@@ -0,0 +1,72 @@
+package socketio
+
+import (
+	"log"
+
+	"github.com/Ireoo/sixin-server/models"
+	"github.com/zishang520/socket.io/v2/socket"
+)
+
+// 记录连接所属会话的设备信息和活跃时间
+func (sim *SocketIOManager) touchSession(client *socket.Socket, sessionID uint) {
+	deviceType, _ := client.Request().Query().Get("type")
+	device := models.Session{
+		DeviceType: deviceType,
+		IP:         clientIP(client),
+		UserAgent:  client.Request().UserAgent(),
+	}
+	if err := sim.baseInstance.DbManager.TouchSession(sessionID, device); err != nil {
+		log.Printf("更新会话 %d 活跃时间失败: %v", sessionID, err)
+	}
+}
+
+func (sim *SocketIOManager) handleGetSessions(client *socket.Socket, args ...any) {
+	userID, err := sim.getUserIDFromSocket(client)
+	if err != nil {
+		emitError(client, "获取用户ID失败", err)
+		return
+	}
+	currentSessionID, err := sim.getSessionIDFromSocket(client)
+	if err != nil {
+		emitError(client, "获取会话ID失败", err)
+		return
+	}
+
+	go func() {
+		sessions, err := sim.baseInstance.DbManager.GetActiveSessions(userID)
+		if err != nil {
+			emitError(client, "获取会话列表失败", err)
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == currentSessionID
+		}
+
+		client.Emit("getSessions", sessions)
+	}()
+}
+
+func (sim *SocketIOManager) handleTerminateSession(client *socket.Socket, args ...any) {
+	sessionID, err := checkArgsAndType[uint](args, 0)
+	if err != nil {
+		emitError(client, "缺少会话ID或ID类型错误", err)
+		return
+	}
+
+	userID, err := sim.getUserIDFromSocket(client)
+	if err != nil {
+		emitError(client, "获取用户ID失败", err)
+		return
+	}
+
+	go func() {
+		if err := sim.baseInstance.DbManager.RevokeUserSession(userID, sessionID); err != nil {
+			emitError(client, "退出会话失败", err)
+			return
+		}
+
+		// 先回复再断开，终止的可能是当前会话
+		client.Emit("sessionTerminated", sessionID)
+		sim.baseInstance.DisconnectSessions(sessionID)
+	}()
+}
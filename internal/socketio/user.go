@@ -7,6 +7,7 @@ import (
 	"github.com/zishang520/socket.io/v2/socket"
 )
 
+// 全量重新加载，仅为兼容旧客户端保留；新客户端应使用 "sync" 增量同步
 func (sim *SocketIOManager) handleGetUsers(client *socket.Socket, args ...any) {
 	go func() {
 		users, err := sim.baseInstance.DbManager.GetAllUsers()
@@ -59,12 +60,16 @@ func (sim *SocketIOManager) handleDeleteUser(client *socket.Socket, args ...any)
 		return
 	}
 	go func() {
-		if err := sim.baseInstance.DbManager.DeleteUser(userID); err != nil {
+		sessionIDs, err := sim.baseInstance.DbManager.DeleteUser(userID)
+		if err != nil {
 			emitError(client, "删除用户失败", err)
 			return
 		}
+		sim.baseInstance.DbManager.Audit(sim.auditContext(client), models.AuditLog{Action: models.AuditUserDelete, TargetType: models.AuditTargetUser, TargetID: userID}, nil, nil)
 
 		client.Emit("userDeleted", userID)
+		// 已删除用户的会话全部撤销，断开包括当前连接在内的所有连接
+		sim.baseInstance.DisconnectSessions(sessionIDs...)
 	}()
 }
 
@@ -86,6 +91,7 @@ func (sim *SocketIOManager) handleAddFriend(client *socket.Socket, args ...any)
 			emitError(client, "添加好友失败", err)
 			return
 		}
+		sim.baseInstance.DbManager.Audit(sim.auditContext(client), models.AuditLog{Action: models.AuditFriendAdd, TargetType: models.AuditTargetUser, TargetID: friendID}, nil, nil)
 
 		client.Emit("friendAdded", map[string]uint{"userID": userID, "friendID": friendID})
 	}()
@@ -104,11 +110,17 @@ func (sim *SocketIOManager) handleRemoveFriend(client *socket.Socket, args ...an
 		return
 	}
 	go func() {
-		err = sim.baseInstance.DbManager.RemoveFriend(userID, friendID)
+		dm := sim.baseInstance.DbManager
+		before, _ := dm.GetFriendship(userID, friendID)
+		err = dm.RemoveFriend(userID, friendID)
 		if err != nil {
 			emitError(client, "删除好友失败", err)
 			return
 		}
+		if before != nil {
+			dm.Audit(sim.auditContext(client), models.AuditLog{Action: models.AuditFriendRemove, TargetType: models.AuditTargetUser, TargetID: friendID},
+				map[string]interface{}{"alias": before.Alias, "isPrivate": before.IsPrivate}, nil)
+		}
 
 		client.Emit("friendRemoved", map[string]uint{"userID": userID, "friendID": friendID})
 	}()
@@ -133,11 +145,14 @@ func (sim *SocketIOManager) handleUpdateFriendAlias(client *socket.Socket, args
 		return
 	}
 	go func() {
-		err = sim.baseInstance.DbManager.UpdateFriendAlias(userID, friendID, alias)
+		dm := sim.baseInstance.DbManager
+		before, _ := dm.GetFriendship(userID, friendID)
+		err = dm.UpdateFriendAlias(userID, friendID, alias)
 		if err != nil {
 			emitError(client, "更新好友别名失败", err)
 			return
 		}
+		dm.AuditFriendChange(sim.auditContext(client), before, &alias, nil)
 
 		client.Emit("friendAliasUpdated", map[string]interface{}{"userID": userID, "friendID": friendID, "alias": alias})
 	}()
@@ -162,11 +177,14 @@ func (sim *SocketIOManager) handleSetFriendPrivacy(client *socket.Socket, args .
 		return
 	}
 	go func() {
-		err = sim.baseInstance.DbManager.SetFriendPrivacy(userID, friendID, privacy)
+		dm := sim.baseInstance.DbManager
+		before, _ := dm.GetFriendship(userID, friendID)
+		err = dm.SetFriendPrivacy(userID, friendID, privacy)
 		if err != nil {
 			emitError(client, "设置好友隐私失败", err)
 			return
 		}
+		dm.AuditFriendChange(sim.auditContext(client), before, nil, &privacy)
 
 		client.Emit("friendPrivacySet", map[string]interface{}{"userID": userID, "friendID": friendID, "privacy": privacy})
 	}()
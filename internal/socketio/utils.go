@@ -12,6 +12,12 @@ func checkArgsAndType[T any](args []any, index int) (T, error) {
 	}
 	value, ok := args[index].(T)
 	if !ok {
+		// JSON 中的数字会被解码为 float64，需要转换为 ID 使用的 uint
+		if number, isNumber := args[index].(float64); isNumber && number >= 0 && number == float64(uint(number)) {
+			if converted, ok := any(uint(number)).(T); ok {
+				return converted, nil
+			}
+		}
 		return *new(T), fmt.Errorf("argument at index %d has incorrect type", index)
 	}
 	return value, nil
@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Ireoo/sixin-server/base"
+	"github.com/Ireoo/sixin-server/database"
+	"github.com/Ireoo/sixin-server/internal/middleware"
 	"github.com/Ireoo/sixin-server/models"
 	"github.com/gorilla/websocket"
 )
@@ -19,54 +22,118 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// 通过 Sec-WebSocket-Protocol 传递令牌时使用的子协议名，格式为 "bearer, <token>"
+const bearerSubprotocol = "bearer"
+
+// Conn 一个已认证的 WebSocket 连接，gorilla/websocket 不支持并发写，写操作需加锁
+type Conn struct {
+	*websocket.Conn
+	writeMu   sync.Mutex
+	UserID    uint
+	SessionID uint
+	IP        string
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
 type WebSocketManager struct {
-	connections  map[string][]*websocket.Conn
+	connections  map[string][]*Conn
 	mu           sync.RWMutex
 	baseInstance *base.Base
 }
 
 func NewWebSocketManager(base *base.Base) *WebSocketManager {
 	return &WebSocketManager{
-		connections:  make(map[string][]*websocket.Conn),
+		connections:  make(map[string][]*Conn),
 		baseInstance: base,
 	}
 }
 
+// 从查询参数 token、Sec-WebSocket-Protocol 或 Authorization 头中读取访问令牌，
+// 返回令牌和需要回应的子协议
+func extractToken(r *http.Request) (string, string) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, ""
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if strings.EqualFold(protocol, bearerSubprotocol) && i+1 < len(protocols) {
+			return protocols[i+1], protocol
+		}
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), ""
+	}
+	return "", ""
+}
+
 func (wsm *WebSocketManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	log.Printf("收到WebSocket连接请求: %s", r.URL)
-	// 移除身份验证中间件
-	conn, err := upgrader.Upgrade(w, r, nil)
+	log.Printf("收到WebSocket连接请求: %s", r.URL.Path)
+
+	// 握手前使用与 HTTP 相同的 JWT 进行认证
+	token, subprotocol := extractToken(r)
+	if token == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	claims, err := middleware.ValidateJWT(token)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {subprotocol}}
+	}
+	wsConn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Printf("WebSocket升级失败: %v", err)
 		return
 	}
-	defer conn.Close()
+	defer wsConn.Close()
 
-	// 由于没有身份验证，我们需要一种方式来识别用户
-	// 这里使用一个简单的随机ID作为示例
-	userID := uint(rand.Uint32())
+	conn := &Conn{Conn: wsConn, UserID: claims.UserID, SessionID: claims.SessionID, IP: middleware.ClientIP(r)}
 
 	// 处理WebSocket连接
-	wsm.handleConnection(conn, userID, r)
+	wsm.handleConnection(conn, r)
 }
 
-func (wsm *WebSocketManager) handleConnection(conn *websocket.Conn, userID uint, r *http.Request) {
+func (wsm *WebSocketManager) handleConnection(conn *Conn, r *http.Request) {
 	connType := r.URL.Query().Get("type")
 	if connType == "" {
 		connType = "web"
 	}
 
-	userConnType := fmt.Sprintf("user_%d", userID)
+	device := models.Session{DeviceType: connType, IP: middleware.ClientIP(r), UserAgent: r.UserAgent()}
+	if err := wsm.baseInstance.DbManager.TouchSession(conn.SessionID, device); err != nil {
+		log.Printf("更新会话 %d 失败: %v", conn.SessionID, err)
+	}
+	defer func() {
+		if err := wsm.baseInstance.DbManager.TouchSession(conn.SessionID, models.Session{}); err != nil {
+			log.Printf("更新会话 %d 失败: %v", conn.SessionID, err)
+		}
+	}()
+
+	userConnType := fmt.Sprintf("user_%d", conn.UserID)
 	wsm.addConnection(userConnType, conn)
 	defer wsm.removeConnection(userConnType, conn)
 
-	// 发送一个欢迎消息，包含分配的userID
+	// 发送一个欢迎消息，包含当前用户和会话
 	welcomeMsg := map[string]interface{}{
-		"type":   "welcome",
-		"userID": userID,
+		"type":      "welcome",
+		"userID":    conn.UserID,
+		"sessionID": conn.SessionID,
 	}
 	welcomeMsgJSON, _ := json.Marshal(welcomeMsg)
 	conn.WriteMessage(websocket.TextMessage, welcomeMsgJSON)
+	wsm.replayMissedEvents(conn)
 
 	for {
 		_, message, err := conn.ReadMessage()
@@ -74,17 +141,17 @@ func (wsm *WebSocketManager) handleConnection(conn *websocket.Conn, userID uint,
 			log.Printf("WebSocket读取错误: %v", err)
 			break
 		}
-		wsm.handleMessage(message, userID)
+		wsm.handleMessage(conn, message)
 	}
 }
 
-func (wsm *WebSocketManager) addConnection(connType string, conn *websocket.Conn) {
+func (wsm *WebSocketManager) addConnection(connType string, conn *Conn) {
 	wsm.mu.Lock()
 	defer wsm.mu.Unlock()
 	wsm.connections[connType] = append(wsm.connections[connType], conn)
 }
 
-func (wsm *WebSocketManager) removeConnection(connType string, conn *websocket.Conn) {
+func (wsm *WebSocketManager) removeConnection(connType string, conn *Conn) {
 	wsm.mu.Lock()
 	defer wsm.mu.Unlock()
 	connections := wsm.connections[connType]
@@ -94,64 +161,122 @@ func (wsm *WebSocketManager) removeConnection(connType string, conn *websocket.C
 			break
 		}
 	}
+	if len(wsm.connections[connType]) == 0 {
+		delete(wsm.connections, connType)
+	}
 }
 
-func (wsm *WebSocketManager) handleMessage(msgBytes []byte, userID uint) {
+// DisconnectSessions 关闭属于指定会话的连接，会话被撤销时调用
+func (wsm *WebSocketManager) DisconnectSessions(sessionIDs ...uint) {
+	revoked := make(map[uint]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		revoked[id] = true
+	}
+
+	wsm.mu.RLock()
+	defer wsm.mu.RUnlock()
+	for _, connections := range wsm.connections {
+		for _, conn := range connections {
+			if !revoked[conn.SessionID] {
+				continue
+			}
+			conn.writeMu.Lock()
+			conn.Conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked"),
+				time.Now().Add(time.Second))
+			conn.writeMu.Unlock()
+			// 关闭底层连接，读循环随之退出并移除连接
+			conn.Close()
+		}
+	}
+}
+
+func (wsm *WebSocketManager) handleMessage(conn *Conn, msgBytes []byte) {
 	// 解析通用消息结构
 	var genericMessage struct {
 		Type string          `json:"type"`
 		Data json.RawMessage `json:"data"`
 	}
 	if err := json.Unmarshal(msgBytes, &genericMessage); err != nil {
-		log.Printf("解析消息失败: %v", err)
+		wsm.sendError(conn, "", fmt.Errorf("解析消息失败: %w", err))
 		return
 	}
 
+	userID := conn.UserID
+	var err error
 	// 根据消息类型处理不同的操作
 	switch genericMessage.Type {
 	case "message":
 		var message models.Message
-		if err := json.Unmarshal(genericMessage.Data, &message); err != nil {
-			log.Printf("解析消息数据失败: %v", err)
-			return
+		if err = json.Unmarshal(genericMessage.Data, &message); err != nil {
+			err = fmt.Errorf("解析消息数据失败: %w", err)
+			break
 		}
 		message.TalkerID = userID // 使用身份验证获取的用户ID
-		wsm.handleChatMessage(&message)
+		err = wsm.handleChatMessage(&message)
 	case "addFriend":
-		wsm.handleAddFriend(genericMessage.Data, userID)
+		err = wsm.handleAddFriend(genericMessage.Data, userID, conn.auditContext())
 	case "removeFriend":
-		wsm.handleRemoveFriend(genericMessage.Data, userID)
+		err = wsm.handleRemoveFriend(genericMessage.Data, userID, conn.auditContext())
 	case "updateFriendAlias":
-		wsm.handleUpdateFriendAlias(genericMessage.Data, userID)
+		err = wsm.handleUpdateFriendAlias(genericMessage.Data, userID, conn.auditContext())
 	case "setFriendPrivacy":
-		wsm.handleSetFriendPrivacy(genericMessage.Data, userID)
+		err = wsm.handleSetFriendPrivacy(genericMessage.Data, userID, conn.auditContext())
 	case "addUserToRoom":
-		wsm.handleAddUserToRoom(genericMessage.Data, userID)
+		err = wsm.handleAddUserToRoom(genericMessage.Data, userID, conn.auditContext())
 	case "removeUserFromRoom":
-		wsm.handleRemoveUserFromRoom(genericMessage.Data, userID)
+		err = wsm.handleRemoveUserFromRoom(genericMessage.Data, userID, conn.auditContext())
 	case "updateRoomAlias":
-		wsm.handleUpdateRoomAlias(genericMessage.Data, userID)
+		err = wsm.handleUpdateRoomAlias(genericMessage.Data, userID, conn.auditContext())
 	case "setRoomPrivacy":
-		wsm.handleSetRoomPrivacy(genericMessage.Data, userID)
+		err = wsm.handleSetRoomPrivacy(genericMessage.Data, userID, conn.auditContext())
 	case "getRoomAliasByUsers":
-		wsm.handleGetRoomAliasByUsers(genericMessage.Data, userID)
+		err = wsm.handleGetRoomAliasByUsers(genericMessage.Data, userID)
+	case "ack":
+		err = wsm.handleAck(genericMessage.Data, conn)
+	case "pinMessage":
+		err = wsm.handlePinMessage(genericMessage.Data, userID, true)
+	case "unpinMessage":
+		err = wsm.handlePinMessage(genericMessage.Data, userID, false)
 	default:
-		log.Printf("未知的消息类型: %s", genericMessage.Type)
+		err = fmt.Errorf("未知的消息类型: %s", genericMessage.Type)
+	}
+
+	if err != nil {
+		wsm.sendError(conn, genericMessage.Type, err)
+	}
+}
+
+// 审计所需的操作者、会话和连接 IP
+func (c *Conn) auditContext() database.AuditContext {
+	return database.AuditContext{ActorID: c.UserID, SessionID: c.SessionID, IP: c.IP, Source: database.AuditSourceWebSocket}
+}
+
+// 将处理失败的原因回复给发起请求的连接，权限不足等错误客户端需要知道
+func (wsm *WebSocketManager) sendError(conn *Conn, event string, err error) {
+	log.Printf("处理 WebSocket 消息 %s 失败: %v", event, err)
+
+	errorMsg := map[string]interface{}{
+		"type":    "error",
+		"event":   event,
+		"message": err.Error(),
+	}
+	errorJSON, _ := json.Marshal(errorMsg)
+	if err := conn.WriteMessage(websocket.TextMessage, errorJSON); err != nil {
+		log.Printf("发送错误消息失败: %v", err)
 	}
 }
 
 // 新增函数处理获取房间别名
-func (wsm *WebSocketManager) handleGetRoomAliasByUsers(data json.RawMessage, userID uint) {
+func (wsm *WebSocketManager) handleGetRoomAliasByUsers(data json.RawMessage, userID uint) error {
 	var roomID uint
 	if err := json.Unmarshal(data, &roomID); err != nil {
-		log.Printf("解析房间ID失败: %v", err)
-		return
+		return fmt.Errorf("解析房间ID失败: %w", err)
 	}
 
 	aliases, err := wsm.baseInstance.DbManager.GetRoomAliasByUsers(userID, roomID)
 	if err != nil {
-		log.Printf("获取房间别名失败: %v", err)
-		return
+		return fmt.Errorf("获取房间别名失败: %w", err)
 	}
 
 	response := map[string]interface{}{
@@ -160,198 +285,247 @@ func (wsm *WebSocketManager) handleGetRoomAliasByUsers(data json.RawMessage, use
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		log.Printf("序列化响应失败: %v", err)
-		return
+		return fmt.Errorf("序列化响应失败: %w", err)
 	}
 
-	wsm.sendMessageToUsers(responseJSON, userID)
+	wsm.SendMessageToUsers(responseJSON, userID)
+	return nil
 }
 
 // 新增函数处理聊天消息
-func (wsm *WebSocketManager) handleChatMessage(message *models.Message) {
-	if err := wsm.baseInstance.DbManager.CreateMessage(message); err != nil {
-		log.Printf("保存消息失败: %v", err)
-		return
-	}
-
-	fullMessage, err := wsm.baseInstance.DbManager.GetFullMessage(message.ID)
-	if err != nil {
-		log.Printf("加载完整消息数据失败: %v", err)
-		return
-	}
-
-	var recipientID uint
-	if message.ListenerID != 0 {
-		recipientID = message.ListenerID
-	} else {
-		recipientID = message.RoomID
+func (wsm *WebSocketManager) handleChatMessage(message *models.Message) error {
+	if _, err := wsm.baseInstance.PostMessage(message); err != nil {
+		return fmt.Errorf("发送消息失败: %w", err)
 	}
-
-	wsm.sendMessageToUsers(fullMessage, message.TalkerID, recipientID)
+	return nil
 }
 
-func (wsm *WebSocketManager) handleAddFriend(data json.RawMessage, userID uint) {
+func (wsm *WebSocketManager) handleAddFriend(data json.RawMessage, userID uint, ac database.AuditContext) error {
 	var friendRequest struct {
 		FriendID  uint   `json:"friend_id"`
 		Alias     string `json:"alias"`
 		IsPrivate bool   `json:"is_private"`
 	}
 	if err := json.Unmarshal(data, &friendRequest); err != nil {
-		log.Printf("解析添加好友请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析添加好友请求数据失败: %w", err)
 	}
 
 	err := wsm.baseInstance.DbManager.AddFriend(userID, friendRequest.FriendID, friendRequest.Alias, friendRequest.IsPrivate)
 	if err != nil {
-		log.Printf("添加好友失败: %v", err)
-		return
+		return fmt.Errorf("添加好友失败: %w", err)
 	}
+	wsm.baseInstance.DbManager.Audit(ac, models.AuditLog{Action: models.AuditFriendAdd, TargetType: models.AuditTargetUser, TargetID: friendRequest.FriendID},
+		nil, map[string]interface{}{"alias": friendRequest.Alias, "isPrivate": friendRequest.IsPrivate})
 
 	// 发送通知给相关用户
 	wsm.sendNotification(userID, "好友添加成功")
 	wsm.sendNotification(friendRequest.FriendID, "您有新的好友请求")
+	return nil
 }
 
-func (wsm *WebSocketManager) handleRemoveFriend(data []byte, userID uint) {
+func (wsm *WebSocketManager) handleRemoveFriend(data []byte, userID uint, ac database.AuditContext) error {
 	var friendRequest struct {
 		FriendID uint `json:"friend_id"`
 	}
 	if err := json.Unmarshal(data, &friendRequest); err != nil {
-		log.Printf("解析删除好友请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析删除好友请求数据失败: %w", err)
 	}
 
-	err := wsm.baseInstance.DbManager.RemoveFriend(userID, friendRequest.FriendID)
+	dm := wsm.baseInstance.DbManager
+	before, _ := dm.GetFriendship(userID, friendRequest.FriendID)
+	err := dm.RemoveFriend(userID, friendRequest.FriendID)
 	if err != nil {
-		log.Printf("删除好友失败: %v", err)
-		return
+		return fmt.Errorf("删除好友失败: %w", err)
+	}
+	if before != nil {
+		dm.Audit(ac, models.AuditLog{Action: models.AuditFriendRemove, TargetType: models.AuditTargetUser, TargetID: friendRequest.FriendID},
+			map[string]interface{}{"alias": before.Alias, "isPrivate": before.IsPrivate}, nil)
 	}
 
 	// 发送通知给相关用户
 	wsm.sendNotification(userID, "好友删除成功")
 	wsm.sendNotification(friendRequest.FriendID, "您已被移除好友列表")
+	return nil
 }
 
-func (wsm *WebSocketManager) handleUpdateFriendAlias(data []byte, userID uint) {
+func (wsm *WebSocketManager) handleUpdateFriendAlias(data []byte, userID uint, ac database.AuditContext) error {
 	var aliasRequest struct {
 		FriendID uint   `json:"friend_id"`
 		Alias    string `json:"alias"`
 	}
 	if err := json.Unmarshal(data, &aliasRequest); err != nil {
-		log.Printf("解析更新好友别名请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析更新好友别名请求数据失败: %w", err)
 	}
 
-	err := wsm.baseInstance.DbManager.UpdateFriendAlias(userID, aliasRequest.FriendID, aliasRequest.Alias)
+	dm := wsm.baseInstance.DbManager
+	before, _ := dm.GetFriendship(userID, aliasRequest.FriendID)
+	err := dm.UpdateFriendAlias(userID, aliasRequest.FriendID, aliasRequest.Alias)
 	if err != nil {
-		log.Printf("更新好友别名失败: %v", err)
-		return
+		return fmt.Errorf("更新好友别名失败: %w", err)
 	}
+	dm.AuditFriendChange(ac, before, &aliasRequest.Alias, nil)
 
 	// 发送通知给用户
 	wsm.sendNotification(userID, "好友别名更新成功")
+	return nil
 }
 
-func (wsm *WebSocketManager) handleSetFriendPrivacy(data []byte, userID uint) {
+func (wsm *WebSocketManager) handleSetFriendPrivacy(data []byte, userID uint, ac database.AuditContext) error {
 	var privacyRequest struct {
 		FriendID  uint `json:"friend_id"`
 		IsPrivate bool `json:"is_private"`
 	}
 	if err := json.Unmarshal(data, &privacyRequest); err != nil {
-		log.Printf("解析设置好友隐私请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析设置好友隐私请求数据失败: %w", err)
 	}
 
-	err := wsm.baseInstance.DbManager.SetFriendPrivacy(userID, privacyRequest.FriendID, privacyRequest.IsPrivate)
+	dm := wsm.baseInstance.DbManager
+	before, _ := dm.GetFriendship(userID, privacyRequest.FriendID)
+	err := dm.SetFriendPrivacy(userID, privacyRequest.FriendID, privacyRequest.IsPrivate)
 	if err != nil {
-		log.Printf("设置好友隐私失败: %v", err)
-		return
+		return fmt.Errorf("设置好友隐私失败: %w", err)
 	}
+	dm.AuditFriendChange(ac, before, nil, &privacyRequest.IsPrivate)
 
 	// 发送通知给用户
 	wsm.sendNotification(userID, "好友隐私设置更新成功")
+	return nil
 }
 
-func (wsm *WebSocketManager) handleAddUserToRoom(data []byte, userID uint) {
+// user_id 为空时添加自己，需要邀请权限
+func (wsm *WebSocketManager) handleAddUserToRoom(data []byte, userID uint, ac database.AuditContext) error {
 	var roomRequest struct {
+		UserID    uint   `json:"user_id"`
 		RoomID    uint   `json:"room_id"`
 		Alias     string `json:"alias"`
 		IsPrivate bool   `json:"is_private"`
+		Role      string `json:"role"`
 	}
 	if err := json.Unmarshal(data, &roomRequest); err != nil {
-		log.Printf("解析添加用户到房间请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析添加用户到房间请求数据失败: %w", err)
+	}
+	if roomRequest.UserID == 0 {
+		roomRequest.UserID = userID
 	}
 
-	err := wsm.baseInstance.DbManager.AddUserToRoom(userID, roomRequest.RoomID, roomRequest.Alias, roomRequest.IsPrivate)
+	dm := wsm.baseInstance.DbManager
+	if _, err := dm.CheckRoomPermission(userID, roomRequest.RoomID, database.ActionInvite); err != nil {
+		return err
+	}
+	err := dm.AddUserToRoom(roomRequest.UserID, roomRequest.RoomID, roomRequest.Alias, roomRequest.IsPrivate, roomRequest.Role)
 	if err != nil {
-		log.Printf("添加用户到房间失败: %v", err)
-		return
+		return fmt.Errorf("添加用户到房间失败: %w", err)
 	}
+	dm.AuditMemberAdd(ac, roomRequest.UserID, roomRequest.RoomID)
 
 	// 发送通知给相关用户
-	wsm.sendNotification(userID, "您已被添加到新的房间")
+	wsm.sendNotification(roomRequest.UserID, "您已被添加到新的房间")
 	// 可以考虑通知房间内的其他成员
+	return nil
 }
 
-func (wsm *WebSocketManager) handleRemoveUserFromRoom(data []byte, userID uint) {
+// user_id 为空时退出房间，移除他人需要踢人权限
+func (wsm *WebSocketManager) handleRemoveUserFromRoom(data []byte, userID uint, ac database.AuditContext) error {
 	var roomRequest struct {
+		UserID uint `json:"user_id"`
 		RoomID uint `json:"room_id"`
 	}
 	if err := json.Unmarshal(data, &roomRequest); err != nil {
-		log.Printf("解析从房间移除用户请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析从房间移除用户请求数据失败: %w", err)
+	}
+	if roomRequest.UserID == 0 {
+		roomRequest.UserID = userID
 	}
 
-	err := wsm.baseInstance.DbManager.RemoveUserFromRoom(userID, roomRequest.RoomID)
+	dm := wsm.baseInstance.DbManager
+	if err := dm.CheckRemoveMember(userID, roomRequest.UserID, roomRequest.RoomID); err != nil {
+		return err
+	}
+	before, _ := dm.GetMembership(roomRequest.UserID, roomRequest.RoomID)
+	err := dm.RemoveUserFromRoom(roomRequest.UserID, roomRequest.RoomID)
 	if err != nil {
-		log.Printf("从房间移除用户失败: %v", err)
-		return
+		return fmt.Errorf("从房间移除用户失败: %w", err)
 	}
+	dm.AuditMemberRemove(ac, before)
 
 	// 发送通知给相关用户
-	wsm.sendNotification(userID, "您已被移出房间")
+	wsm.sendNotification(roomRequest.UserID, "您已被移出房间")
 	// 可以考虑通知房间内的其他成员
+	return nil
 }
 
-func (wsm *WebSocketManager) handleUpdateRoomAlias(data []byte, userID uint) {
+func (wsm *WebSocketManager) handleUpdateRoomAlias(data []byte, userID uint, ac database.AuditContext) error {
 	var aliasRequest struct {
 		RoomID uint   `json:"room_id"`
 		Alias  string `json:"alias"`
 	}
 	if err := json.Unmarshal(data, &aliasRequest); err != nil {
-		log.Printf("解析更新房间别名请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析更新房间别名请求数据失败: %w", err)
 	}
 
-	err := wsm.baseInstance.DbManager.UpdateRoomAlias(userID, aliasRequest.RoomID, aliasRequest.Alias)
+	dm := wsm.baseInstance.DbManager
+	before, _ := dm.GetMembership(userID, aliasRequest.RoomID)
+	err := dm.UpdateRoomAlias(userID, aliasRequest.RoomID, aliasRequest.Alias)
 	if err != nil {
-		log.Printf("更新房间别名失败: %v", err)
-		return
+		return fmt.Errorf("更新房间别名失败: %w", err)
 	}
+	dm.AuditMemberChange(ac, before, &aliasRequest.Alias, nil)
 
 	// 发送通知给用户
 	wsm.sendNotification(userID, "房间别名更新成功")
+	return nil
 }
 
-func (wsm *WebSocketManager) handleSetRoomPrivacy(data []byte, userID uint) {
+func (wsm *WebSocketManager) handleSetRoomPrivacy(data []byte, userID uint, ac database.AuditContext) error {
 	var privacyRequest struct {
 		RoomID    uint `json:"room_id"`
 		IsPrivate bool `json:"is_private"`
 	}
 	if err := json.Unmarshal(data, &privacyRequest); err != nil {
-		log.Printf("解析设置房间隐私请求数据失败: %v", err)
-		return
+		return fmt.Errorf("解析设置房间隐私请求数据失败: %w", err)
 	}
 
-	err := wsm.baseInstance.DbManager.SetRoomPrivacy(userID, privacyRequest.RoomID, privacyRequest.IsPrivate)
+	dm := wsm.baseInstance.DbManager
+	before, _ := dm.GetMembership(userID, privacyRequest.RoomID)
+	err := dm.SetRoomPrivacy(userID, privacyRequest.RoomID, privacyRequest.IsPrivate)
 	if err != nil {
-		log.Printf("设置房间隐私失败: %v", err)
-		return
+		return fmt.Errorf("设置房间隐私失败: %w", err)
 	}
+	dm.AuditMemberChange(ac, before, nil, &privacyRequest.IsPrivate)
 
 	// 发送通知给用户
 	wsm.sendNotification(userID, "房间隐私设置更新成功")
+	return nil
+}
+
+// 置顶或取消置顶房间消息，需要置顶权限
+func (wsm *WebSocketManager) handlePinMessage(data []byte, userID uint, pin bool) error {
+	var pinRequest struct {
+		RoomID uint   `json:"room_id"`
+		MsgID  string `json:"msg_id"`
+	}
+	if err := json.Unmarshal(data, &pinRequest); err != nil {
+		return fmt.Errorf("解析置顶消息请求数据失败: %w", err)
+	}
+
+	dm := wsm.baseInstance.DbManager
+	if _, err := dm.CheckRoomPermission(userID, pinRequest.RoomID, database.ActionPin); err != nil {
+		return err
+	}
+
+	if !pin {
+		if err := dm.UnpinMessage(pinRequest.RoomID, pinRequest.MsgID); err != nil {
+			return err
+		}
+		wsm.sendNotification(userID, "已取消置顶")
+		return nil
+	}
+
+	if _, err := dm.PinMessage(pinRequest.RoomID, pinRequest.MsgID, userID); err != nil {
+		return err
+	}
+	wsm.sendNotification(userID, "消息已置顶")
+	return nil
 }
 
 func (wsm *WebSocketManager) sendNotification(userID uint, message string) {
@@ -364,14 +538,18 @@ func (wsm *WebSocketManager) sendNotification(userID uint, message string) {
 		log.Printf("序列化通知失败: %v", err)
 		return
 	}
-	wsm.sendMessageToUsers(notificationJSON, userID)
+	wsm.SendMessageToUsers(notificationJSON, userID)
 }
 
-func (wsm *WebSocketManager) sendMessageToUsers(message interface{}, userIDs ...uint) {
-	messageJSON, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("序列化消息失败: %v", err)
-		return
+func (wsm *WebSocketManager) SendMessageToUsers(message interface{}, userIDs ...uint) {
+	// 已序列化的消息直接发送，避免被再次编码成 base64 字符串
+	messageJSON, ok := message.([]byte)
+	if !ok {
+		var err error
+		if messageJSON, err = json.Marshal(message); err != nil {
+			log.Printf("序列化消息失败: %v", err)
+			return
+		}
 	}
 
 	wsm.mu.RLock()
@@ -387,6 +565,44 @@ func (wsm *WebSocketManager) sendMessageToUsers(message interface{}, userIDs ...
 	}
 }
 
+// SendEvent 把带序号的事件发送给用户的所有连接，格式为 {"type": 事件名, "seq": 序号, "data": 内容}
+func (wsm *WebSocketManager) SendEvent(userID uint, event string, seq uint64, data interface{}) {
+	wsm.SendMessageToUsers(eventEnvelope(event, seq, data), userID)
+}
+
+func eventEnvelope(event string, seq uint64, data interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": event, "seq": seq, "data": data}
+}
+
+// 补发连接所属设备未确认的事件
+func (wsm *WebSocketManager) replayMissedEvents(conn *Conn) {
+	err := wsm.baseInstance.ReplayMissedEvents(conn.UserID, conn.SessionID, func(event string, data interface{}, meta base.EventMeta) {
+		eventJSON, err := json.Marshal(eventEnvelope(event, meta.Seq, data))
+		if err != nil {
+			log.Printf("序列化事件失败: %v", err)
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, eventJSON); err != nil {
+			log.Printf("补发事件 %d 失败: %v", meta.Seq, err)
+		}
+	})
+	if err != nil {
+		log.Printf("补发用户 %d 的离线事件失败: %v", conn.UserID, err)
+	}
+}
+
+// 确认已收到 seq 及之前的全部事件
+func (wsm *WebSocketManager) handleAck(data json.RawMessage, conn *Conn) error {
+	var seq uint64
+	if err := json.Unmarshal(data, &seq); err != nil {
+		return fmt.Errorf("解析事件序号失败: %w", err)
+	}
+	if _, err := wsm.baseInstance.DbManager.AckEvents(conn.SessionID, conn.UserID, seq); err != nil {
+		return fmt.Errorf("确认事件失败: %w", err)
+	}
+	return nil
+}
+
 func (wsm *WebSocketManager) SendMessage(connType string, message []byte) {
 	wsm.mu.RLock()
 	defer wsm.mu.RUnlock()
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"errors"
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -11,6 +14,21 @@ func GetAllModels() []interface{} {
 		&Message{},
 		&UserFriend{}, // 新增
 		&UserRoom{},   // 新增
+		&Session{},
+		&VerificationToken{},
+		&UserIdentity{},
+		&AccountLockout{},
+		&PinnedMessage{},
+		&AuditLog{},
+		&ConversationState{},
+		&UserEvent{},
+		&UserEventSequence{},
+		&DeviceCursor{},
+		&MessageEdit{},
+		&MessageReaction{},
+		&ThreadParticipant{},
+		&Mention{},
+		&ScheduledMessage{},
 		// 在这里添加新模型
 	}
 }
@@ -21,30 +39,166 @@ type Birthday struct {
 	Day   int64
 }
 
+// 用户状态
+const (
+	UserStatusPending = "pending" // 已注册，邮箱未验证
+	UserStatusActive  = "active"
+)
+
 type User struct {
 	gorm.Model
-	Username  string `gorm:"uniqueIndex"`
-	Password  string
-	Email     string
-	SecretKey string `gorm:"type:varchar(64)"` // 添加这一行
-	WechatID  string `gorm:"uniqueIndex;not null"`
-	Name      string
-	Phone     map[string]string `gorm:"type:json"`
-	Province  string
-	Signature string
-	Type      int
-	Weixin    string
-	Alias     string
-	Avatar    string
-	City      string
-	Gender    string
-	Birthday  *Birthday `gorm:"type:json"`
+	Username        string `gorm:"uniqueIndex"`
+	Password        string `json:"-"`
+	Email           string
+	EmailVerifiedAt *time.Time
+	Status          string `gorm:"type:varchar(16);default:active"`
+	IsAdmin         bool   `gorm:"default:false"`             // 系统管理员，可以解除账号锁定等
+	SecretKey       string `gorm:"type:varchar(64)" json:"-"` // 添加这一行
+	// 两步验证：TOTPSecret 在启用前为待确认状态，恢复码只保存哈希且每个只能使用一次
+	TOTPSecret    string   `gorm:"type:varchar(64)" json:"-"`
+	TOTPEnabled   bool     `json:"totpEnabled"`
+	TOTPLastStep  int64    `json:"-"` // 最近一次使用的验证码时间步，用于拒绝重放
+	RecoveryCodes []string `gorm:"type:json;serializer:json" json:"-"`
+	WechatID      string   `gorm:"uniqueIndex;not null"`
+	Name          string
+	Phone         map[string]string `gorm:"type:json;serializer:json"`
+	Province      string
+	Signature     string
+	Type          int
+	Weixin        string
+	Alias         string
+	Avatar        string
+	City          string
+	Gender        string
+	Birthday      *Birthday  `gorm:"type:json;serializer:json"`
+	LastSeenAt    *time.Time `json:"-"` // 最后在线时间，只通过在线状态接口按好友隐私设置返回
 	// 定义与 Room 的多对多关系
 	Rooms []*Room `gorm:"many2many:user_rooms;"`
 	// 定义与 Message 的一对多关系
 	Messages []Message `gorm:"foreignKey:TalkerID"`
 }
 
+// Session 登录会话，访问令牌通过 sid 关联到会话，刷新令牌每次使用后轮换
+type Session struct {
+	gorm.Model
+	UserID            uint       `gorm:"index;not null" json:"userId"`
+	RefreshTokenHash  string     `gorm:"uniqueIndex;type:varchar(64)" json:"-"`
+	PreviousTokenHash string     `gorm:"index;type:varchar(64)" json:"-"` // 上一个刷新令牌，用于检测重放
+	ExpiresAt         time.Time  `json:"expiresAt"`
+	RevokedAt         *time.Time `json:"revokedAt,omitempty"`
+	DeviceType        string     `json:"deviceType"` // 客户端类型，来自 type 查询参数，如 web、phone、desktop
+	IP                string     `json:"ip"`
+	UserAgent         string     `json:"userAgent"`
+	LastSeenAt        time.Time  `json:"lastSeenAt"`
+	Current           bool       `gorm:"-" json:"current"` // 是否为发起请求的会话
+}
+
+// 验证令牌用途
+const (
+	TokenPurposeEmailVerify   = "email_verify"
+	TokenPurposePasswordReset = "password_reset"
+	TokenPurposeEmailChange   = "email_change"
+)
+
+// VerificationToken 邮件验证/密码重置/修改邮箱令牌，同时支持链接中的令牌和用户手动输入的验证码，只保存哈希
+type VerificationToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index;not null"`
+	Purpose   string `gorm:"type:varchar(32);index"`
+	TokenHash string `gorm:"uniqueIndex;type:varchar(64)"`
+	CodeHash  string `gorm:"type:varchar(64)"`
+	Attempts  int    // 验证码错误次数
+	Email     string // 修改邮箱时待验证的新邮箱
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// UserIdentity 外部身份提供方（OIDC）账号与本地用户的绑定关系
+type UserIdentity struct {
+	gorm.Model
+	UserID   uint   `gorm:"index;not null" json:"userId"`
+	Provider string `gorm:"type:varchar(255);uniqueIndex:idx_identity_provider_subject" json:"provider"` // 提供方 issuer
+	Subject  string `gorm:"type:varchar(255);uniqueIndex:idx_identity_provider_subject" json:"subject"`  // 提供方用户标识 sub
+	Email    string `json:"email"`
+}
+
+// 锁定类型
+const (
+	LockoutTypeAccount = "account"
+	LockoutTypeIP      = "ip"
+)
+
+// AccountLockout 登录失败次数过多导致的锁定记录，管理员可以提前解锁
+type AccountLockout struct {
+	gorm.Model
+	Type        string     `gorm:"type:varchar(16);index" json:"type"` // account 或 ip
+	UserID      uint       `gorm:"index" json:"userId"`                // 账号锁定且用户存在时有值
+	Username    string     `gorm:"index" json:"username"`
+	IP          string     `gorm:"index" json:"ip"`
+	Failures    int        `json:"failures"`
+	LockedUntil time.Time  `json:"lockedUntil"`
+	UnlockedAt  *time.Time `json:"unlockedAt,omitempty"`
+	UnlockedBy  uint       `json:"unlockedBy,omitempty"` // 解锁的管理员 ID
+}
+
+// 审计日志动作
+const (
+	AuditLogin            = "login"
+	AuditLoginFailed      = "login_failed"
+	AuditRegister         = "register"
+	AuditPasswordChange   = "password_change"
+	AuditPasswordReset    = "password_reset"
+	AuditEmailChange      = "email_change"
+	AuditTwoFactorEnable  = "2fa_enable"
+	AuditTwoFactorDisable = "2fa_disable"
+	AuditUserDelete       = "user_delete"
+	AuditUnlock           = "unlock"
+	AuditFriendAdd        = "friend_add"
+	AuditFriendRemove     = "friend_remove"
+	AuditFriendAlias      = "friend_alias"
+	AuditFriendPrivacy    = "friend_privacy"
+	AuditRoomCreate       = "room_create"
+	AuditRoomUpdate       = "room_update"
+	AuditRoomDelete       = "room_delete"
+	AuditRoomMemberAdd    = "room_member_add"
+	AuditRoomMemberRemove = "room_member_remove"
+	AuditRoomAlias        = "room_alias"
+	AuditRoomPrivacy      = "room_privacy"
+	AuditRoomAdminAdd     = "room_admin_add"
+	AuditRoomAdminRemove  = "room_admin_remove"
+)
+
+// 审计对象类型
+const (
+	AuditTargetUser = "user"
+	AuditTargetRoom = "room"
+	AuditTargetIP   = "ip"
+)
+
+// AuditLog 安全和管理操作审计记录，只追加，不允许修改或删除
+type AuditLog struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time `gorm:"index" json:"createdAt"`
+	ActorID    uint      `gorm:"index" json:"actorId"` // 未登录操作（如登录失败）为 0
+	Action     string    `gorm:"type:varchar(32);index" json:"action"`
+	TargetType string    `gorm:"type:varchar(16)" json:"targetType"`
+	TargetID   uint      `gorm:"index" json:"targetId"`
+	RoomID     uint      `gorm:"index" json:"roomId,omitempty"` // 房间成员相关操作所在的房间
+	Before     string    `gorm:"type:text" json:"before,omitempty"`
+	After      string    `gorm:"type:text" json:"after,omitempty"`
+	IP         string    `gorm:"type:varchar(64)" json:"ip"`
+	SessionID  uint      `json:"sessionId,omitempty"`
+	Source     string    `gorm:"type:varchar(16)" json:"source"` // http、socketio 或 websocket
+}
+
+func (a *AuditLog) BeforeUpdate(tx *gorm.DB) error {
+	return errors.New("审计日志不允许修改")
+}
+
+func (a *AuditLog) BeforeDelete(tx *gorm.DB) error {
+	return errors.New("审计日志不允许删除")
+}
+
 type Room struct {
 	gorm.Model
 	Name    string
@@ -58,17 +212,135 @@ type Room struct {
 	Messages []Message `gorm:"foreignKey:RoomID"`
 }
 
+// 历史消息按 (timestamp, id) 分页，房间会话和单聊会话分别建立复合索引
 type Message struct {
 	gorm.Model
+	ID            uint                   `gorm:"primaryKey;index:idx_msg_room_time,priority:3;index:idx_msg_direct_time,priority:4;index:idx_msg_thread,priority:3" json:"id"`
+	MsgID         string                 `gorm:"uniqueIndex" json:"msgId"`
+	TalkerID      uint                   `gorm:"index:idx_msg_direct_time,priority:1" json:"talkerId"`
+	ListenerID    uint                   `gorm:"index:idx_msg_direct_time,priority:2" json:"listenerId"`
+	RoomID        uint                   `gorm:"index:idx_msg_room_time,priority:1" json:"roomId"`
+	Text          map[string]interface{} `gorm:"type:json;serializer:json" json:"text"`
+	Timestamp     int64                  `gorm:"index:idx_msg_room_time,priority:2;index:idx_msg_direct_time,priority:3;index:idx_msg_thread,priority:2" json:"timestamp"`
+	Type          int                    `json:"type"`
+	MentionIDList []uint                 `gorm:"type:json;serializer:json" json:"mentionIdList"`
+	MentionScope  string                 `gorm:"type:varchar(8)" json:"mentionScope,omitempty"`
+	DeliveredAt   *time.Time             `json:"deliveredAt,omitempty"` // 单聊：接收方设备收到的时间
+	ReadAt        *time.Time             `json:"readAt,omitempty"`      // 单聊：接收方已读的时间
+	EditedAt      *time.Time             `json:"editedAt,omitempty"`
+	RecalledAt    *time.Time             `json:"recalledAt,omitempty"` // 撤回后清空内容，只保留占位
+	RecalledBy    uint                   `json:"recalledBy,omitempty"`
+	Reactions     []ReactionCount        `gorm:"-" json:"reactions,omitempty"` // 按查询者汇总，不存储
+	QuoteMsgID    string                 `json:"quoteMsgId,omitempty"`         // 引用的消息
+	// ThreadRootID 所属话题的根消息；根消息上记录话题的回复数和最后回复时间
+	ThreadRootID      string     `gorm:"index:idx_msg_thread,priority:1" json:"threadRootId,omitempty"`
+	ThreadReplyCount  int        `json:"threadReplyCount,omitempty"`
+	ThreadLastReplyAt *time.Time `json:"threadLastReplyAt,omitempty"`
+}
+
+// ThreadParticipant 话题参与者：根消息的发送者和回复过的用户，话题有新回复时通知
+type ThreadParticipant struct {
+	ID            uint      `gorm:"primaryKey" json:"-"`
+	RootMessageID uint      `gorm:"not null;uniqueIndex:idx_thread_participant" json:"-"`
+	UserID        uint      `gorm:"not null;uniqueIndex:idx_thread_participant" json:"userId"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// 提及类型：MentionIDList 中指定的用户、房间所有成员（@all）或房间在线成员（@here），
+// 后两种由房间消息的 MentionScope 指定
+const (
+	MentionUser = "user"
+	MentionAll  = "all"
+	MentionHere = "here"
+)
+
+// Mention 消息提及用户的通知记录，同一消息对同一用户只记录一次，ReadAt 为空表示未读
+type Mention struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;uniqueIndex:idx_mention_user_message,priority:1;index:idx_mention_unread,priority:1" json:"userId"`
+	MessageID uint       `gorm:"not null;uniqueIndex:idx_mention_user_message,priority:2" json:"-"`
+	MsgID     string     `gorm:"not null" json:"msgId"`
+	TalkerID  uint       `json:"talkerId"`
+	RoomID    uint       `json:"roomId"`
+	Timestamp int64      `json:"timestamp"`                    // 消息的 timestamp，会话已读位置越过该消息时标记为已读
+	Scope     string     `gorm:"type:varchar(8)" json:"scope"` // user、all 或 here
+	ReadAt    *time.Time `gorm:"index:idx_mention_unread,priority:2" json:"readAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	Message   *Message   `gorm:"foreignKey:MessageID" json:"message,omitempty"`
+}
+
+// 定时消息状态
+const (
+	ScheduledPending  = "pending"
+	ScheduledSending  = "sending" // 已被发送任务领取
+	ScheduledSent     = "sent"
+	ScheduledFailed   = "failed"
+	ScheduledCanceled = "canceled"
+)
+
+// ScheduledMessage 定时发送的消息，到期后以作者身份发送。MsgID 在创建时确定，
+// 发送中断后重试不会产生重复消息
+type ScheduledMessage struct {
 	ID            uint                   `gorm:"primaryKey" json:"id"`
+	UserID        uint                   `gorm:"not null;index" json:"userId"`
 	MsgID         string                 `gorm:"uniqueIndex" json:"msgId"`
-	TalkerID      uint                   `json:"talkerId"`
 	ListenerID    uint                   `json:"listenerId"`
 	RoomID        uint                   `json:"roomId"`
-	Text          map[string]interface{} `gorm:"type:json" json:"text"`
-	Timestamp     int64                  `json:"timestamp"`
+	Text          map[string]interface{} `gorm:"type:json;serializer:json" json:"text"`
 	Type          int                    `json:"type"`
-	MentionIDList []uint                 `gorm:"type:json" json:"mentionIdList"`
+	MentionIDList []uint                 `gorm:"type:json;serializer:json" json:"mentionIdList"`
+	MentionScope  string                 `gorm:"type:varchar(8)" json:"mentionScope,omitempty"`
+	QuoteMsgID    string                 `json:"quoteMsgId,omitempty"`
+	ThreadRootID  string                 `json:"threadRootId,omitempty"`
+	SendAt        time.Time              `gorm:"index:idx_scheduled_due,priority:2" json:"sendAt"`
+	Status        string                 `gorm:"type:varchar(16);index:idx_scheduled_due,priority:1" json:"status"`
+	Error         string                 `json:"error,omitempty"` // 发送失败的原因
+	SentAt        *time.Time             `json:"sentAt,omitempty"`
+	CreatedAt     time.Time              `json:"createdAt"`
+	UpdatedAt     time.Time              `json:"updatedAt"`
+}
+
+// ToMessage 转换为待发送的消息，发送时间在保存时设置
+func (s *ScheduledMessage) ToMessage() *Message {
+	return &Message{
+		MsgID:         s.MsgID,
+		TalkerID:      s.UserID,
+		ListenerID:    s.ListenerID,
+		RoomID:        s.RoomID,
+		Text:          s.Text,
+		Type:          s.Type,
+		MentionIDList: s.MentionIDList,
+		MentionScope:  s.MentionScope,
+		QuoteMsgID:    s.QuoteMsgID,
+		ThreadRootID:  s.ThreadRootID,
+	}
+}
+
+// MessageReaction 用户对消息的表情回应，同一用户对同一消息的同一表情只记录一次
+type MessageReaction struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_reaction" json:"-"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_reaction" json:"userId"`
+	Emoji     string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_message_reaction" json:"emoji"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReactionCount 消息上某个表情的回应人数，Reacted 表示查询者是否回应过
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// MessageEdit 消息被编辑前的版本，按编辑顺序保存，撤回时一并删除
+type MessageEdit struct {
+	ID            uint                   `gorm:"primaryKey" json:"id"`
+	MessageID     uint                   `gorm:"not null;index" json:"-"`
+	MsgID         string                 `gorm:"not null" json:"msgId"`
+	Text          map[string]interface{} `gorm:"type:json;serializer:json" json:"text"`
+	MentionIDList []uint                 `gorm:"type:json;serializer:json" json:"mentionIdList"`
+	EditedBy      uint                   `json:"editedBy"`
+	CreatedAt     time.Time              `json:"createdAt"` // 被替换的时间
 }
 
 // 新增 UserFriend 结构体
@@ -82,15 +354,75 @@ type UserFriend struct {
 	IsPrivate bool `gorm:"default:false"` // 新增字段：是否为私密好友
 }
 
+// 房间成员角色。房主由 Room.OwnerID 决定，管理员由 Room.Admins 决定，
+// UserRoom.Role 只区分普通成员和访客（只读）
+const (
+	RoomRoleOwner  = "owner"
+	RoomRoleAdmin  = "admin"
+	RoomRoleMember = "member"
+	RoomRoleGuest  = "guest"
+)
+
 // 新增 UserRoom 结构体
 type UserRoom struct {
 	gorm.Model
-	UserID    uint  `gorm:"not null"`
-	RoomID    uint  `gorm:"not null"`
+	UserID    uint  `gorm:"not null;uniqueIndex:idx_user_room"`
+	RoomID    uint  `gorm:"not null;uniqueIndex:idx_user_room"`
 	User      *User `gorm:"foreignKey:UserID"`
 	Room      *Room `gorm:"foreignKey:RoomID"`
 	Alias     string
-	IsPrivate bool `gorm:"default:false"` // 新增字段：是否为私密房间
+	IsPrivate bool   `gorm:"default:false"` // 新增字段：是否为私密房间
+	Role      string `gorm:"type:varchar(16);default:member"`
+}
+
+// PinnedMessage 房间置顶消息
+type PinnedMessage struct {
+	gorm.Model
+	RoomID   uint   `gorm:"not null;uniqueIndex:idx_room_pinned_msg" json:"roomId"`
+	MsgID    string `gorm:"not null;uniqueIndex:idx_room_pinned_msg" json:"msgId"`
+	PinnedBy uint   `json:"pinnedBy"`
+}
+
+// ConversationState 用户在某个会话（单聊对方或房间）中的个人状态。
+// 已读位置按 (timestamp, id) 记录，多端共享，未读数据此计算
+type ConversationState struct {
+	gorm.Model
+	UserID                 uint       `gorm:"not null;uniqueIndex:idx_conversation_state" json:"userId"`
+	PeerID                 uint       `gorm:"not null;uniqueIndex:idx_conversation_state" json:"peerId"`
+	RoomID                 uint       `gorm:"not null;uniqueIndex:idx_conversation_state" json:"roomId"`
+	LastReadTimestamp      int64      `json:"lastReadTimestamp"`
+	LastReadID             uint       `json:"lastReadId"`
+	LastDeliveredTimestamp int64      `json:"lastDeliveredTimestamp"` // 送达位置，已读位置之前的消息也视为已送达
+	LastDeliveredID        uint       `json:"lastDeliveredId"`
+	Muted                  bool       `json:"muted"`
+	Pinned                 bool       `json:"pinned"`
+	PinnedAt               *time.Time `json:"pinnedAt,omitempty"`
+	Archived               bool       `json:"archived"`
+}
+
+// UserEvent 推送给用户的实时事件日志，Seq 按用户连续递增，设备重连后补发未确认的事件
+type UserEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_user_event_seq" json:"-"`
+	Seq       uint64    `gorm:"not null;uniqueIndex:idx_user_event_seq" json:"seq"`
+	Event     string    `gorm:"type:varchar(64)" json:"event"`
+	Payload   string    `gorm:"type:text" json:"-"` // 事件内容的 JSON
+	MessageID uint      `json:"-"`                  // 新消息事件只记录消息 ID，不保存 Payload
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+}
+
+// UserEventSequence 每个用户最近分配的事件序号
+type UserEventSequence struct {
+	UserID  uint `gorm:"primaryKey;autoIncrement:false"`
+	LastSeq uint64
+}
+
+// DeviceCursor 每个设备（登录会话）已确认收到的事件序号
+type DeviceCursor struct {
+	SessionID uint   `gorm:"primaryKey;autoIncrement:false" json:"sessionId"`
+	UserID    uint   `gorm:"index" json:"userId"`
+	AckedSeq  uint64 `json:"ackedSeq"`
+	UpdatedAt time.Time
 }
 
 type FullMessage struct {
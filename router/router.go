@@ -8,7 +8,9 @@ import (
 	"github.com/Ireoo/sixin-server/base"
 	"github.com/Ireoo/sixin-server/config"
 	httpHandler "github.com/Ireoo/sixin-server/internal/http"
+	"github.com/Ireoo/sixin-server/internal/middleware"
 	"github.com/Ireoo/sixin-server/internal/socketio"
+	"github.com/Ireoo/sixin-server/internal/websocket"
 	"github.com/Ireoo/sixin-server/logger"
 	"github.com/gorilla/mux"
 )
@@ -20,17 +22,40 @@ func SetupAndRun(cfg *config.Config) {
 		return
 	}
 
+	// 初始化 JWT 密钥环和会话校验，HTTP 和 Socket.IO 共用
+	if err := middleware.InitAuth(cfg, baseInstance.DbManager); err != nil {
+		logger.Error("初始化 JWT 密钥失败:", err)
+		return
+	}
+
+	// 客户端 IP 只在经过受信任的代理时使用转发请求头
+	if err := middleware.InitTrustedProxies(cfg.TrustedProxies); err != nil {
+		logger.Error("解析受信任的代理失败:", err)
+		return
+	}
+
+	// 定期清理离线事件日志
+	baseInstance.StartEventJanitor(time.Hour)
+
 	r := mux.NewRouter()
 
 	// 设置 Socket.IO 路由
 	ioManager := socketio.NewSocketIOManager(baseInstance)
-	baseInstance.IoManager = ioManager.Io
+	baseInstance.IoManager = ioManager.SetupSocketHandlers()
 	r.Handle("/socket.io/", baseInstance.IoManager.ServeHandler(nil))
 
+	// 设置原生 WebSocket 路由，供无法使用 socket.io 的轻量客户端连接
+	wsManager := websocket.NewWebSocketManager(baseInstance)
+	baseInstance.SetWebSocketManager(wsManager)
+	r.HandleFunc("/ws", wsManager.HandleWebSocket)
+
 	// 设置 HTTP 处理程序
 	httpManager := httpHandler.NewHTTPManager(baseInstance)
 	httpManager.SetupRoutes(r)
 
+	// 发送到期的定时消息，推送依赖上面初始化的实时连接
+	baseInstance.StartScheduledDispatcher(time.Second)
+
 	// 创建 http.Server 实例
 	serverInstance := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),